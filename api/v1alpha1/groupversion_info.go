@@ -0,0 +1,26 @@
+// Package v1alpha1 contains API types of the pfsense.slamdev.net group.
+// +kubebuilder:object:generate=true
+// +groupName=pfsense.slamdev.net
+package v1alpha1
+
+//go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen@v0.19.0 object paths=.
+
+import (
+	"embed"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	GroupVersion = schema.GroupVersion{Group: "pfsense.slamdev.net", Version: "v1alpha1"}
+
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+// CRDs holds custom resource definitions of the group.
+//
+//go:embed *.yaml
+var CRDs embed.FS
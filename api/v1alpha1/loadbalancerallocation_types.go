@@ -0,0 +1,68 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LoadBalancerAllocation records what the controller has exposed in pfsense for a service.
+// It has the same name as the service and is owned by it.
+//
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=lba
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="IPs",type=string,JSONPath=`.status.ips`
+// +kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.status.target`
+// +kubebuilder:printcolumn:name="Pool",type=string,JSONPath=`.status.pool`
+// +kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSyncTime`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type LoadBalancerAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LoadBalancerAllocationSpec   `json:"spec,omitempty"`
+	Status LoadBalancerAllocationStatus `json:"status,omitempty"`
+}
+
+type LoadBalancerAllocationSpec struct {
+	// ServiceName is the name of the service in the same namespace.
+	ServiceName string `json:"serviceName"`
+}
+
+type LoadBalancerAllocationStatus struct {
+	// IPs assigned to the service.
+	IPs []string `json:"ips,omitempty"`
+	// RetiringIPs were assigned to the service before a migration and are released at RetireTime.
+	RetiringIPs []string `json:"retiringIPs,omitempty"`
+	// RetireTime is the time the retiring IPs are released.
+	RetireTime *metav1.Time `json:"retireTime,omitempty"`
+	// Target is the name of the pfsense firewall the IPs are exposed on.
+	Target string `json:"target,omitempty"`
+	// Pool the IPs are allocated from.
+	Pool string `json:"pool,omitempty"`
+	// RuleTrackerIDs of the NAT rules created in pfsense.
+	RuleTrackerIDs []string `json:"ruleTrackerIDs,omitempty"`
+	// VirtualIPIDs of the virtual IPs created in pfsense.
+	VirtualIPIDs []string `json:"virtualIPIDs,omitempty"`
+	// SpecHash is the hash of the service ports that were last synced to pfsense.
+	SpecHash string `json:"specHash,omitempty"`
+	// ApprovedBy is the user who approved exposing the ports, if the controller requires an approval.
+	ApprovedBy string `json:"approvedBy,omitempty"`
+	// ApprovedSpecHash is the hash of the service ports that were approved.
+	ApprovedSpecHash string `json:"approvedSpecHash,omitempty"`
+	// LastSyncTime is the time pfsense was last brought in line with the service.
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+}
+
+// LoadBalancerAllocationList contains a list of LoadBalancerAllocation.
+//
+// +kubebuilder:object:root=true
+type LoadBalancerAllocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []LoadBalancerAllocation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&LoadBalancerAllocation{}, &LoadBalancerAllocationList{})
+}
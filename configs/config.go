@@ -2,8 +2,11 @@ package configs
 
 import (
 	"fmt"
+	"maps"
 	"net/netip"
 	"net/url"
+	"slices"
+	"time"
 
 	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
 )
@@ -24,22 +27,259 @@ type Config struct {
 			BindAddress string
 		}
 	}
-	Pfsense struct {
-		URL      URL
-		Username string
-		Password string
-		Insecure bool
+	Pfsense        Pfsense
+	LeaderElection LeaderElection
+	Controller     Controller
+}
+
+// Pfsense configures a firewall the controller manages.
+type Pfsense struct {
+	Backend  string
+	URL      URL
+	Username string
+	Password string
+	// Credentials replace Username and Password when either the files or the secret are set;
+	// both are read again once they change and whenever pfsense rejects the ones in use
+	Credentials struct {
+		UsernameFile string
+		PasswordFile string
+		Secret       struct {
+			Namespace   string
+			Name        string
+			UsernameKey string
+			PasswordKey string
+			// RefreshInterval is how long the secret is used before it is read again
+			RefreshInterval time.Duration
+		}
+	}
+	// APIKey is used by the rest backend; without it the username and password are exchanged for a JWT
+	APIKey string
+	// APISecret pairs with APIKey for the opnsense backend
+	APISecret string
+	Insecure  bool
+	// Mutations is either "sections", which replaces the whole nat section on every change, or "php",
+	// which changes only the rules of the service on pfsense itself; php needs the xmlrpc backend and pfsense 2.7 or plus 23.01
+	Mutations string
+	// WriteBatchWindow is how long changes are collected to be written to pfsense at once;
+	// changes queued while a write is running are written together with the next one regardless
+	WriteBatchWindow time.Duration
+	// Cache serves config sections from memory while the config revision on pfsense is unchanged; xmlrpc backend only
+	Cache struct {
+		Enabled bool
+		// HealthMaxAge is how long a successful call lets the readiness check skip calling pfsense
+		HealthMaxAge time.Duration
+	}
+	// Health is checked every interval in the background and readiness reports the last result
+	Health struct {
+		Interval time.Duration
+		// FailureThreshold is the number of failed checks in a row that make the target unready
+		FailureThreshold int
+		// Degraded keeps the controller ready while the target is down, also when its circuit breaker is open
+		Degraded bool
+	}
+	// TLS files are reloaded when they change on disk
+	TLS struct {
+		CAFile     string
+		CertFile   string
+		KeyFile    string
+		ServerName string
+		// MinVersion is one of "1.0", "1.1", "1.2" or "1.3"
+		MinVersion string
+	}
+	Timeouts integration.PfsenseTimeouts
+	// Retry applies to transient failures of calls that are safe to repeat
+	Retry struct {
+		Attempts   int
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+	}
+	CircuitBreaker struct {
+		// FailureThreshold is the number of transient failures in a row that opens the circuit
+		FailureThreshold int
+		OpenDuration     time.Duration
+	}
+	// SSH transfers the nat section over ssh; it manages no virtual IPs, so neither pool.carp.vhid nor ha can be set
+	SSH struct {
+		// Address defaults to the url host on port 22
+		Address        string
+		PrivateKeyFile string
+		// HostKey is pinned in the authorized_keys format, e.g. "ssh-ed25519 AAAA..."
+		HostKey string
+	}
+	// Render replaces pushing the config to pfsense with writing nat, filter and virtualip fragments; it renders ip
+	// aliases only, so neither pool.carp.vhid, ha nor php mutations can be set
+	Render struct {
+		// Target is either "file", "configmap" or "git"; empty disables rendering
+		Target string
+		// Dir is used by the file and git targets; for git it has to be inside a working tree
+		Dir       string
+		ConfigMap struct {
+			Namespace string
+			Name      string
+		}
+		Git struct {
+			AuthorName  string
+			AuthorEmail string
+		}
+	}
+	// HA configures a CARP pair, where URL points to the primary; only the xmlrpc backend supports it
+	HA struct {
+		// SecondaryURL is called while the primary is unreachable
+		SecondaryURL URL
+		// Sync pushes the config to the peer after every change instead of waiting for the next sync
+		Sync bool
+	}
+	// Pool defaults to the subnet and exclusions of the controller
+	Pool struct {
+		Subnet     netip.Prefix
+		Exclusions []integration.Range[netip.Addr]
+		// CARP creates a carp virtual IP for every allocated address when VHID is set; only the xmlrpc backend supports it
+		CARP struct {
+			Interface string
+			// VHID is the first vhid handed out; every address takes the next one that is free on the interface
+			VHID     int
+			AdvSkew  int
+			AdvBase  int
+			Password string
+		}
+	}
+	// Targets are the firewalls to manage by name; each inherits the settings it does not set from the ones above,
+	// except for the pool. Without targets the settings above are the only target, named "default".
+	Targets map[string]map[string]any
+	// DefaultTarget manages services that neither select a target nor have an IP yet; empty makes the selection required
+	DefaultTarget string
+}
+
+// DefaultPfsenseTarget names the only target when no targets are configured.
+const DefaultPfsenseTarget = "default"
+
+type PfsenseTarget struct {
+	Name string
+	Pfsense
+}
+
+// PfsenseTargets resolves the firewalls to manage sorted by name. A target without a pool gets the controller one,
+// but pools must not overlap, as services are matched with their target by the pool of their IP.
+func (c Config) PfsenseTargets() ([]PfsenseTarget, error) {
+	if len(c.Pfsense.Targets) == 0 {
+		target := PfsenseTarget{Name: DefaultPfsenseTarget, Pfsense: c.Pfsense}
+		return []PfsenseTarget{c.withControllerPool(target)}, nil
+	}
+	targets := make([]PfsenseTarget, 0, len(c.Pfsense.Targets))
+	for _, name := range slices.Sorted(maps.Keys(c.Pfsense.Targets)) {
+		target := PfsenseTarget{Name: name, Pfsense: c.Pfsense}
+		target.Pool = Pfsense{}.Pool
+		target.Targets = nil
+		if err := integration.DecodeConfig(c.Pfsense.Targets[name], &target.Pfsense); err != nil {
+			return nil, fmt.Errorf("failed to decode pfsense target %s; %w", name, err)
+		}
+		target = c.withControllerPool(target)
+		for _, other := range targets {
+			if other.Pool.Subnet.Overlaps(target.Pool.Subnet) {
+				return nil, fmt.Errorf("pools of pfsense targets %s and %s overlap", other.Name, name)
+			}
+		}
+		targets = append(targets, target)
+	}
+	if _, ok := c.Pfsense.Targets[c.Pfsense.DefaultTarget]; c.Pfsense.DefaultTarget != "" && !ok {
+		return nil, fmt.Errorf("default pfsense target %s is not configured", c.Pfsense.DefaultTarget)
+	}
+	return targets, nil
+}
+
+func (c Config) withControllerPool(target PfsenseTarget) PfsenseTarget {
+	if !target.Pool.Subnet.IsValid() {
+		target.Pool.Subnet, target.Pool.Exclusions = c.Controller.Subnet, c.Controller.Exclusions
+	}
+	if target.Pool.CARP.Interface == "" {
+		target.Pool.CARP.Interface = "wan"
 	}
-	Controller Controller
+	return target
 }
 
+type LeaderElection struct {
+	Enabled       bool
+	Namespace     string
+	ID            string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+const (
+	PfsenseBackendXMLRPC   = "xmlrpc"
+	PfsenseBackendREST     = "rest"
+	PfsenseBackendOPNsense = "opnsense"
+	PfsenseBackendSSH      = "ssh"
+)
+
+const (
+	PfsenseMutationsSections = "sections"
+	PfsenseMutationsPHP      = "php"
+)
+
+const (
+	OutOfPoolPolicyFlag    = "flag"
+	OutOfPoolPolicyMigrate = "migrate"
+)
+
+const (
+	RenderTargetFile      = "file"
+	RenderTargetConfigMap = "configmap"
+	RenderTargetGit       = "git"
+)
+
 type Controller struct {
-	DryRun              bool
-	LoadBalancerClass   string
+	DryRun            bool
+	InstallCRDs       bool
+	LoadBalancerClass string
+	// PortsHashAnnotation is where versions before the LoadBalancerAllocation kept the synced ports of a service;
+	// it is only read to move the hash to the allocation and then removed from the service
 	PortsHashAnnotation string
 	FinalizerName       string
 	Subnet              netip.Prefix
 	Exclusions          []integration.Range[netip.Addr]
+	// MaxConcurrentReconciles lets the writes of several services be batched into one pfsense write
+	MaxConcurrentReconciles int
+	// Watch limits the services that are cached; empty namespaces watch all of them
+	Watch struct {
+		Namespaces    []string
+		LabelSelector string
+	}
+	OutOfPool struct {
+		// Policy is either "flag" or "migrate"
+		Policy  string
+		Overlap time.Duration
+	}
+	// Rollback snapshots the pfsense config sections before every write and restores them when the write fails;
+	// the last History snapshots are kept in memory. Only the backends that replace config sections can roll back,
+	// so the controller does not start with it on a rest or opnsense target or with php mutations
+	Rollback struct {
+		Enabled bool
+		History int
+		// ServeSnapshots serves the snapshots as json on /snapshots of the metrics server, which has neither
+		// authentication nor authorization, so it is off unless the metrics port is reachable by admins only
+		ServeSnapshots bool
+	}
+	// ConfigWatch reconciles all services when the pfsense config changes, polled every interval; zero disables it
+	ConfigWatch struct {
+		Interval time.Duration
+	}
+	// Approval reserves the IP of a service but exposes its ports only once they are approved with an annotation of
+	// the approver and the hash of the ports; it requires the admission policy of config/admission/approval-policy.yaml,
+	// which makes sure users can only name themselves as the approver, and the controller does not start without it
+	Approval struct {
+		Required bool
+	}
+	// Maintenance holds allocations and port changes back until a window is open; no windows means always open
+	Maintenance struct {
+		TimeZone string
+		Windows  []struct {
+			// Schedule is a five field cron expression of when a window opens
+			Schedule string
+			Duration time.Duration
+		}
+	}
 }
 
 type URL url.URL
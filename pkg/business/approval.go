@@ -0,0 +1,185 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ApprovedByAnnotation names the user who approves exposing the ports of the service and the ports they approve,
+// as <user>@<ports hash>, if the controller requires an approval. The hash is the one the controller asks for while
+// the service waits for an approval, so a port change after the approver looked at them is not approved. The user has to be allowed to "approve" the loadbalancerallocation of the service, which is
+// checked with a SubjectAccessReview of the user name alone, so the permission has to be bound to the user and not
+// to a group. The review is of the user named in the annotation, not of the one who set it, which only the admission
+// policy ApprovalPolicyName ties together, see CheckApprovalPolicy.
+const ApprovedByAnnotation = annotationPrefix + "approved-by"
+
+// ApprovalPolicyName names the ValidatingAdmissionPolicy of config/admission/approval-policy.yaml and its binding,
+// which only let users set ApprovedByAnnotation to their own name and to a ports hash.
+const ApprovalPolicyName = "pfsense-k8s-lb-controller-approved-by"
+
+const (
+	// conditionTypeApproved is set while the controller requires an approval
+	conditionTypeApproved = "Approved"
+	approveVerb           = "approve"
+)
+
+// CheckApprovalPolicy makes sure the approval admission policy is installed and denies what it does not validate;
+// without it anyone who may edit the service could name a user who is allowed to approve.
+func CheckApprovalPolicy(ctx context.Context, k8s client.Reader) error {
+	var policy admissionregistrationv1.ValidatingAdmissionPolicy
+	if err := k8s.Get(ctx, client.ObjectKey{Name: ApprovalPolicyName}, &policy); err != nil {
+		return fmt.Errorf("get validating admission policy %s: %w", ApprovalPolicyName, err)
+	}
+	var binding admissionregistrationv1.ValidatingAdmissionPolicyBinding
+	if err := k8s.Get(ctx, client.ObjectKey{Name: ApprovalPolicyName}, &binding); err != nil {
+		return fmt.Errorf("get validating admission policy binding %s: %w", ApprovalPolicyName, err)
+	}
+	if binding.Spec.PolicyName != ApprovalPolicyName || !slices.Contains(binding.Spec.ValidationActions, admissionregistrationv1.Deny) {
+		return fmt.Errorf("validating admission policy binding %s does not deny what policy %s rejects", ApprovalPolicyName, ApprovalPolicyName)
+	}
+	return nil
+}
+
+// approve returns the user who approved the current ports of the service, or a message of what the service waits for.
+// An approval is for the ports whose hash it names: once they change, the annotation is removed and the ports have to
+// be approved again.
+func (r *reconciler) approve(ctx context.Context, svc *corev1.Service, lba *v1alpha1.LoadBalancerAllocation, portsHash string) (string, string, error) {
+	annotation := svc.Annotations[ApprovedByAnnotation]
+	approver, approvedPorts := parseApproval(annotation)
+	var approvedBy, approvedHash string
+	if lba != nil {
+		approvedBy, approvedHash = lba.Status.ApprovedBy, lba.Status.ApprovedSpecHash
+	}
+
+	switch {
+	case annotation == "":
+		return "", fmt.Sprintf("waiting for an approver to set the %s annotation to <user>@%s", ApprovedByAnnotation, portsHash), r.clearApproval(ctx, lba)
+	case approvedPorts != portsHash:
+		if err := r.revokeApproval(ctx, svc, lba); err != nil {
+			return "", "", err
+		}
+		log.FromContext(ctx).V(0).Info("approval is for other ports, approval revoked", "approvedBy", approver)
+		return "", fmt.Sprintf("%s approved other ports than the current ones, waiting for an approver to set the %s annotation to <user>@%s",
+			approver, ApprovedByAnnotation, portsHash), nil
+	case approver == approvedBy && approvedHash == portsHash:
+		return approver, "", nil
+	}
+
+	allowed, reason, err := r.reviewApprover(ctx, svc, approver)
+	if err != nil {
+		return "", "", err
+	}
+	if !allowed {
+		message := fmt.Sprintf("%s is not allowed to approve load balancers in namespace %s", approver, svc.Namespace)
+		if reason != "" {
+			message += ": " + reason
+		}
+		return "", message, nil
+	}
+	log.FromContext(ctx).V(0).Info("ports approved", "approvedBy", approver)
+	return approver, "", nil
+}
+
+// parseApproval splits ApprovedByAnnotation into the user and the ports hash; the user name may contain an @ itself
+func parseApproval(annotation string) (string, string) {
+	i := strings.LastIndex(annotation, "@")
+	if i < 0 {
+		return annotation, ""
+	}
+	return annotation[:i], annotation[i+1:]
+}
+
+// reviewApprover asks the api server whether the user may approve the allocation of the service
+func (r *reconciler) reviewApprover(ctx context.Context, svc *corev1.Service, user string) (bool, string, error) {
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User: user,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: svc.Namespace,
+				Verb:      approveVerb,
+				Group:     v1alpha1.GroupVersion.Group,
+				Resource:  "loadbalancerallocations",
+				Name:      svc.Name,
+			},
+		},
+	}
+	if err := r.k8s.Create(ctx, review); err != nil {
+		return false, "", fmt.Errorf("review approver: %w", err)
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// revokeApproval removes the annotation before the recorded approval, so a failure in between leaves the service
+// waiting for an approval rather than approved
+func (r *reconciler) revokeApproval(ctx context.Context, svc *corev1.Service, lba *v1alpha1.LoadBalancerAllocation) error {
+	patch := client.MergeFromWithOptions(svc.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	delete(svc.Annotations, ApprovedByAnnotation)
+	if err := r.k8s.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("remove approval: %w", err)
+	}
+	return r.clearApproval(ctx, lba)
+}
+
+func (r *reconciler) clearApproval(ctx context.Context, lba *v1alpha1.LoadBalancerAllocation) error {
+	if lba == nil || (lba.Status.ApprovedBy == "" && lba.Status.ApprovedSpecHash == "") {
+		return nil
+	}
+	patch := client.MergeFromWithOptions(lba.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	lba.Status.ApprovedBy, lba.Status.ApprovedSpecHash = "", ""
+	if err := r.k8s.Status().Patch(ctx, lba, patch); err != nil {
+		return fmt.Errorf("clear approval: %w", err)
+	}
+	return nil
+}
+
+// waitForApproval reserves the IP of a service whose ports are not approved, without writing any rule. A new IP is
+// recorded in the allocation, so the approver can see where the ports are going to be exposed; the rules of ports
+// that were approved before are left as they are.
+func (r *reconciler) waitForApproval(ctx context.Context, svc *corev1.Service, target PfsenseTarget, ip string) error {
+	allocation, err := target.Service.ReserveIP(ctx, svc.Namespace, svc.Name, ip)
+	if ip != "" {
+		// an IP outside of every pool cannot be handed out anyway
+		if err != nil && !errors.Is(err, ErrIPOutsidePool) {
+			return fmt.Errorf("reserve IP: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reserve IP: %w", err)
+	}
+	if err := r.saveAllocation(ctx, svc, newAllocationStatus(target, allocation, "", "")); err != nil {
+		// Failed to persist — release the IP to avoid leak
+		rerr := target.Service.ReleaseIP(ctx, allocation.IP)
+		return fmt.Errorf("save allocation: %w", errors.Join(err, rerr))
+	}
+	log.FromContext(ctx).V(0).Info("reserved load balancer IP until the ports are approved", "ip", allocation.IP)
+	return nil
+}
+
+func approvalCondition(approvedBy string, pending string) metav1.Condition {
+	if pending != "" {
+		return metav1.Condition{
+			Type:    conditionTypeApproved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "PendingApproval",
+			Message: pending,
+		}
+	}
+	return metav1.Condition{
+		Type:    conditionTypeApproved,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Approved",
+		Message: fmt.Sprintf("ports are approved by %s", approvedBy),
+	}
+}
@@ -0,0 +1,166 @@
+package business
+
+import (
+	"context"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func Test_should_expose_ports_only_once_they_are_approved(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Finalizers: []string{finalizer}},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: integration.ToPointer(class),
+			Ports:             []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	k8s := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(svc).
+		WithStatusSubresource(&corev1.Service{}, &v1alpha1.LoadBalancerAllocation{}).
+		WithInterceptorFuncs(interceptor.Funcs{Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if review, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+				review.Status.Allowed = review.Spec.User == "alice" && review.Spec.ResourceAttributes.Verb == "approve"
+				return nil
+			}
+			return c.Create(ctx, obj, opts...)
+		}}).
+		Build()
+	pfsense := &exposingService{}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", class, finalizer, "", OutOfPoolPolicyFlag, 0, nil, true)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+	reconcileAndGet := func() (*corev1.Service, *v1alpha1.LoadBalancerAllocation) {
+		_, err := r.Reconcile(t.Context(), req)
+		require.NoError(t, err)
+		var svc corev1.Service
+		var lba v1alpha1.LoadBalancerAllocation
+		require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &svc))
+		require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &lba))
+		return &svc, &lba
+	}
+	approve := func(user string) {
+		svc, _ := reconcileAndGet()
+		svc.Annotations = map[string]string{ApprovedByAnnotation: user + "@" + computePortsHash(extractServicePorts(svc))}
+		require.NoError(t, k8s.Update(t.Context(), svc))
+	}
+
+	// the IP is reserved, but nothing is exposed
+	got, lba := reconcileAndGet()
+	require.Equal(t, []string{"10.0.0.1"}, lba.Status.IPs)
+	require.Empty(t, lba.Status.SpecHash)
+	require.Empty(t, got.Status.LoadBalancer.Ingress)
+	require.True(t, meta.IsStatusConditionFalse(got.Status.Conditions, conditionTypeApproved))
+	require.Equal(t, []string{"reserve "}, pfsense.calls)
+
+	approve("mallory")
+	got, lba = reconcileAndGet()
+	require.Contains(t, meta.FindStatusCondition(got.Status.Conditions, conditionTypeApproved).Message, "mallory is not allowed")
+	require.Empty(t, lba.Status.ApprovedBy)
+
+	// an approval of the ports before they changed does not approve the new ones
+	stale := computePortsHash([]ServicePort{{Name: "http", Protocol: "TCP", NodePort: 30081}})
+	got.Annotations = map[string]string{ApprovedByAnnotation: "alice@" + stale}
+	require.NoError(t, k8s.Update(t.Context(), got))
+	got, lba = reconcileAndGet()
+	require.Contains(t, meta.FindStatusCondition(got.Status.Conditions, conditionTypeApproved).Message, "alice approved other ports")
+	require.NotContains(t, got.Annotations, ApprovedByAnnotation)
+	require.Empty(t, lba.Status.ApprovedBy)
+	require.NotContains(t, pfsense.calls, "update 10.0.0.1")
+
+	approve("alice")
+	got, lba = reconcileAndGet()
+	require.True(t, meta.IsStatusConditionTrue(got.Status.Conditions, conditionTypeApproved))
+	require.Equal(t, "alice", lba.Status.ApprovedBy)
+	require.Equal(t, lba.Status.SpecHash, lba.Status.ApprovedSpecHash)
+	require.Equal(t, "10.0.0.1", got.Status.LoadBalancer.Ingress[0].IP)
+	require.Contains(t, pfsense.calls, "update 10.0.0.1")
+
+	// a port change has to be approved again
+	pfsense.calls = nil
+	got.Spec.Ports = append(got.Spec.Ports, corev1.ServicePort{Name: "https", Protocol: corev1.ProtocolTCP, Port: 443, NodePort: 30443})
+	require.NoError(t, k8s.Update(t.Context(), got))
+	got, lba = reconcileAndGet()
+	require.NotContains(t, got.Annotations, ApprovedByAnnotation)
+	require.Empty(t, lba.Status.ApprovedBy)
+	require.True(t, meta.IsStatusConditionFalse(got.Status.Conditions, conditionTypeApproved))
+	require.Equal(t, []string{"reserve 10.0.0.1"}, pfsense.calls)
+}
+
+// exposingService records the calls that reserve or expose an IP
+type exposingService struct {
+	PfsenseService
+	calls []string
+}
+
+func (s *exposingService) AllocateIP(_ context.Context, _ string, _ string, _ string, _ []ServicePort) (Allocation, error) {
+	s.calls = append(s.calls, "allocate")
+	return Allocation{IP: "10.0.0.1", Pool: "10.0.0.0/24"}, nil
+}
+
+func (s *exposingService) ReserveIP(_ context.Context, _ string, _ string, ip string) (Allocation, error) {
+	s.calls = append(s.calls, "reserve "+ip)
+	return Allocation{IP: "10.0.0.1", Pool: "10.0.0.0/24"}, nil
+}
+
+func (s *exposingService) UpdatePorts(_ context.Context, _ string, _ string, _ string, ip string, _ []ServicePort) (Allocation, error) {
+	s.calls = append(s.calls, "update "+ip)
+	return Allocation{IP: ip, Pool: "10.0.0.0/24"}, nil
+}
+
+func (s *exposingService) EnsureIP(_ context.Context, _ string, _ string, _ string, ip string, _ []ServicePort) (Allocation, error) {
+	s.calls = append(s.calls, "ensure "+ip)
+	return Allocation{IP: ip, Pool: "10.0.0.0/24"}, nil
+}
+
+func (s *exposingService) ReleaseIP(_ context.Context, ip string) error {
+	s.calls = append(s.calls, "release "+ip)
+	return nil
+}
+
+func (s *exposingService) IsInPool(_ string) bool {
+	return true
+}
+
+func Test_should_require_the_approval_admission_policy_to_be_installed(t *testing.T) {
+	t.Parallel()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	policy := &admissionregistrationv1.ValidatingAdmissionPolicy{ObjectMeta: metav1.ObjectMeta{Name: ApprovalPolicyName}}
+	binding := &admissionregistrationv1.ValidatingAdmissionPolicyBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: ApprovalPolicyName},
+		Spec: admissionregistrationv1.ValidatingAdmissionPolicyBindingSpec{
+			PolicyName:        ApprovalPolicyName,
+			ValidationActions: []admissionregistrationv1.ValidationAction{admissionregistrationv1.Audit},
+		},
+	}
+
+	require.ErrorContains(t, CheckApprovalPolicy(t.Context(), fake.NewClientBuilder().WithScheme(scheme).Build()), "not found")
+	require.ErrorContains(t, CheckApprovalPolicy(t.Context(), fake.NewClientBuilder().WithScheme(scheme).WithObjects(policy).Build()), "not found")
+	// a binding that only audits lets anyone name another user as the approver
+	require.ErrorContains(t, CheckApprovalPolicy(t.Context(), fake.NewClientBuilder().WithScheme(scheme).WithObjects(policy, binding).Build()), "does not deny")
+
+	binding.Spec.ValidationActions = []admissionregistrationv1.ValidationAction{admissionregistrationv1.Deny}
+	require.NoError(t, CheckApprovalPolicy(t.Context(), fake.NewClientBuilder().WithScheme(scheme).WithObjects(policy, binding).Build()))
+}
@@ -0,0 +1,265 @@
+package business
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+const (
+	virtualIPConfigSection = "virtualip"
+	maxVHID                = 255
+	// pfsenseSyncPeerScript makes pfsense push its config to the HA peer the same way a change in the web ui does
+	pfsenseSyncPeerScript = `require_once("util.inc"); send_event("filter sync");`
+)
+
+// CARPConfig describes the carp virtual IPs created for the allocated addresses of a pool.
+type CARPConfig struct {
+	Interface string
+	// VHID is the first vhid handed out; every address takes the next one that is free on the interface
+	VHID     int
+	AdvSkew  int
+	AdvBase  int
+	Password string
+}
+
+// NewPfsenseHAService manages a CARP pair through the XML-RPC backend: with a vhid every allocated address gets
+// a carp virtual IP and, with syncPeer, every change is pushed to the peer right away instead of on the next sync.
+func NewPfsenseHAService(client *integration.PfsenseClient, carp CARPConfig, syncPeer bool, dryRun bool, writeWindow time.Duration, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	svc := withNATWriter(&pfsenseService{
+		pool:     newPool(subnet, exclusions),
+		client:   client,
+		sections: xmlrpcNATSections{client: client},
+		syncPeer: syncPeer,
+		dryRun:   dryRun,
+	}, writeWindow)
+	if carp.VHID > 0 {
+		svc.carp = &carp
+	}
+	return svc
+}
+
+// ensureVIP creates the carp virtual IP of the service for the address if it is missing and returns its id;
+// without carp there is nothing to create. The virtualip section is replaced as a whole, so the change goes
+// through the writer like the nat section and concurrent reconciles neither lose virtual IPs nor share a vhid.
+func (s *pfsenseService) ensureVIP(ctx context.Context, namespace string, name string, ip string) ([]string, error) {
+	if s.carp == nil {
+		return nil, nil
+	}
+	var ids []string
+	err := s.writer.exec(ctx, func(ctx context.Context) (err error) {
+		ids, err = s.ensureVIPLocked(ctx, namespace, name, ip)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ensureVIPLocked is ensureVIP for a caller that already runs on the writer.
+func (s *pfsenseService) ensureVIPLocked(ctx context.Context, namespace string, name string, ip string) ([]string, error) {
+	if s.carp == nil {
+		return nil, nil
+	}
+	section, err := s.fetchVirtualIPSection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch virtualip section; %w", err)
+	}
+	vips := integration.FromPtr(section.VIP)
+	if existing := integration.FilterSlice(vips, isVIPOf(s.carp.Interface, namespace, name, ip)); len(existing) > 0 {
+		return []string{integration.FromPtr(existing[0].Uniqid)}, nil
+	}
+	if slices.ContainsFunc(vips, vipHasAddress(ip)) {
+		return nil, fmt.Errorf("virtual IP %s exists in pfsense and is not the carp virtual IP of %s/%s", ip, namespace, name)
+	}
+
+	vhid, err := s.freeVHID(vips)
+	if err != nil {
+		return nil, err
+	}
+	created := vip{
+		Mode:       integration.ToPointer("carp"),
+		Interface:  integration.ToPointer(s.carp.Interface),
+		Uniqid:     integration.ToPointer(strconv.FormatInt(time.Now().UnixMicro(), 16)),
+		Descr:      integration.ToPointer(namespace + "/" + name),
+		Type:       integration.ToPointer("single"),
+		Subnet:     &ip,
+		SubnetBits: integration.ToPointer("32"),
+		Vhid:       integration.ToPointer(strconv.Itoa(vhid)),
+		Advskew:    integration.ToPointer(strconv.Itoa(s.carp.AdvSkew)),
+		Advbase:    integration.ToPointer(strconv.Itoa(max(1, s.carp.AdvBase))),
+		Password:   integration.ToPointer(s.carp.Password),
+	}
+	slog.InfoContext(ctx, "creating carp virtual IP in pfsense", "ip", ip, "vhid", vhid)
+	section.VIP = integration.ToPointer(append(vips, created))
+	if err := s.saveVirtualIPSection(ctx, section); err != nil {
+		return nil, fmt.Errorf("failed to save virtualip section; %w", err)
+	}
+	return []string{integration.FromPtr(created.Uniqid)}, nil
+}
+
+// releaseVIP removes the carp virtual IPs the controller created for the address through the writer;
+// the virtual IPs someone added to pfsense for the address are left alone.
+func (s *pfsenseService) releaseVIP(ctx context.Context, ip string) error {
+	if s.carp == nil {
+		return nil
+	}
+	return s.writer.exec(ctx, func(ctx context.Context) error {
+		section, err := s.fetchVirtualIPSection(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch virtualip section; %w", err)
+		}
+		vips := integration.FromPtr(section.VIP)
+		remaining := integration.FilterSlice(vips, not(isOwnedVIPAt(s.carp.Interface, ip)))
+		if len(remaining) == len(vips) {
+			return nil
+		}
+		section.VIP = &remaining
+		if err := s.saveVirtualIPSection(ctx, section); err != nil {
+			return fmt.Errorf("failed to save virtualip section; %w", err)
+		}
+		return nil
+	})
+}
+
+// freeVHID returns the first vhid from the configured one that no carp virtual IP uses on the interface.
+func (s *pfsenseService) freeVHID(vips []vip) (int, error) {
+	used := map[int]bool{}
+	for _, v := range vips {
+		if integration.FromPtr(v.Mode) != "carp" || integration.FromPtr(v.Interface) != s.carp.Interface {
+			continue
+		}
+		if vhid, err := strconv.Atoi(integration.FromPtr(v.Vhid)); err == nil {
+			used[vhid] = true
+		}
+	}
+	for vhid := s.carp.VHID; vhid <= maxVHID; vhid++ {
+		if !used[vhid] {
+			return vhid, nil
+		}
+	}
+	return 0, fmt.Errorf("no free vhid from %d on interface %s", s.carp.VHID, s.carp.Interface)
+}
+
+// syncPeerConfig pushes the config to the HA peer; a primary that is down cannot sync, and the secondary
+// it failed over to has nothing to sync to, so the skipped sync is only logged.
+func (s *pfsenseService) syncPeerConfig(ctx context.Context) error {
+	if !s.syncPeer {
+		return nil
+	}
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, peer config sync skipped")
+		return nil
+	}
+	if err := s.execPhp(ctx, pfsenseSyncPeerScript); err != nil {
+		if integration.IsTransient(err) {
+			slog.WarnContext(ctx, "failed to trigger peer config sync", "error", err)
+			return nil
+		}
+		return fmt.Errorf("failed to sync peer config; %w", err)
+	}
+	return nil
+}
+
+func (s *pfsenseService) fetchVirtualIPSection(ctx context.Context) (vipSection, error) {
+	req := &struct{ Data []string }{Data: []string{virtualIPConfigSection}}
+	res := &integration.NestedXMLRPC[vipSectionStruct]{}
+	if err := s.client.Read(ctx, "pfsense.backup_config_section", req, res); err != nil {
+		return vipSection{}, fmt.Errorf("failed to call %s; %w", "backup_config_section", err)
+	}
+	return integration.FromPtr(res.Nested.Virtualip), nil
+}
+
+func (s *pfsenseService) saveVirtualIPSection(ctx context.Context, section vipSection) error {
+	if s.dryRun {
+		// the section is not logged as it holds the carp passwords
+		slog.InfoContext(ctx, "dry run enabled, virtualip section restore skipped", "vips", len(integration.FromPtr(section.VIP)))
+		return nil
+	}
+	err := writeSection(ctx, s, virtualIPConfigSection, s.fetchVirtualIPSection, s.restoreVirtualIPSection, redactVirtualIPs,
+		func(ctx context.Context) error { return s.restoreVirtualIPSection(ctx, section) })
+	if err != nil {
+		return err
+	}
+	return s.verifyVirtualIPSection(ctx, section)
+}
+
+func (s *pfsenseService) restoreVirtualIPSection(ctx context.Context, section vipSection) error {
+	// pfsense brings the virtual IPs up and down itself when the section is restored over XML-RPC
+	req := &struct {
+		Sections any
+		Timeout  int
+	}{
+		Sections: map[string]any{virtualIPConfigSection: section},
+		Timeout:  integration.TimeoutSeconds(s.client.Timeouts().Write),
+	}
+	res := &integration.OperationResult{}
+	if err := s.client.Write(ctx, "pfsense.restore_config_section", req, res); err != nil {
+		return fmt.Errorf("failed to call %s; %w", "restore_config_section", err)
+	}
+	if !res.Success {
+		return integration.NewRejectedError("pfsense.restore_config_section")
+	}
+	return nil
+}
+
+func vipHasAddress(ip string) func(vip) bool {
+	return func(v vip) bool {
+		return strings.TrimSpace(integration.FromPtr(v.Subnet)) == ip
+	}
+}
+
+// isOwnedVIPAt matches the carp virtual IPs of the controller for the address, whose descr names the service
+func isOwnedVIPAt(iface string, ip string) func(vip) bool {
+	return func(v vip) bool {
+		return vipHasAddress(ip)(v) && integration.FromPtr(v.Mode) == "carp" && integration.FromPtr(v.Interface) == iface &&
+			ownerDescr.MatchString(integration.FromPtr(v.Descr))
+	}
+}
+
+// isVIPOf matches the carp virtual IP the controller created for the service
+func isVIPOf(iface string, namespace string, name string, ip string) func(vip) bool {
+	return func(v vip) bool {
+		return isOwnedVIPAt(iface, ip)(v) && integration.FromPtr(v.Descr) == namespace+"/"+name
+	}
+}
+
+// redactVirtualIPs drops the carp passwords from the section kept in the snapshot history
+func redactVirtualIPs(section vipSection) any {
+	vips := slices.Clone(integration.FromPtr(section.VIP))
+	for i := range vips {
+		vips[i].Password = nil
+	}
+	return vipSection{VIP: &vips}
+}
+
+type vipSectionStruct struct {
+	Virtualip *vipSection `xmlrpc:"virtualip" json:"virtualip,omitempty" xml:"virtualip,omitempty"`
+}
+
+type vipSection struct {
+	VIP *[]vip `xmlrpc:"vip" json:"vip,omitempty" xml:"vip,omitempty"`
+}
+
+type vip struct {
+	Mode       *string `xmlrpc:"mode" json:"mode,omitempty" xml:"mode,omitempty"`
+	Interface  *string `xmlrpc:"interface" json:"interface,omitempty" xml:"interface,omitempty"`
+	Uniqid     *string `xmlrpc:"uniqid" json:"uniqid,omitempty" xml:"uniqid,omitempty"`
+	Descr      *string `xmlrpc:"descr" json:"descr,omitempty" xml:"descr,omitempty"`
+	Type       *string `xmlrpc:"type" json:"type,omitempty" xml:"type,omitempty"`
+	Subnet     *string `xmlrpc:"subnet" json:"subnet,omitempty" xml:"subnet,omitempty"`
+	SubnetBits *string `xmlrpc:"subnet_bits" json:"subnet_bits,omitempty" xml:"subnet_bits,omitempty"`
+	Vhid       *string `xmlrpc:"vhid" json:"vhid,omitempty" xml:"vhid,omitempty"`
+	Advskew    *string `xmlrpc:"advskew" json:"advskew,omitempty" xml:"advskew,omitempty"`
+	Advbase    *string `xmlrpc:"advbase" json:"advbase,omitempty" xml:"advbase,omitempty"`
+	Password   *string `xmlrpc:"password" json:"password,omitempty" xml:"password,omitempty"`
+	Noexpand   *string `xmlrpc:"noexpand" json:"noexpand,omitempty" xml:"noexpand,omitempty"`
+}
@@ -0,0 +1,60 @@
+package business
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// annotationPrefix is shared by all annotations the controller reads
+const annotationPrefix = "pfsense.slamdev.net/"
+
+// ServiceTransform drops what the controller never reads from the cached services: the managed fields
+// and every annotation but its own, e.g. the last applied configuration kept by kubectl.
+// The ports hash annotation of older versions is kept until the reconcile removes it; empty is its default key.
+// Services are changed with patches only, so the stripped fields are never written back.
+func ServiceTransform(portsHashAnnotation string) func(in any) (any, error) {
+	if portsHashAnnotation == "" {
+		portsHashAnnotation = legacyPortsHashAnnotation
+	}
+	return func(in any) (any, error) {
+		svc, ok := in.(*corev1.Service)
+		if !ok {
+			return in, nil
+		}
+		svc.ManagedFields = nil
+		for key := range svc.Annotations {
+			if !strings.HasPrefix(key, annotationPrefix) && key != portsHashAnnotation {
+				delete(svc.Annotations, key)
+			}
+		}
+		return svc, nil
+	}
+}
+
+// ServicePredicate lets through the services of the load balancer class and the ones that still have the finalizer,
+// e.g. after their type changed; an update passes if either version does, so the change away from the class is seen.
+func ServicePredicate(loadBalancerClass string, finalizerName string) predicate.Predicate {
+	relevant := func(obj client.Object) bool {
+		svc, ok := obj.(*corev1.Service)
+		return ok && isManagedService(svc, loadBalancerClass, finalizerName)
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return relevant(e.Object) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return relevant(e.Object) },
+		GenericFunc: func(e event.GenericEvent) bool { return relevant(e.Object) },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return relevant(e.ObjectOld) || relevant(e.ObjectNew)
+		},
+	}
+}
+
+// isManagedService reports whether the controller has to look at the service: it is of the class
+// or it still holds pfsense objects that need to be released.
+func isManagedService(svc *corev1.Service, loadBalancerClass string, finalizerName string) bool {
+	return isLoadBalancerOfClass(svc, loadBalancerClass) || controllerutil.ContainsFinalizer(svc, finalizerName)
+}
@@ -0,0 +1,44 @@
+package business
+
+import (
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func Test_should_cache_and_queue_only_relevant_services(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "svc",
+			Annotations: map[string]string{
+				TargetAnnotation: "site-a",
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				"example.com/ports-hash":                           "hash",
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerClass: integration.ToPointer(class)},
+	}
+	transformed, err := ServiceTransform("example.com/ports-hash")(svc.DeepCopy())
+	require.NoError(t, err)
+	require.Empty(t, transformed.(*corev1.Service).ManagedFields)
+	require.Equal(t, map[string]string{TargetAnnotation: "site-a", "example.com/ports-hash": "hash"}, transformed.(*corev1.Service).Annotations)
+
+	predicate := ServicePredicate(class, finalizer)
+	require.True(t, predicate.Create(event.CreateEvent{Object: svc}))
+
+	clusterIP := svc.DeepCopy()
+	clusterIP.Spec = corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP}
+	require.False(t, predicate.Create(event.CreateEvent{Object: clusterIP}))
+	// the service that stops being a load balancer still has to release its IP
+	require.True(t, predicate.Update(event.UpdateEvent{ObjectOld: svc, ObjectNew: clusterIP}))
+	clusterIP.Finalizers = []string{finalizer}
+	require.True(t, predicate.Delete(event.DeleteEvent{Object: clusterIP}))
+}
@@ -0,0 +1,92 @@
+package business
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// maintenanceQueueRetry is how often a queued change checks whether the changes before it have started
+const maintenanceQueueRetry = time.Second
+
+// maintenanceGate holds back allocations and port changes outside the maintenance windows. The services that
+// wait are queued, and once a window opens they are let through in the order they were queued.
+// Releases are never held back. Without windows every change runs right away.
+type maintenanceGate struct {
+	windows []integration.MaintenanceWindow
+
+	mu    sync.Mutex
+	queue []queuedChange
+}
+
+type queuedChange struct {
+	key types.NamespacedName
+	// started is set once the change is let through; the next one only waits for it to start, not to finish
+	started bool
+}
+
+func newMaintenanceGate(windows []integration.MaintenanceWindow) *maintenanceGate {
+	return &maintenanceGate{windows: windows}
+}
+
+// admit returns zero if the change of the service may run now, otherwise how long to wait and why;
+// the reason only changes when the window does, so it does not rewrite the service status on every retry.
+// An admitted change has to be reported with done.
+func (g *maintenanceGate) admit(key types.NamespacedName, now time.Time) (time.Duration, string) {
+	if len(g.windows) == 0 {
+		return 0, ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	idx := slices.IndexFunc(g.queue, func(c queuedChange) bool { return c.key == key })
+	if !g.open(now) {
+		if idx < 0 {
+			g.queue = append(g.queue, queuedChange{key: key})
+		}
+		next, ok := g.nextOpen(now)
+		if !ok {
+			return time.Hour, "queued, but no maintenance window is ever open"
+		}
+		return next.Sub(now), fmt.Sprintf("queued until the maintenance window opens at %s", next.Format(time.RFC3339))
+	}
+
+	waiting := slices.IndexFunc(g.queue, func(c queuedChange) bool { return !c.started })
+	switch {
+	case idx < 0 && waiting < 0:
+		// nothing is queued, so there is no order to keep
+		return 0, ""
+	case idx < 0:
+		g.queue = append(g.queue, queuedChange{key: key})
+		return maintenanceQueueRetry, "queued behind earlier changes"
+	case waiting < idx:
+		return maintenanceQueueRetry, "queued behind earlier changes"
+	}
+	g.queue[idx].started = true
+	return 0, ""
+}
+
+// done drops the service from the queue, e.g. once its change ran or when it no longer needs one.
+func (g *maintenanceGate) done(key types.NamespacedName) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.queue = slices.DeleteFunc(g.queue, func(c queuedChange) bool { return c.key == key })
+}
+
+func (g *maintenanceGate) open(now time.Time) bool {
+	return slices.ContainsFunc(g.windows, func(w integration.MaintenanceWindow) bool { return w.Open(now) })
+}
+
+func (g *maintenanceGate) nextOpen(now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, w := range g.windows {
+		if t, ok := w.NextOpen(now); ok && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next, !next.IsZero()
+}
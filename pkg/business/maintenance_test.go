@@ -0,0 +1,53 @@
+package business
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func Test_should_hold_back_changes_until_the_maintenance_window_opens(t *testing.T) {
+	t.Parallel()
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	// every weekday night at 2am for an hour
+	window, err := integration.ParseMaintenanceWindow("0 2 * * 1-5", time.Hour, berlin)
+	require.NoError(t, err)
+
+	saturday := time.Date(2026, 10, 17, 12, 0, 0, 0, berlin)
+	require.False(t, window.Open(saturday))
+	next, ok := window.NextOpen(saturday)
+	require.True(t, ok)
+	require.Equal(t, time.Date(2026, 10, 19, 2, 0, 0, 0, berlin), next)
+	require.True(t, window.Open(next.Add(59*time.Minute)))
+	require.False(t, window.Open(next.Add(time.Hour)))
+
+	_, err = integration.ParseMaintenanceWindow("0 25 * * *", time.Hour, berlin)
+	require.Error(t, err)
+
+	gate := newMaintenanceGate([]integration.MaintenanceWindow{window})
+	first, second := types.NamespacedName{Name: "first"}, types.NamespacedName{Name: "second"}
+
+	wait, reason := gate.admit(first, saturday)
+	require.Equal(t, next.Sub(saturday), wait)
+	require.Contains(t, reason, "maintenance window")
+	wait, _ = gate.admit(second, saturday)
+	require.Positive(t, wait)
+
+	// once the window opens the changes are let through in the order they were queued
+	wait, _ = gate.admit(second, next)
+	require.Equal(t, maintenanceQueueRetry, wait)
+	wait, _ = gate.admit(first, next)
+	require.Zero(t, wait)
+	wait, _ = gate.admit(second, next)
+	require.Zero(t, wait)
+
+	gate.done(first)
+	gate.done(second)
+	wait, _ = gate.admit(first, next)
+	require.Zero(t, wait)
+}
@@ -0,0 +1,458 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// opnsenseService manages destination nat rules, an ip alias virtual IP and a host alias per address of an OPNsense firewall.
+type opnsenseService struct {
+	pool
+	client *integration.OPNsenseClient
+	dryRun bool
+	// mu serializes the changes of concurrent reconciles from the first search to the apply, so two allocations
+	// do not pick the same free IP and a rewrite does not delete the rules another reconcile just added
+	mu sync.Mutex
+}
+
+func NewOPNsenseService(client *integration.OPNsenseClient, dryRun bool, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	return &opnsenseService{
+		pool:   newPool(subnet, exclusions),
+		client: client,
+		dryRun: dryRun,
+	}
+}
+
+func (s *opnsenseService) AllocateIP(ctx context.Context, namespace string, name string, clusterIP string, ports []ServicePort) (Allocation, error) {
+	slog.InfoContext(ctx, "allocating IP from opnsense", "namespace", namespace, "name", name, "ports", ports)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, err := s.usedAddresses(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	ip, err := s.allocate(used)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	return s.expose(ctx, namespace, name, clusterIP, ip, ports)
+}
+
+func (s *opnsenseService) EnsureIP(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	// the nat rules are usually there, which is checked without waiting for the changes of other services
+	if allocation, ok, err := s.exposed(ctx, namespace, name, clusterIP, ip, ports); err != nil || ok {
+		return allocation, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if allocation, ok, err := s.exposed(ctx, namespace, name, clusterIP, ip, ports); err != nil || ok {
+		return allocation, err
+	}
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+
+	rules, err := s.client.SearchDNATRules(ctx)
+	if err != nil {
+		return Allocation{}, fmt.Errorf("failed to search nat rules; %w", err)
+	}
+	existing := integration.FilterSlice(rules, hasDNATDestination(ip))
+	if len(existing) == 0 {
+		slog.InfoContext(ctx, "re-creating missing opnsense nat rules for assigned IP", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+	} else {
+		slog.InfoContext(ctx, "rewriting opnsense nat rules that differ from the service", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+		if err := s.removeRules(ctx, dnatUUIDs(existing)); err != nil {
+			return Allocation{}, err
+		}
+	}
+	return s.expose(ctx, namespace, name, clusterIP, ip, ports)
+}
+
+func (s *opnsenseService) UpdatePorts(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	slog.InfoContext(ctx, "updating ports in opnsense", "ip", ip, "ports", ports)
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.deleteRules(ctx, ip); err != nil {
+		return Allocation{}, err
+	}
+	return s.expose(ctx, namespace, name, clusterIP, ip, ports)
+}
+
+func (s *opnsenseService) ReserveIP(ctx context.Context, namespace string, name string, ip string) (Allocation, error) {
+	owner := namespace + "/" + name
+	if ip != "" {
+		return Allocation{IP: ip, Pool: s.name()}, s.reserveIP(ip, owner)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, err := s.usedAddresses(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+	ip, err = s.reserve(used, owner)
+	if err != nil {
+		return Allocation{}, err
+	}
+	return Allocation{IP: ip, Pool: s.name()}, nil
+}
+
+func (s *opnsenseService) ReleaseIP(ctx context.Context, ip string) error {
+	slog.InfoContext(ctx, "releasing IP back to opnsense", "ip", ip)
+	defer s.unreserve(ip)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.deleteRules(ctx, ip); err != nil {
+		return err
+	}
+	if err := s.deleteAlias(ctx, ip); err != nil {
+		return err
+	}
+	// the virtual IP goes last, so the address is not dropped while it is still forwarded
+	if err := s.deleteVirtualIP(ctx, ip); err != nil {
+		return err
+	}
+	if err := s.apply(ctx, true); err != nil {
+		return err
+	}
+	return s.verifyAddress(ctx, ip, nil, nil, nil)
+}
+
+// exposed reports whether the nat rules, the virtual IP and the alias of the service are in place
+func (s *opnsenseService) exposed(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, bool, error) {
+	rules, err := s.client.SearchDNATRules(ctx)
+	if err != nil {
+		return Allocation{}, false, fmt.Errorf("failed to search nat rules; %w", err)
+	}
+	existing := integration.FilterSlice(rules, hasDNATDestination(ip))
+	if !rulesMatch(integration.MapSlice(existing, fromDNATRule), buildRules(namespace, name, clusterIP, ip, ports)) {
+		return Allocation{}, false, nil
+	}
+	vips, err := s.client.SearchVirtualIPs(ctx)
+	if err != nil {
+		return Allocation{}, false, fmt.Errorf("failed to search virtual ips; %w", err)
+	}
+	aliases, err := s.client.SearchAliases(ctx)
+	if err != nil {
+		return Allocation{}, false, fmt.Errorf("failed to search aliases; %w", err)
+	}
+	vip := integration.FilterSlice(vips, isOPNsenseVirtualIPOf(namespace, name, ip))
+	if len(vip) == 0 || !slices.ContainsFunc(aliases, isOPNsenseAliasOf(namespace, name, ip)) {
+		return Allocation{}, false, nil
+	}
+	return Allocation{IP: ip, Pool: s.name(), RuleTrackerIDs: dnatUUIDs(existing), VirtualIPIDs: []string{vip[0].UUID}}, true, nil
+}
+
+// usedAddresses returns the addresses that are forwarded or held by a virtual IP
+func (s *opnsenseService) usedAddresses(ctx context.Context) ([]string, error) {
+	rules, err := s.client.SearchDNATRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search nat rules; %w", err)
+	}
+	vips, err := s.client.SearchVirtualIPs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search virtual ips; %w", err)
+	}
+	used := integration.MapSlice(rules, func(r integration.OPNsenseDNATRule) string {
+		return r.Destination.Network
+	})
+	return append(used, integration.MapSlice(vips, func(v integration.OPNsenseVirtualIP) string {
+		return v.Subnet
+	})...), nil
+}
+
+// expose creates the virtual IP and the alias of the address when they are missing, and then the nat rules;
+// what it created is deleted again when a later step fails, so no service is half exposed
+func (s *opnsenseService) expose(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	vipUUID, vipCreated, err := s.ensureVirtualIP(ctx, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+	var aliasUUID string
+	undo := func() error {
+		var errs []error
+		if aliasUUID != "" {
+			errs = append(errs, s.removeAlias(ctx, aliasUUID))
+		}
+		if vipCreated {
+			errs = append(errs, s.removeVirtualIP(ctx, vipUUID))
+		}
+		return errors.Join(errs...)
+	}
+	if aliasUUID, err = s.ensureAlias(ctx, namespace, name, ip); err != nil {
+		return Allocation{}, errors.Join(err, undo())
+	}
+
+	allocation := Allocation{IP: ip, Pool: s.name()}
+	if vipUUID != "" {
+		allocation.VirtualIPIDs = []string{vipUUID}
+	}
+	for _, r := range buildRules(namespace, name, clusterIP, ip, ports) {
+		dnat := toDNATRule(r)
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, nat rule creation skipped", "rule", integration.ToUnsafeJSONString(dnat))
+			continue
+		}
+		uuid, err := s.client.AddDNATRule(ctx, dnat)
+		if err != nil {
+			return Allocation{}, errors.Join(fmt.Errorf("failed to add nat rule; %w", err), s.removeRules(ctx, allocation.RuleTrackerIDs), undo())
+		}
+		allocation.RuleTrackerIDs = append(allocation.RuleTrackerIDs, uuid)
+	}
+	if err := s.apply(ctx, vipCreated); err != nil {
+		return Allocation{}, errors.Join(err, s.removeRules(ctx, allocation.RuleTrackerIDs), undo())
+	}
+	rules := integration.MapSlice(buildRules(namespace, name, clusterIP, ip, ports), toDNATRule)
+	vips := []integration.OPNsenseVirtualIP{opnsenseVirtualIP(namespace, name, ip)}
+	if err := s.verifyAddress(ctx, ip, rules, vips, []integration.OPNsenseAlias{opnsenseAlias(namespace, name, ip)}); err != nil {
+		return Allocation{}, err
+	}
+	return allocation, nil
+}
+
+// ensureVirtualIP creates the ip alias virtual IP that makes opnsense answer arp requests for the address
+// and returns its uuid and whether it had to be created
+func (s *opnsenseService) ensureVirtualIP(ctx context.Context, namespace string, name string, ip string) (string, bool, error) {
+	vips, err := s.client.SearchVirtualIPs(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to search virtual ips; %w", err)
+	}
+	if existing := integration.FilterSlice(vips, isOPNsenseVirtualIPOf(namespace, name, ip)); len(existing) > 0 {
+		return existing[0].UUID, false, nil
+	}
+	vip := opnsenseVirtualIP(namespace, name, ip)
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, virtual ip creation skipped", "virtualIP", integration.ToUnsafeJSONString(vip))
+		return "", false, nil
+	}
+	uuid, err := s.client.AddVirtualIP(ctx, vip)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to add virtual ip; %w", err)
+	}
+	return uuid, true, nil
+}
+
+func (s *opnsenseService) deleteVirtualIP(ctx context.Context, ip string) error {
+	vips, err := s.client.SearchVirtualIPs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to search virtual ips; %w", err)
+	}
+	for _, v := range integration.FilterSlice(vips, isOwnedOPNsenseVirtualIPAt(ip)) {
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, virtual ip deletion skipped", "uuid", v.UUID, "descr", v.Descr)
+			continue
+		}
+		if err := s.removeVirtualIP(ctx, v.UUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *opnsenseService) removeVirtualIP(ctx context.Context, uuid string) error {
+	if err := s.client.DeleteVirtualIP(ctx, uuid); err != nil {
+		return fmt.Errorf("failed to delete virtual ip %s; %w", uuid, err)
+	}
+	return nil
+}
+
+// ensureAlias creates the host alias of the address, which lets firewall rules written on opnsense refer to
+// the address of the service by name, and returns its uuid if it had to be created
+func (s *opnsenseService) ensureAlias(ctx context.Context, namespace string, name string, ip string) (string, error) {
+	aliases, err := s.client.SearchAliases(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to search aliases; %w", err)
+	}
+	if slices.ContainsFunc(aliases, isOPNsenseAliasOf(namespace, name, ip)) {
+		return "", nil
+	}
+	if slices.ContainsFunc(aliases, func(a integration.OPNsenseAlias) bool {
+		return a.Name == aliasName(ip) && !ownerDescr.MatchString(a.Description)
+	}) {
+		return "", fmt.Errorf("alias %s exists in opnsense and is not managed by the controller", aliasName(ip))
+	}
+	// an alias of the address that is left from its previous owner is replaced
+	if err := s.deleteAlias(ctx, ip); err != nil {
+		return "", err
+	}
+	alias := opnsenseAlias(namespace, name, ip)
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, alias creation skipped", "alias", integration.ToUnsafeJSONString(alias))
+		return "", nil
+	}
+	uuid, err := s.client.AddAlias(ctx, alias)
+	if err != nil {
+		return "", fmt.Errorf("failed to add alias; %w", err)
+	}
+	return uuid, nil
+}
+
+func (s *opnsenseService) deleteAlias(ctx context.Context, ip string) error {
+	aliases, err := s.client.SearchAliases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to search aliases; %w", err)
+	}
+	for _, a := range integration.FilterSlice(aliases, isOwnedOPNsenseAliasAt(ip)) {
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, alias deletion skipped", "uuid", a.UUID, "name", a.Name)
+			continue
+		}
+		if err := s.removeAlias(ctx, a.UUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *opnsenseService) removeAlias(ctx context.Context, uuid string) error {
+	if err := s.client.DeleteAlias(ctx, uuid); err != nil {
+		return fmt.Errorf("failed to delete alias %s; %w", uuid, err)
+	}
+	return nil
+}
+
+func (s *opnsenseService) removeRules(ctx context.Context, uuids []string) error {
+	for _, uuid := range uuids {
+		if err := s.client.DeleteDNATRule(ctx, uuid); err != nil {
+			return fmt.Errorf("failed to delete nat rule %s; %w", uuid, err)
+		}
+	}
+	return nil
+}
+
+func (s *opnsenseService) deleteRules(ctx context.Context, ip string) error {
+	rules, err := s.client.SearchDNATRules(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to search nat rules; %w", err)
+	}
+	for _, r := range integration.FilterSlice(rules, hasDNATDestination(ip)) {
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, nat rule deletion skipped", "uuid", r.UUID, "descr", r.Descr)
+			continue
+		}
+		if err := s.client.DeleteDNATRule(ctx, r.UUID); err != nil {
+			return fmt.Errorf("failed to delete nat rule %s; %w", r.UUID, err)
+		}
+	}
+	return nil
+}
+
+// apply reloads the aliases and the nat rules, and the virtual IPs as well when they changed
+func (s *opnsenseService) apply(ctx context.Context, vipChanged bool) error {
+	if s.dryRun {
+		return nil
+	}
+	if vipChanged {
+		if err := s.client.ApplyVirtualIPs(ctx); err != nil {
+			return fmt.Errorf("failed to apply virtual ip changes; %w", err)
+		}
+	}
+	if err := s.client.ApplyAliases(ctx); err != nil {
+		return fmt.Errorf("failed to apply alias changes; %w", err)
+	}
+	if err := s.client.ApplyDNAT(ctx); err != nil {
+		return fmt.Errorf("failed to apply nat changes; %w", err)
+	}
+	return nil
+}
+
+func opnsenseVirtualIP(namespace string, name string, ip string) integration.OPNsenseVirtualIP {
+	return integration.OPNsenseVirtualIP{
+		Mode:       "ipalias",
+		Interface:  "wan",
+		Subnet:     ip,
+		SubnetBits: "32",
+		Descr:      namespace + "/" + name,
+	}
+}
+
+func opnsenseAlias(namespace string, name string, ip string) integration.OPNsenseAlias {
+	return integration.OPNsenseAlias{
+		Enabled:     "1",
+		Name:        aliasName(ip),
+		Type:        "host",
+		Content:     ip,
+		Description: namespace + "/" + name,
+	}
+}
+
+func toDNATRule(r rule) integration.OPNsenseDNATRule {
+	return integration.OPNsenseDNATRule{
+		Disabled:   "0",
+		Interface:  integration.FromPtr(r.Interface),
+		IPProtocol: integration.FromPtr(r.Ipprotocol),
+		Protocol:   integration.FromPtr(r.Protocol),
+		Source:     integration.OPNsenseNetwork{Network: "any"},
+		Destination: integration.OPNsenseNetwork{
+			Network: ruleAddress(r),
+			Port:    integration.FromPtr(r.Destination.Port),
+		},
+		Target:    integration.FromPtr(r.Target),
+		LocalPort: integration.FromPtr(r.LocalPort),
+		Descr:     integration.FromPtr(r.Descr),
+	}
+}
+
+func fromDNATRule(r integration.OPNsenseDNATRule) rule {
+	return rule{
+		Destination: &destination{Address: &r.Destination.Network, Port: &r.Destination.Port},
+		Protocol:    &r.Protocol,
+		Target:      &r.Target,
+		LocalPort:   &r.LocalPort,
+		Interface:   &r.Interface,
+		Descr:       &r.Descr,
+	}
+}
+
+// hasDNATDestination matches the nat rules of the controller for the address
+func hasDNATDestination(ip string) func(integration.OPNsenseDNATRule) bool {
+	return func(r integration.OPNsenseDNATRule) bool {
+		return r.Destination.Network == ip && ownedDescr.MatchString(r.Descr)
+	}
+}
+
+func dnatUUIDs(rules []integration.OPNsenseDNATRule) []string {
+	return integration.MapSlice(rules, func(r integration.OPNsenseDNATRule) string {
+		return r.UUID
+	})
+}
+
+// isOPNsenseVirtualIPOf matches the ip alias virtual IP the controller created for the service
+func isOPNsenseVirtualIPOf(namespace string, name string, ip string) func(integration.OPNsenseVirtualIP) bool {
+	return func(v integration.OPNsenseVirtualIP) bool {
+		return isOwnedOPNsenseVirtualIPAt(ip)(v) && v.Descr == namespace+"/"+name
+	}
+}
+
+// isOwnedOPNsenseVirtualIPAt matches the ip alias virtual IPs of the controller for the address, so the virtual IPs
+// someone added to opnsense for the same address are left alone
+func isOwnedOPNsenseVirtualIPAt(ip string) func(integration.OPNsenseVirtualIP) bool {
+	return func(v integration.OPNsenseVirtualIP) bool {
+		return v.Mode == "ipalias" && v.Subnet == ip && ownerDescr.MatchString(v.Descr)
+	}
+}
+
+// isOwnedOPNsenseAliasAt matches the host alias of the controller for the address
+func isOwnedOPNsenseAliasAt(ip string) func(integration.OPNsenseAlias) bool {
+	return func(a integration.OPNsenseAlias) bool {
+		return a.Name == aliasName(ip) && ownerDescr.MatchString(a.Description)
+	}
+}
+
+func isOPNsenseAliasOf(namespace string, name string, ip string) func(integration.OPNsenseAlias) bool {
+	return func(a integration.OPNsenseAlias) bool {
+		return a.Name == aliasName(ip) && a.Description == namespace+"/"+name && a.Content == ip
+	}
+}
@@ -0,0 +1,196 @@
+package business
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/slamdev/pfsense-k8s-lb-controller/testdata"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_manage_nat_rules_with_opnsense_api(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	opnsenseURL, opnsenseStart := testdata.MockOPNsenseServer()
+	go func() {
+		if err := opnsenseStart(t.Context()); err != nil {
+			t.Logf("mock opnsense server stopped with error: %v", err)
+		}
+	}()
+
+	client, err := integration.CreateOPNsenseClient(opnsenseURL, "key", "secret", integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+
+	svc := NewOPNsenseService(client, false, subnet)
+	namespace, name := testdata.RndName(), testdata.RndName()
+
+	allocation, err := svc.AllocateIP(t.Context(), namespace, name, "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.1", allocation.IP)
+	require.Len(t, allocation.RuleTrackerIDs, 2)
+	require.Len(t, allocation.VirtualIPIDs, 1)
+
+	vips, err := client.SearchVirtualIPs(t.Context())
+	require.NoError(t, err)
+	require.Len(t, vips, 1)
+	require.Equal(t, allocation.VirtualIPIDs[0], vips[0].UUID)
+	require.Equal(t, namespace+"/"+name, vips[0].Descr)
+
+	aliases, err := client.SearchAliases(t.Context())
+	require.NoError(t, err)
+	require.Len(t, aliases, 1)
+	require.Equal(t, "k8s_lb_150_150_150_1", aliases[0].Name)
+	require.Equal(t, allocation.IP, aliases[0].Content)
+
+	ensured, err := svc.EnsureIP(t.Context(), namespace, name, "10.1.2.3", allocation.IP, []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.NoError(t, err)
+	require.Equal(t, allocation.RuleTrackerIDs, ensured.RuleTrackerIDs)
+	require.Equal(t, allocation.VirtualIPIDs, ensured.VirtualIPIDs)
+
+	second, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.4", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8081, TargetPort: 80},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.2", second.IP)
+
+	updated, err := svc.UpdatePorts(t.Context(), namespace, name, "10.1.2.3", allocation.IP, []ServicePort{
+		{Name: "ssh", Protocol: "TCP", NodePort: 8022, TargetPort: 22},
+	})
+	require.NoError(t, err)
+	require.Len(t, updated.RuleTrackerIDs, 1)
+	require.Equal(t, allocation.VirtualIPIDs, updated.VirtualIPIDs)
+
+	rules, err := client.SearchDNATRules(t.Context())
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	// a virtual IP someone added to opnsense for the address stays when the service releases it
+	_, err = client.AddVirtualIP(t.Context(), integration.OPNsenseVirtualIP{Mode: "ipalias", Interface: "wan", Subnet: allocation.IP, SubnetBits: "32", Descr: "uplink"})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.ReleaseIP(t.Context(), allocation.IP))
+
+	rules, err = client.SearchDNATRules(t.Context())
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Equal(t, second.IP, rules[0].Destination.Network)
+
+	vips, err = client.SearchVirtualIPs(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{second.IP, allocation.IP}, integration.MapSlice(vips, func(v integration.OPNsenseVirtualIP) string {
+		return v.Subnet
+	}))
+	require.Equal(t, "uplink", vips[1].Descr)
+
+	aliases, err = client.SearchAliases(t.Context())
+	require.NoError(t, err)
+	require.Len(t, aliases, 1)
+	require.Equal(t, second.IP, aliases[0].Content)
+}
+
+func Test_should_delete_added_nat_rules_virtual_ip_and_alias_when_one_of_them_fails(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	opnsenseURL, opnsenseStart := testdata.MockOPNsenseServer()
+	go func() {
+		if err := opnsenseStart(t.Context()); err != nil {
+			t.Logf("mock opnsense server stopped with error: %v", err)
+		}
+	}()
+	target, err := url.Parse(opnsenseURL)
+	require.NoError(t, err)
+
+	// the second rule is rejected
+	var adds atomic.Int32
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/firewall/d_nat/add_rule" && adds.Add(1) == 2 {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := integration.CreateOPNsenseClient(srv.URL, "key", "secret", integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+	svc := NewOPNsenseService(client, false, subnet)
+
+	_, err = svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.Error(t, err)
+
+	rules, err := client.SearchDNATRules(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, rules)
+	vips, err := client.SearchVirtualIPs(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, vips)
+	aliases, err := client.SearchAliases(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, aliases)
+}
+
+func Test_should_fail_when_nat_rule_read_back_from_opnsense_api_differs(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	opnsenseURL, opnsenseStart := testdata.MockOPNsenseServer()
+	go func() {
+		if err := opnsenseStart(t.Context()); err != nil {
+			t.Logf("mock opnsense server stopped with error: %v", err)
+		}
+	}()
+	target, err := url.Parse(opnsenseURL)
+	require.NoError(t, err)
+
+	// opnsense accepts the rule but keeps another local port
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/firewall/d_nat/add_rule" {
+			body, _ := io.ReadAll(r.Body)
+			body = bytes.ReplaceAll(body, []byte(`"local-port":"8080"`), []byte(`"local-port":"9090"`))
+			r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := integration.CreateOPNsenseClient(srv.URL, "key", "secret", integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+	svc := NewOPNsenseService(client, false, subnet)
+
+	_, err = svc.AllocateIP(t.Context(), "default", "svc", "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	var verificationErr *VerificationError
+	require.ErrorAs(t, err, &verificationErr)
+	require.Equal(t, "nat", verificationErr.Section)
+	require.Equal(t, []string{`nat rule 80/tcp (default/svc 80) has local-port "9090", expected "8080"`}, verificationErr.Diff)
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
-	"alexejk.io/go-xmlrpc"
 	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
 )
 
@@ -24,45 +26,329 @@ type ServicePort struct {
 
 const natConfigSection = "nat"
 
+// ErrIPOutsidePool is returned when an IP that is already assigned to a service
+// cannot be adopted because it does not belong to any configured pool.
+var ErrIPOutsidePool = errors.New("ip is outside of every configured pool")
+
+// Allocation describes the pfsense objects that expose a service.
+type Allocation struct {
+	IP   string
+	Pool string
+	// RuleTrackerIDs are the trackers of the nat rules, or their uuids on OPNsense; the pfSense REST API only
+	// knows port forwards by their position in the config, which is no stable id, so it leaves them empty.
+	RuleTrackerIDs []string
+	// VirtualIPIDs are the uniqids of the virtual IPs, or their uuids on OPNsense.
+	VirtualIPIDs []string
+}
+
 type pfsenseService struct {
-	client     *xmlrpc.Client
-	dryRun     bool
-	subnet     netip.Prefix
-	exclusions []integration.Range[netip.Addr]
+	pool
+	client   *integration.PfsenseClient
+	sections natSections
+	// carp is set for a CARP pair, whose allocated addresses need a carp virtual IP each
+	carp     *CARPConfig
+	syncPeer bool
+	// php changes single rules on pfsense instead of replacing the nat section when the firmware supports it
+	php    *phpMutations
+	writer *natWriter
+	dryRun bool
+	// snapshots is set to roll back the sections when a write fails, see WithRollback
+	snapshots *SnapshotHistory
+	target    string
+}
+
+// natSections reads and replaces the whole nat section of the pfsense config.
+type natSections interface {
+	fetchNATSection(ctx context.Context) (nat, error)
+	saveNATSection(ctx context.Context, section nat) error
 }
 
 type PfsenseService interface {
-	AllocateIP(ctx context.Context, namespace string, name string, clusterIP string, ports []ServicePort) (string, error)
-	UpdatePorts(ctx context.Context, loadBalancerIP string, ports []ServicePort) error
+	AllocateIP(ctx context.Context, namespace string, name string, clusterIP string, ports []ServicePort) (Allocation, error)
+	EnsureIP(ctx context.Context, namespace string, name string, clusterIP string, loadBalancerIP string, ports []ServicePort) (Allocation, error)
+	UpdatePorts(ctx context.Context, namespace string, name string, clusterIP string, loadBalancerIP string, ports []ServicePort) (Allocation, error)
 	ReleaseIP(ctx context.Context, loadBalancerIP string) error
+	// ReserveIP keeps a free IP for the service without exposing anything, or the given IP again after a restart;
+	// the reservation ends with ReleaseIP.
+	ReserveIP(ctx context.Context, namespace string, name string, loadBalancerIP string) (Allocation, error)
+	IsInPool(loadBalancerIP string) bool
 }
 
-func NewPfsenseService(client *xmlrpc.Client, dryRun bool, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
-	return &pfsenseService{
-		client:     client,
-		dryRun:     dryRun,
-		subnet:     subnet,
-		exclusions: exclusions,
-	}
+// NewPfsenseService replaces the nat section over XML-RPC; the writes queued within writeWindow are saved at once.
+func NewPfsenseService(client *integration.PfsenseClient, dryRun bool, writeWindow time.Duration, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	return withNATWriter(&pfsenseService{
+		pool:     newPool(subnet, exclusions),
+		client:   client,
+		sections: xmlrpcNATSections{client: client},
+		dryRun:   dryRun,
+	}, writeWindow)
+}
+
+func withNATWriter(s *pfsenseService, writeWindow time.Duration) *pfsenseService {
+	s.writer = newNATWriter(writeWindow, s.sections.fetchNATSection, s.saveNATSection)
+	return s
 }
 
-func (s *pfsenseService) AllocateIP(ctx context.Context, namespace string, name string, clusterIP string, ports []ServicePort) (string, error) {
+// Start runs the writer for the lifetime of the manager, see natWriter.Start.
+func (s *pfsenseService) Start(ctx context.Context) error {
+	return s.writer.Start(ctx)
+}
+
+// NeedLeaderElection is false, as the writer of a replica that is not the leader still has to stop with it.
+func (s *pfsenseService) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *pfsenseService) AllocateIP(ctx context.Context, namespace string, name string, clusterIP string, ports []ServicePort) (Allocation, error) {
 	slog.InfoContext(ctx, "allocating IP from pfsense", "namespace", namespace, "name", name, "ports", ports)
-	natSection, err := s.fetchNATSection()
+	m, err := s.mutations(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+	if m != nil {
+		var allocation Allocation
+		err := s.writer.exec(ctx, func(ctx context.Context) (err error) {
+			allocation, err = s.allocateIPWithPHP(ctx, m, namespace, name, clusterIP, ports)
+			return err
+		})
+		if err != nil {
+			// the write may still run once the caller stopped waiting, so allocation is not read
+			return Allocation{}, err
+		}
+		return allocation, nil
+	}
+
+	var allocation Allocation
+	// the IP is picked within the batch, so the changes queued before are taken into account
+	err = s.writer.change(ctx, func(ctx context.Context, natSection *nat) (bool, error) {
+		rules := integration.FromPtr(natSection.Rule)
+		ip, err := s.allocate(integration.MapSlice(rules, ruleAddress))
+		if err != nil {
+			return false, err
+		}
+
+		// the change runs on the writer already
+		vipIDs, err := s.ensureVIPLocked(ctx, namespace, name, ip)
+		if err != nil {
+			return false, err
+		}
+
+		newRules := buildRules(namespace, name, clusterIP, ip, ports)
+		natSection.Rule = integration.ToPointer(append(rules, newRules...))
+		allocation = s.toAllocation(ip, newRules, vipIDs)
+		return true, nil
+	})
+	if err != nil {
+		// allocation is only read once the writer reported back, as the change may still run otherwise
+		if ctx.Err() == nil && allocation.IP != "" {
+			// the IP is not handed out, so its virtual IP would be left behind
+			err = errors.Join(err, s.releaseVIP(ctx, allocation.IP))
+		}
+		return Allocation{}, err
+	}
+
+	return allocation, s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) EnsureIP(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	m, err := s.mutations(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+	if m != nil {
+		var allocation Allocation
+		err := s.writer.exec(ctx, func(ctx context.Context) (err error) {
+			allocation, err = s.ensureIPWithPHP(ctx, m, namespace, name, clusterIP, ip, ports)
+			return err
+		})
+		if err != nil {
+			return Allocation{}, err
+		}
+		return allocation, nil
+	}
+
+	// the rules are usually there, which is checked without waiting for the writer
+	natSection, err := s.sections.fetchNATSection(ctx)
+	if err != nil {
+		return Allocation{}, fmt.Errorf("failed to fetch nat section; %w", err)
+	}
+
+	newRules := buildRules(namespace, name, clusterIP, ip, ports)
+	existing := integration.FilterSlice(integration.FromPtr(natSection.Rule), isOwnedAt(ip))
+	if rulesMatch(existing, newRules) {
+		// the virtual IP may be gone while the rules are not, e.g. after the peer took over with an old config
+		vipIDs, err := s.ensureVIP(ctx, namespace, name, ip)
+		if err != nil {
+			return Allocation{}, err
+		}
+		return s.toAllocation(ip, existing, vipIDs), nil
+	}
+
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+
+	vipIDs, err := s.ensureVIP(ctx, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	var allocation Allocation
+	created := false
+	err = s.writer.change(ctx, func(ctx context.Context, natSection *nat) (bool, error) {
+		rules := integration.FromPtr(natSection.Rule)
+		existing := integration.FilterSlice(rules, isOwnedAt(ip))
+		if rulesMatch(existing, newRules) {
+			allocation = s.toAllocation(ip, existing, vipIDs)
+			return false, nil
+		}
+		if len(existing) == 0 {
+			slog.InfoContext(ctx, "re-creating missing pfsense rules for assigned IP", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+		} else {
+			slog.InfoContext(ctx, "rewriting pfsense rules that differ from the service", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+		}
+		rules = integration.FilterSlice(rules, not(isOwnedAt(ip)))
+		natSection.Rule = integration.ToPointer(append(rules, newRules...))
+		allocation, created = s.toAllocation(ip, newRules, vipIDs), true
+		return true, nil
+	})
+	if err != nil {
+		return Allocation{}, err
+	}
+	if !created {
+		return allocation, nil
+	}
+
+	return allocation, s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) UpdatePorts(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	slog.InfoContext(ctx, "updating ports in pfsense", "ip", ip, "ports", ports)
+	m, err := s.mutations(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+	if m != nil {
+		var allocation Allocation
+		err := s.writer.exec(ctx, func(ctx context.Context) (err error) {
+			allocation, err = s.updatePortsWithPHP(ctx, m, namespace, name, clusterIP, ip, ports)
+			return err
+		})
+		if err != nil {
+			return Allocation{}, err
+		}
+		return allocation, nil
+	}
+
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+
+	vipIDs, err := s.ensureVIP(ctx, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	newRules := buildRules(namespace, name, clusterIP, ip, ports)
+	err = s.writer.change(ctx, func(_ context.Context, natSection *nat) (bool, error) {
+		rules := integration.FilterSlice(integration.FromPtr(natSection.Rule), not(isOwnedAt(ip)))
+		natSection.Rule = integration.ToPointer(append(rules, newRules...))
+		return true, nil
+	})
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	return s.toAllocation(ip, newRules, vipIDs), s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) ReserveIP(ctx context.Context, namespace string, name string, ip string) (Allocation, error) {
+	owner := namespace + "/" + name
+	if ip != "" {
+		return Allocation{IP: ip, Pool: s.name()}, s.reserveIP(ip, owner)
+	}
+	m, err := s.mutations(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+	if m != nil {
+		err = s.writer.exec(ctx, func(ctx context.Context) error {
+			addresses, err := m.run(ctx, "addresses", "", nil)
+			if err != nil {
+				return err
+			}
+			ip, err = s.reserve(addresses.Addresses, owner)
+			return err
+		})
+	} else {
+		// the IP is picked within the batch like an allocation, but nothing is written
+		err = s.writer.change(ctx, func(_ context.Context, natSection *nat) (bool, error) {
+			var err error
+			ip, err = s.reserve(integration.MapSlice(integration.FromPtr(natSection.Rule), ruleAddress), owner)
+			return false, err
+		})
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch nat section; %w", err)
+		return Allocation{}, err
 	}
+	slog.InfoContext(ctx, "reserved IP in pfsense pool", "namespace", namespace, "name", name, "ip", ip)
+	return Allocation{IP: ip, Pool: s.name()}, nil
+}
 
-	allocatedIPs := integration.UniqueSlice(integration.MapSlice(*natSection.Rule, func(r rule) string {
-		return *r.Destination.Address
-	}))
+func (s *pfsenseService) ReleaseIP(ctx context.Context, ip string) error {
+	slog.InfoContext(ctx, "releasing IP back to pfsense", "ip", ip)
+	defer s.unreserve(ip)
+	m, err := s.mutations(ctx)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return s.writer.exec(ctx, func(ctx context.Context) error {
+			return s.releaseIPWithPHP(ctx, m, ip)
+		})
+	}
 
-	ip, err := integration.AllocateIP(s.subnet, s.exclusions, allocatedIPs)
+	released := false
+	err = s.writer.change(ctx, func(_ context.Context, natSection *nat) (bool, error) {
+		rules := integration.FromPtr(natSection.Rule)
+		remaining := integration.FilterSlice(rules, not(isOwnedAt(ip)))
+		if len(remaining) == len(rules) {
+			return false, nil
+		}
+		natSection.Rule, released = &remaining, true
+		return true, nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to allocate IP; %w", err)
+		return err
+	}
+
+	// the virtual IP goes last, so the address is not dropped while it is still forwarded
+	if err := s.releaseVIP(ctx, ip); err != nil {
+		return err
+	}
+	if !released && s.carp == nil {
+		return nil
+	}
+	return s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) toAllocation(ip string, rules []rule, vipIDs []string) Allocation {
+	trackers := integration.MapSlice(rules, func(r rule) string {
+		return integration.FromPtr(r.Tracker)
+	})
+	return Allocation{
+		IP:             ip,
+		Pool:           s.name(),
+		RuleTrackerIDs: integration.FilterSlice(trackers, isNotEmpty),
+		VirtualIPIDs:   vipIDs,
 	}
+}
 
-	newRules := integration.MapSlice(ports, func(p ServicePort) rule {
+func buildRules(namespace string, name string, clusterIP string, ip string, ports []ServicePort) []rule {
+	// pfsense generates trackers from the current time as well
+	tracker := time.Now().UnixMicro()
+	return integration.MapSlice(ports, func(p ServicePort) rule {
+		tracker++
 		return rule{
 			Destination: &destination{
 				Address: &ip,
@@ -74,129 +360,201 @@ func (s *pfsenseService) AllocateIP(ctx context.Context, namespace string, name
 			LocalPort:  integration.ToPointer(strconv.Itoa(int(p.NodePort))),
 			Interface:  integration.ToPointer("wan"),
 			Descr:      integration.ToPointer(fmt.Sprintf("%s/%s %d", namespace, name, p.TargetPort)),
+			Tracker:    integration.ToPointer(strconv.FormatInt(tracker, 10)),
 		}
 	})
-	natSection.Rule = integration.ToPointer(append(*natSection.Rule, newRules...))
+}
 
-	if err := s.saveNATSection(natSection); err != nil {
-		return "", fmt.Errorf("failed to save nat section; %w", err)
+// rulesMatch reports whether the existing rules forward the same ports to the same target under the same owner descr
+// as the expected ones; trackers and the timestamps pfsense adds are not compared.
+func rulesMatch(existing []rule, expected []rule) bool {
+	key := func(r rule) string {
+		var port string
+		if r.Destination != nil {
+			port = integration.FromPtr(r.Destination.Port)
+		}
+		return strings.Join([]string{
+			integration.FromPtr(r.Interface), integration.FromPtr(r.Protocol), ruleAddress(r), port,
+			integration.FromPtr(r.Target), integration.FromPtr(r.LocalPort), integration.FromPtr(r.Descr),
+		}, "|")
 	}
+	a, b := integration.MapSlice(existing, key), integration.MapSlice(expected, key)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
 
-	return ip, nil
+func ruleAddress(r rule) string {
+	if r.Destination == nil {
+		return ""
+	}
+	return integration.FromPtr(r.Destination.Address)
 }
 
-func (s *pfsenseService) UpdatePorts(ctx context.Context, ip string, ports []ServicePort) error {
-	slog.InfoContext(ctx, "updating ports in pfsense", "ip", ip, "ports", ports)
-	return nil
+// ownedDescr matches the "namespace/name port" descr buildRules gives the rules of a service, which tells them apart
+// from rules someone added to pfsense for the same address
+var ownedDescr = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?/[a-z0-9]([-a-z0-9.]*[a-z0-9])? [0-9]+$`)
+
+// ownerDescr matches the "namespace/name" descr of the virtual IPs and aliases created for a service
+var ownerDescr = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?/[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// isOwnedAt matches the rules of the controller that forward the address
+func isOwnedAt(ip string) func(rule) bool {
+	return func(r rule) bool {
+		return ruleAddress(r) == ip && ownedDescr.MatchString(integration.FromPtr(r.Descr))
+	}
 }
 
-func (s *pfsenseService) ReleaseIP(ctx context.Context, ip string) error {
-	slog.InfoContext(ctx, "releasing IP back to pfsense", "ip", ip)
-	return nil
+func not[T any](fn func(T) bool) func(T) bool {
+	return func(t T) bool {
+		return !fn(t)
+	}
 }
 
-func (s *pfsenseService) execPhp(code string) error {
+func (s *pfsenseService) execPhp(ctx context.Context, code string) error {
 	req := &struct{ Data string }{Data: code}
 	res := &integration.OperationResult{}
-	if err := s.client.Call("pfsense.exec_php", req, res); err != nil {
+	if err := s.client.Exec(ctx, "pfsense.exec_php", req, res); err != nil {
 		return fmt.Errorf("failed to exec php; %w", err)
 	}
 	if !res.Success {
-		return errors.New("pfsense return 'false' as a result of exec php")
+		return integration.NewRejectedError("pfsense.exec_php")
 	}
 	return nil
 }
 
-func (s *pfsenseService) fetchNATSection() (nat, error) {
+func (s *pfsenseService) saveNATSection(ctx context.Context, section nat) error {
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, nat section restore skipped", "section", integration.ToUnsafeJSONString(section))
+		return nil
+	}
+	err := writeSection(ctx, s, natConfigSection, s.sections.fetchNATSection, s.sections.saveNATSection,
+		func(section nat) any { return section },
+		func(ctx context.Context) error { return s.sections.saveNATSection(ctx, section) })
+	if err != nil {
+		return err
+	}
+	return s.verifyNATSection(ctx, section)
+}
+
+// sectionRevisioner is implemented by the sections of the backends that keep a config revision
+type sectionRevisioner interface {
+	configRevision(ctx context.Context) (string, error)
+}
+
+// ConfigRevision identifies the current pfsense config, so changes made on pfsense itself can be noticed;
+// it is empty for the backends that do not keep a revision.
+func (s *pfsenseService) ConfigRevision(ctx context.Context) (string, error) {
+	revisions, ok := s.sections.(sectionRevisioner)
+	if !ok {
+		return "", nil
+	}
+	return revisions.configRevision(ctx)
+}
+
+func (s *pfsenseService) keepsConfigRevision() bool {
+	_, ok := s.sections.(sectionRevisioner)
+	return ok
+}
+
+type xmlrpcNATSections struct {
+	client *integration.PfsenseClient
+}
+
+func (x xmlrpcNATSections) fetchNATSection(ctx context.Context) (nat, error) {
 	req := &struct{ Data []string }{Data: []string{natConfigSection}}
 	res := &integration.NestedXMLRPC[natStruct]{}
-	if err := s.client.Call("pfsense.backup_config_section", req, res); err != nil {
+	if err := x.client.Read(ctx, "pfsense.backup_config_section", req, res); err != nil {
 		return nat{}, fmt.Errorf("failed to call %s; %w", "backup_config_section", err)
 	}
 	return *res.Nested.Nat, nil
 }
 
-func (s *pfsenseService) saveNATSection(section nat) error {
+func (x xmlrpcNATSections) configRevision(ctx context.Context) (string, error) {
+	return x.client.ConfigRevision(ctx)
+}
+
+func (x xmlrpcNATSections) healthCheck(ctx context.Context) error {
+	return x.client.CheckWriter(ctx)
+}
+
+func (x xmlrpcNATSections) saveNATSection(ctx context.Context, section nat) error {
 	req := &struct {
 		Sections any
 		Timeout  int
 	}{
 		Sections: map[string]any{natConfigSection: section},
-		Timeout:  30,
-	}
-
-	if s.dryRun {
-		slog.Info("dry run enabled, pfsense.restore_config_section call skipped", "request", integration.ToUnsafeJSONString(req))
-		return nil
+		Timeout:  integration.TimeoutSeconds(x.client.Timeouts().Write),
 	}
 
 	res := &integration.OperationResult{}
-	if err := s.client.Call("pfsense.restore_config_section", req, res); err != nil {
+	if err := x.client.Write(ctx, "pfsense.restore_config_section", req, res); err != nil {
 		return fmt.Errorf("failed to call %s; %w", "restore_config_section", err)
 	}
 	if !res.Success {
-		return errors.New("pfsense return 'false' as a result of config restoring")
+		return integration.NewRejectedError("pfsense.restore_config_section")
 	}
 	return nil
 }
 
 type natStruct struct {
-	Nat *nat `xmlrpc:"nat"`
+	Nat *nat `xmlrpc:"nat" json:"nat,omitempty" xml:"nat,omitempty"`
 }
 
 //nolint:revive,staticcheck
 type nat struct {
-	Separator *string   `xmlrpc:"separator"`
-	Outbound  *outbound `xmlrpc:"outbound"`
-	Rule      *[]rule   `xmlrpc:"rule"`
+	Separator *string   `xmlrpc:"separator" json:"separator,omitempty" xml:"separator,omitempty"`
+	Outbound  *outbound `xmlrpc:"outbound" json:"outbound,omitempty" xml:"outbound,omitempty"`
+	Rule      *[]rule   `xmlrpc:"rule" json:"rule,omitempty" xml:"rule,omitempty"`
 }
 
 type outbound struct {
-	Rule *[]outboundRule `xmlrpc:"rule"`
-	Mode *string         `xmlrpc:"mode"`
+	Rule *[]outboundRule `xmlrpc:"rule" json:"rule,omitempty" xml:"rule,omitempty"`
+	Mode *string         `xmlrpc:"mode" json:"mode,omitempty" xml:"mode,omitempty"`
 }
 
 type outboundRule struct {
-	Source         *source      `xmlrpc:"source"`
-	Sourceport     *string      `xmlrpc:"sourceport"`
-	Descr          *string      `xmlrpc:"descr"`
-	Target         *string      `xmlrpc:"target"`
-	Targetip       *string      `xmlrpc:"targetip"`
-	TargetipSubnet *string      `xmlrpc:"targetip_subnet"`
-	Interface      *string      `xmlrpc:"interface"`
-	Poolopts       *string      `xmlrpc:"poolopts"`
-	SourceHashKey  *string      `xmlrpc:"source_hash_key"`
-	Destination    *destination `xmlrpc:"destination"`
-	Updated        *timestamp   `xmlrpc:"updated"`
-	Created        *timestamp   `xmlrpc:"created"`
+	Source         *source      `xmlrpc:"source" json:"source,omitempty" xml:"source,omitempty"`
+	Sourceport     *string      `xmlrpc:"sourceport" json:"sourceport,omitempty" xml:"sourceport,omitempty"`
+	Descr          *string      `xmlrpc:"descr" json:"descr,omitempty" xml:"descr,omitempty"`
+	Target         *string      `xmlrpc:"target" json:"target,omitempty" xml:"target,omitempty"`
+	Targetip       *string      `xmlrpc:"targetip" json:"targetip,omitempty" xml:"targetip,omitempty"`
+	TargetipSubnet *string      `xmlrpc:"targetip_subnet" json:"targetip_subnet,omitempty" xml:"targetip_subnet,omitempty"`
+	Interface      *string      `xmlrpc:"interface" json:"interface,omitempty" xml:"interface,omitempty"`
+	Poolopts       *string      `xmlrpc:"poolopts" json:"poolopts,omitempty" xml:"poolopts,omitempty"`
+	SourceHashKey  *string      `xmlrpc:"source_hash_key" json:"source_hash_key,omitempty" xml:"source_hash_key,omitempty"`
+	Destination    *destination `xmlrpc:"destination" json:"destination,omitempty" xml:"destination,omitempty"`
+	Updated        *timestamp   `xmlrpc:"updated" json:"updated,omitempty" xml:"updated,omitempty"`
+	Created        *timestamp   `xmlrpc:"created" json:"created,omitempty" xml:"created,omitempty"`
 }
 
 type rule struct {
-	Source           *source      `xmlrpc:"source"`
-	Destination      *destination `xmlrpc:"destination"`
-	Ipprotocol       *string      `xmlrpc:"ipprotocol"`
-	Protocol         *string      `xmlrpc:"protocol"`
-	Target           *string      `xmlrpc:"target"`
-	LocalPort        *string      `xmlrpc:"local-port"`
-	Interface        *string      `xmlrpc:"interface"`
-	Descr            *string      `xmlrpc:"descr"`
-	AssociatedRuleId *string      `xmlrpc:"associated-rule-id"`
-	Updated          *timestamp   `xmlrpc:"updated"`
-	Created          *timestamp   `xmlrpc:"created"`
+	Source           *source      `xmlrpc:"source" json:"source,omitempty" xml:"source,omitempty"`
+	Destination      *destination `xmlrpc:"destination" json:"destination,omitempty" xml:"destination,omitempty"`
+	Ipprotocol       *string      `xmlrpc:"ipprotocol" json:"ipprotocol,omitempty" xml:"ipprotocol,omitempty"`
+	Protocol         *string      `xmlrpc:"protocol" json:"protocol,omitempty" xml:"protocol,omitempty"`
+	Target           *string      `xmlrpc:"target" json:"target,omitempty" xml:"target,omitempty"`
+	LocalPort        *string      `xmlrpc:"local-port" json:"local-port,omitempty" xml:"local-port,omitempty"`
+	Interface        *string      `xmlrpc:"interface" json:"interface,omitempty" xml:"interface,omitempty"`
+	Descr            *string      `xmlrpc:"descr" json:"descr,omitempty" xml:"descr,omitempty"`
+	Tracker          *string      `xmlrpc:"tracker" json:"tracker,omitempty" xml:"tracker,omitempty"`
+	AssociatedRuleId *string      `xmlrpc:"associated-rule-id" json:"associated-rule-id,omitempty" xml:"associated-rule-id,omitempty"`
+	Updated          *timestamp   `xmlrpc:"updated" json:"updated,omitempty" xml:"updated,omitempty"`
+	Created          *timestamp   `xmlrpc:"created" json:"created,omitempty" xml:"created,omitempty"`
 }
 
 type source struct {
-	Network *string `xmlrpc:"network"`
-	Any     *string `xmlrpc:"any"`
+	Network *string `xmlrpc:"network" json:"network,omitempty" xml:"network,omitempty"`
+	Any     *string `xmlrpc:"any" json:"any,omitempty" xml:"any,omitempty"`
 }
 
 type destination struct {
-	Any     *string `xmlrpc:"any"`
-	Address *string `xmlrpc:"address"`
-	Port    *string `xmlrpc:"port"`
+	Any     *string `xmlrpc:"any" json:"any,omitempty" xml:"any,omitempty"`
+	Address *string `xmlrpc:"address" json:"address,omitempty" xml:"address,omitempty"`
+	Port    *string `xmlrpc:"port" json:"port,omitempty" xml:"port,omitempty"`
 }
 
 type timestamp struct {
-	Time     *string `xmlrpc:"time"`
-	Username *string `xmlrpc:"username"`
+	Time     *string `xmlrpc:"time" json:"time,omitempty" xml:"time,omitempty"`
+	Username *string `xmlrpc:"username" json:"username,omitempty" xml:"username,omitempty"`
 }
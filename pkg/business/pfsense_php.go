@@ -0,0 +1,409 @@
+package business
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// phpMutationScript runs a single operation on a freshly parsed config. The parameters are passed as base64 encoded
+// json, so nothing from the cluster ends up in the code itself. The read-modify-write holds pfsense's own config lock,
+// which write_config takes as well, so no other writer on pfsense changes the config in between. The lock is not
+// reentrant and parse_config and write_config take it on their own, so the script reads and writes config.xml the
+// way they do while it holds the lock: it backs up the current config, adds a revision entry and drops the config
+// cache, so the next parse_config reads the written file. The changes are applied after the lock is released.
+const phpMutationScript = `require_once("config.inc");
+require_once("filter.inc");
+require_once("interfaces.inc");
+global $config, $g;
+$params = json_decode(base64_decode("%s"), true);
+$matches = function ($pattern, $descr) { return preg_match("#" . $pattern . "#", $descr ?? "") === 1; };
+$marked = function ($entry) use ($params, $matches) {
+	return ($entry["destination"]["address"] ?? "") === $params["address"] && $matches($params["owned"], $entry["descr"] ?? "");
+};
+$result = [];
+$changed = false;
+$apply = null;
+$lock = lock("config", LOCK_EX);
+try {
+	$config = parse_xml_config($g["conf_path"] . "/config.xml", $g["xml_rootobj"]);
+	if (!is_array($config)) {
+		throw new Exception("failed to parse config.xml");
+	}
+	%s
+	if ($changed) {
+		backup_config();
+		$config["revision"] = make_config_revision_entry("pfsense-k8s-lb-controller: " . $params["op"] . " " . $params["address"]);
+		if (!safe_write_file($g["conf_path"] . "/config.xml", dump_xml_config($config, $g["xml_rootobj"]))) {
+			throw new Exception("failed to write config.xml");
+		}
+		unlink_if_exists($g["tmp_path"] . "/config.cache");
+	}
+} catch (Throwable $e) {
+	$result = ["error" => $e->getMessage()];
+	$changed = false;
+} finally {
+	unlock($lock);
+}
+if ($changed) {
+	if ($apply !== null) {
+		$apply();
+	}
+	filter_configure();
+}
+// an empty array is encoded as [], which is not an object
+$toreturn = json_encode((object) $result);`
+
+// phpOperations are the bodies of phpMutationScript by operation; the rules of the controller are marked by their
+// destination address, which is the load balancer IP they forward, and their owned descr, so the rules someone added
+// to pfsense for the same address are left alone. Carp virtual IPs are matched by their descr in the same way.
+var phpOperations = map[string]string{
+	"addresses": `$result["addresses"] = array_values(array_unique(array_map(function ($entry) { return $entry["destination"]["address"] ?? ""; }, config_get_path("nat/rule", []))));`,
+	"rules":     `$result["rules"] = array_values(array_filter(config_get_path("nat/rule", []), $marked));`,
+	"add": `$rules = config_get_path("nat/rule", []);
+	if (count(array_filter($rules, $marked)) > 0) {
+		$result["error"] = "address " . $params["address"] . " is already forwarded";
+	} else {
+		config_set_path("nat/rule", array_merge($rules, $params["rules"]));
+		$changed = true;
+	}`,
+	"replace": `$rules = array_filter(config_get_path("nat/rule", []), function ($entry) use ($marked) { return !$marked($entry); });
+	config_set_path("nat/rule", array_merge(array_values($rules), $params["rules"]));
+	$changed = true;`,
+	"delete": `$rules = config_get_path("nat/rule", []);
+	$remaining = array_values(array_filter($rules, function ($entry) use ($marked) { return !$marked($entry); }));
+	$result["deleted"] = count($rules) - count($remaining);
+	if ($result["deleted"] > 0) {
+		config_set_path("nat/rule", $remaining);
+		$changed = true;
+	}`,
+	"upsert_vip": `$vips = config_get_path("virtualip/vip", []);
+	$used = [];
+	$foreign = false;
+	foreach ($vips as $entry) {
+		$carp = ($entry["mode"] ?? "") === "carp" && ($entry["interface"] ?? "") === $params["vip"]["interface"];
+		if (($entry["subnet"] ?? "") === $params["address"]) {
+			if ($carp && ($entry["descr"] ?? "") === $params["vip"]["descr"]) {
+				$result["uniqid"] = $entry["uniqid"] ?? "";
+			} else {
+				$foreign = true;
+			}
+		}
+		if ($carp) {
+			$used[intval($entry["vhid"] ?? 0)] = true;
+		}
+	}
+	if (isset($result["uniqid"])) {
+		// the virtual IP of the service is there already
+	} elseif ($foreign) {
+		$result["error"] = "virtual IP " . $params["address"] . " exists in pfsense and is not the carp virtual IP of " . $params["vip"]["descr"];
+	} else {
+		$vhid = intval($params["vhid"]);
+		while (isset($used[$vhid])) {
+			$vhid++;
+		}
+		if ($vhid > intval($params["maxVhid"])) {
+			$result["error"] = "no free vhid from " . $params["vhid"] . " on interface " . $params["vip"]["interface"];
+		} else {
+			$vip = $params["vip"];
+			$vip["vhid"] = strval($vhid);
+			$vips[] = $vip;
+			config_set_path("virtualip/vip", $vips);
+			$changed = true;
+			$apply = function () use ($vip) { interface_carp_configure($vip); };
+			$result["uniqid"] = $vip["uniqid"];
+		}
+	}`,
+	"delete_vip": `$vips = config_get_path("virtualip/vip", []);
+	$remaining = [];
+	$removed = [];
+	foreach ($vips as $entry) {
+		if (($entry["subnet"] ?? "") === $params["address"] && ($entry["mode"] ?? "") === "carp" &&
+			($entry["interface"] ?? "") === $params["interface"] && $matches($params["owner"], $entry["descr"] ?? "")) {
+			$removed[] = $entry;
+		} else {
+			$remaining[] = $entry;
+		}
+	}
+	$result["deleted"] = count($removed);
+	if (count($removed) > 0) {
+		config_set_path("virtualip/vip", $remaining);
+		$changed = true;
+		$apply = function () use ($removed) {
+			foreach ($removed as $entry) {
+				interface_vip_bring_down($entry);
+			}
+		};
+	}`,
+}
+
+// phpMutations change the rules and virtual IPs of a single address on pfsense itself instead of transferring
+// the whole nat section, which is slow with many rules and drops the fields that are not modelled here.
+// The operations rely on config_get_path and config_set_path, so they are only used on a firmware that has them.
+type phpMutations struct {
+	client *integration.PfsenseClient
+	dryRun bool
+
+	mu        sync.Mutex
+	checked   bool
+	supported bool
+}
+
+type phpResult struct {
+	Error     string   `json:"error,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Rules     []rule   `json:"rules,omitempty"`
+	Deleted   int      `json:"deleted,omitempty"`
+	Uniqid    string   `json:"uniqid,omitempty"`
+}
+
+// NewPfsensePHPService is the XML-RPC backend with the changes made by php on pfsense, falling back to replacing
+// the nat section on a firmware that is too old; carp and syncPeer are the same as for NewPfsenseHAService.
+func NewPfsensePHPService(client *integration.PfsenseClient, carp CARPConfig, syncPeer bool, dryRun bool, writeWindow time.Duration, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	svc := NewPfsenseHAService(client, carp, syncPeer, dryRun, writeWindow, subnet, exclusions...).(*pfsenseService)
+	svc.php = &phpMutations{client: client, dryRun: dryRun}
+	return svc
+}
+
+// mutations returns the php mutations if the firmware supports them, or nil to replace the sections instead.
+// The firmware is checked once; a failed check is repeated on the next call.
+func (s *pfsenseService) mutations(ctx context.Context) (*phpMutations, error) {
+	if s.php == nil {
+		return nil, nil
+	}
+	m := s.php
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.checked {
+		version, err := m.client.FirmwareVersion(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check pfsense firmware version; %w", err)
+		}
+		m.checked, m.supported = true, phpMutationsSupported(version)
+		if !m.supported {
+			slog.WarnContext(ctx, "pfsense firmware does not support php mutations, replacing the nat section instead", "version", version)
+		}
+	}
+	if !m.supported {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// phpMutationsSupported reports whether the firmware has config_get_path, which came with 2.7.0 and plus 23.01.
+// Plus versions are told apart by their year based major version.
+func phpMutationsSupported(version string) bool {
+	parts := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	if major >= 21 {
+		return major >= 23
+	}
+	return major > 2 || (major == 2 && minor >= 7)
+}
+
+func (s *pfsenseService) allocateIPWithPHP(ctx context.Context, m *phpMutations, namespace string, name string, clusterIP string, ports []ServicePort) (Allocation, error) {
+	addresses, err := m.run(ctx, "addresses", "", nil)
+	if err != nil {
+		return Allocation{}, err
+	}
+	ip, err := s.allocate(addresses.Addresses)
+	if err != nil {
+		return Allocation{}, err
+	}
+	vipIDs, err := s.upsertVIPWithPHP(ctx, m, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+	newRules := buildRules(namespace, name, clusterIP, ip, ports)
+	// add refuses an address that got rules since it was listed, so a concurrent allocation is not overwritten
+	if _, err := m.run(ctx, "add", ip, map[string]any{"rules": newRules}); err != nil {
+		return Allocation{}, errors.Join(err, s.deleteVIPWithPHP(ctx, m, ip))
+	}
+	if err := s.verifyRulesWithPHP(ctx, m, ip, newRules); err != nil {
+		return Allocation{}, err
+	}
+	return s.toAllocation(ip, newRules, vipIDs), s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) ensureIPWithPHP(ctx context.Context, m *phpMutations, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	existing, err := m.run(ctx, "rules", ip, nil)
+	if err != nil {
+		return Allocation{}, err
+	}
+	newRules := buildRules(namespace, name, clusterIP, ip, ports)
+	matching := rulesMatch(existing.Rules, newRules)
+	if !matching {
+		if err := s.checkAllocatable(ip); err != nil {
+			return Allocation{}, err
+		}
+	}
+	vipIDs, err := s.upsertVIPWithPHP(ctx, m, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+	if matching {
+		return s.toAllocation(ip, existing.Rules, vipIDs), nil
+	}
+	op := "add"
+	if len(existing.Rules) == 0 {
+		slog.InfoContext(ctx, "re-creating missing pfsense rules for assigned IP", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+	} else {
+		slog.InfoContext(ctx, "rewriting pfsense rules that differ from the service", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+		op = "replace"
+	}
+	if _, err := m.run(ctx, op, ip, map[string]any{"rules": newRules}); err != nil {
+		return Allocation{}, err
+	}
+	if err := s.verifyRulesWithPHP(ctx, m, ip, newRules); err != nil {
+		return Allocation{}, err
+	}
+	return s.toAllocation(ip, newRules, vipIDs), s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) updatePortsWithPHP(ctx context.Context, m *phpMutations, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+	vipIDs, err := s.upsertVIPWithPHP(ctx, m, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+	newRules := buildRules(namespace, name, clusterIP, ip, ports)
+	if _, err := m.run(ctx, "replace", ip, map[string]any{"rules": newRules}); err != nil {
+		return Allocation{}, err
+	}
+	if err := s.verifyRulesWithPHP(ctx, m, ip, newRules); err != nil {
+		return Allocation{}, err
+	}
+	return s.toAllocation(ip, newRules, vipIDs), s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) releaseIPWithPHP(ctx context.Context, m *phpMutations, ip string) error {
+	deleted, err := m.run(ctx, "delete", ip, nil)
+	if err != nil {
+		return err
+	}
+	if deleted.Deleted > 0 {
+		if err := s.verifyRulesWithPHP(ctx, m, ip, nil); err != nil {
+			return err
+		}
+	}
+	// the virtual IP goes last, so the address is not dropped while it is still forwarded
+	if s.carp == nil {
+		if deleted.Deleted == 0 {
+			return nil
+		}
+		return s.syncPeerConfig(ctx)
+	}
+	if err := s.deleteVIPWithPHP(ctx, m, ip); err != nil {
+		return err
+	}
+	return s.syncPeerConfig(ctx)
+}
+
+func (s *pfsenseService) upsertVIPWithPHP(ctx context.Context, m *phpMutations, namespace string, name string, ip string) ([]string, error) {
+	if s.carp == nil {
+		return nil, nil
+	}
+	created := vip{
+		Mode:       integration.ToPointer("carp"),
+		Interface:  integration.ToPointer(s.carp.Interface),
+		Uniqid:     integration.ToPointer(strconv.FormatInt(time.Now().UnixMicro(), 16)),
+		Descr:      integration.ToPointer(namespace + "/" + name),
+		Type:       integration.ToPointer("single"),
+		Subnet:     &ip,
+		SubnetBits: integration.ToPointer("32"),
+		Advskew:    integration.ToPointer(strconv.Itoa(s.carp.AdvSkew)),
+		Advbase:    integration.ToPointer(strconv.Itoa(max(1, s.carp.AdvBase))),
+		Password:   integration.ToPointer(s.carp.Password),
+	}
+	res, err := m.run(ctx, "upsert_vip", ip, map[string]any{"vip": created, "vhid": s.carp.VHID, "maxVhid": maxVHID})
+	if err != nil {
+		return nil, err
+	}
+	if res.Uniqid == "" {
+		// dry run does not create the virtual IP, so it has the id it would have been created with
+		return []string{integration.FromPtr(created.Uniqid)}, nil
+	}
+	if res.Uniqid == integration.FromPtr(created.Uniqid) {
+		// the vhid is picked by the php, so it is not compared
+		if err := s.verifyVirtualIPs(ctx, []vip{created}, isOwnedVIPAt(s.carp.Interface, ip)); err != nil {
+			return nil, err
+		}
+	}
+	return []string{res.Uniqid}, nil
+}
+
+func (s *pfsenseService) deleteVIPWithPHP(ctx context.Context, m *phpMutations, ip string) error {
+	if s.carp == nil {
+		return nil
+	}
+	deleted, err := m.run(ctx, "delete_vip", ip, map[string]any{"interface": s.carp.Interface})
+	if err != nil || deleted.Deleted == 0 {
+		return err
+	}
+	return s.verifyVirtualIPs(ctx, nil, isOwnedVIPAt(s.carp.Interface, ip))
+}
+
+// run executes the operation for the address; operations that change the config are only logged in dry run.
+func (m *phpMutations) run(ctx context.Context, op string, address string, params map[string]any) (phpResult, error) {
+	readOnly := op == "addresses" || op == "rules"
+	if m.dryRun && !readOnly {
+		// params are not logged as the virtual IP holds the carp password
+		slog.InfoContext(ctx, "dry run enabled, pfsense php mutation skipped", "op", op, "address", address)
+		return phpResult{}, nil
+	}
+	if params == nil {
+		params = map[string]any{}
+	}
+	params["op"], params["address"] = op, address
+	// the php matches the descr of the rules and virtual IPs of the controller with the same patterns as the go code
+	params["owned"], params["owner"] = ownedDescr.String(), ownerDescr.String()
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return phpResult{}, fmt.Errorf("failed to encode php mutation params; %w", err)
+	}
+	code := fmt.Sprintf(phpMutationScript, base64.StdEncoding.EncodeToString(encoded), phpOperations[op])
+
+	req := &struct{ Data string }{Data: code}
+	res := &struct{ Result string }{}
+	// only add must not be repeated, as it refuses an address that already has rules
+	call := m.client.Write
+	switch {
+	case readOnly:
+		call = m.client.Read
+	case op == "add":
+		call = m.client.Exec
+	}
+	if err := call(ctx, "pfsense.exec_php", req, res); err != nil {
+		return phpResult{}, fmt.Errorf("failed to exec php %s; %w", op, err)
+	}
+	var result phpResult
+	if err := json.Unmarshal([]byte(res.Result), &result); err != nil {
+		return phpResult{}, fmt.Errorf("failed to decode php %s result; %w", op, err)
+	}
+	if result.Error != "" {
+		return phpResult{}, &integration.PfsenseError{Kind: integration.ErrorKindRejected, Op: "pfsense.exec_php " + op, Err: errors.New(result.Error)}
+	}
+	return result, nil
+}
@@ -0,0 +1,461 @@
+package business
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// aliasConfigSection is the config section of the host aliases the rest and opnsense backends create per address
+const aliasConfigSection = "aliases"
+
+// pfsenseRESTService manages port forwards, an ip alias virtual IP and a host alias per address through the pfSense
+// REST API package instead of rewriting whole config sections over XML-RPC.
+type pfsenseRESTService struct {
+	pool
+	client *integration.PfsenseRESTClient
+	dryRun bool
+	// mu serializes the changes of concurrent reconciles from the first list to the apply, as ids are positions
+	// that shift with every delete and two allocations must not pick the same free IP
+	mu sync.Mutex
+}
+
+func NewPfsenseRESTService(client *integration.PfsenseRESTClient, dryRun bool, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	return &pfsenseRESTService{
+		pool:   newPool(subnet, exclusions),
+		client: client,
+		dryRun: dryRun,
+	}
+}
+
+func (s *pfsenseRESTService) AllocateIP(ctx context.Context, namespace string, name string, clusterIP string, ports []ServicePort) (Allocation, error) {
+	slog.InfoContext(ctx, "allocating IP from pfsense", "namespace", namespace, "name", name, "ports", ports)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, err := s.usedAddresses(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	ip, err := s.allocate(used)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	return s.expose(ctx, namespace, name, clusterIP, ip, ports)
+}
+
+func (s *pfsenseRESTService) EnsureIP(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	// the port forwards are usually there, which is checked without waiting for the changes of other services
+	if allocation, ok, err := s.exposed(ctx, namespace, name, clusterIP, ip, ports); err != nil || ok {
+		return allocation, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if allocation, ok, err := s.exposed(ctx, namespace, name, clusterIP, ip, ports); err != nil || ok {
+		return allocation, err
+	}
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+
+	forwards, err := s.client.ListPortForwards(ctx)
+	if err != nil {
+		return Allocation{}, fmt.Errorf("failed to list port forwards; %w", err)
+	}
+	existing := integration.FilterSlice(forwards, hasDestination(ip))
+	if len(existing) == 0 {
+		slog.InfoContext(ctx, "re-creating missing pfsense port forwards for assigned IP", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+	} else {
+		slog.InfoContext(ctx, "rewriting pfsense port forwards that differ from the service", "namespace", namespace, "name", name, "ip", ip, "ports", ports)
+		if err := s.removePortForwards(ctx, existing); err != nil {
+			return Allocation{}, err
+		}
+	}
+	return s.expose(ctx, namespace, name, clusterIP, ip, ports)
+}
+
+func (s *pfsenseRESTService) UpdatePorts(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	slog.InfoContext(ctx, "updating ports in pfsense", "ip", ip, "ports", ports)
+	if err := s.checkAllocatable(ip); err != nil {
+		return Allocation{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.deletePortForwards(ctx, ip); err != nil {
+		return Allocation{}, err
+	}
+	return s.expose(ctx, namespace, name, clusterIP, ip, ports)
+}
+
+func (s *pfsenseRESTService) ReserveIP(ctx context.Context, namespace string, name string, ip string) (Allocation, error) {
+	owner := namespace + "/" + name
+	if ip != "" {
+		return Allocation{IP: ip, Pool: s.name()}, s.reserveIP(ip, owner)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, err := s.usedAddresses(ctx)
+	if err != nil {
+		return Allocation{}, err
+	}
+	ip, err = s.reserve(used, owner)
+	if err != nil {
+		return Allocation{}, err
+	}
+	return Allocation{IP: ip, Pool: s.name()}, nil
+}
+
+func (s *pfsenseRESTService) ReleaseIP(ctx context.Context, ip string) error {
+	slog.InfoContext(ctx, "releasing IP back to pfsense", "ip", ip)
+	defer s.unreserve(ip)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.deletePortForwards(ctx, ip); err != nil {
+		return err
+	}
+	if err := s.deleteAlias(ctx, ip); err != nil {
+		return err
+	}
+	// the virtual IP goes last, so the address is not dropped while it is still forwarded
+	if err := s.deleteVirtualIP(ctx, ip); err != nil {
+		return err
+	}
+	if err := s.apply(ctx, true); err != nil {
+		return err
+	}
+	return s.verifyAddress(ctx, ip, nil, nil, nil)
+}
+
+// exposed reports whether the port forwards, the virtual IP and the alias of the service are in place
+func (s *pfsenseRESTService) exposed(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, bool, error) {
+	forwards, err := s.client.ListPortForwards(ctx)
+	if err != nil {
+		return Allocation{}, false, fmt.Errorf("failed to list port forwards; %w", err)
+	}
+	existing := integration.MapSlice(integration.FilterSlice(forwards, hasDestination(ip)), fromPortForward)
+	if !rulesMatch(existing, buildRules(namespace, name, clusterIP, ip, ports)) {
+		return Allocation{}, false, nil
+	}
+	vips, err := s.client.ListVirtualIPs(ctx)
+	if err != nil {
+		return Allocation{}, false, fmt.Errorf("failed to list virtual ips; %w", err)
+	}
+	aliases, err := s.client.ListAliases(ctx)
+	if err != nil {
+		return Allocation{}, false, fmt.Errorf("failed to list aliases; %w", err)
+	}
+	vip := integration.FilterSlice(vips, isVirtualIPOf(namespace, name, ip))
+	if len(vip) == 0 || !slices.ContainsFunc(aliases, isAliasOf(namespace, name, ip)) {
+		return Allocation{}, false, nil
+	}
+	return Allocation{IP: ip, Pool: s.name(), VirtualIPIDs: []string{vip[0].UniqID}}, true, nil
+}
+
+// usedAddresses returns the addresses that are forwarded or held by a virtual IP
+func (s *pfsenseRESTService) usedAddresses(ctx context.Context) ([]string, error) {
+	forwards, err := s.client.ListPortForwards(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list port forwards; %w", err)
+	}
+	vips, err := s.client.ListVirtualIPs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list virtual ips; %w", err)
+	}
+	used := integration.MapSlice(forwards, func(pf integration.RESTPortForward) string {
+		return pf.Destination
+	})
+	return append(used, integration.MapSlice(vips, func(v integration.RESTVirtualIP) string {
+		return v.Subnet
+	})...), nil
+}
+
+// expose creates the virtual IP and the alias of the address when they are missing, and then the port forwards;
+// what it created is removed again when a later step fails, so no service is half exposed
+func (s *pfsenseRESTService) expose(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort) (Allocation, error) {
+	vipID, vipCreated, err := s.ensureVirtualIP(ctx, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, err
+	}
+	undo := func(aliasCreated bool) error {
+		var errs []error
+		if aliasCreated {
+			errs = append(errs, s.deleteAlias(ctx, ip))
+		}
+		if vipCreated {
+			errs = append(errs, s.deleteVirtualIP(ctx, ip))
+		}
+		return errors.Join(errs...)
+	}
+	aliasCreated, err := s.ensureAlias(ctx, namespace, name, ip)
+	if err != nil {
+		return Allocation{}, errors.Join(err, undo(false))
+	}
+	if err := s.createPortForwards(ctx, namespace, name, clusterIP, ip, ports, vipCreated); err != nil {
+		return Allocation{}, errors.Join(err, undo(aliasCreated))
+	}
+	forwards := integration.MapSlice(buildRules(namespace, name, clusterIP, ip, ports), toPortForward)
+	vips := []integration.RESTVirtualIP{restVirtualIP(namespace, name, ip)}
+	if err := s.verifyAddress(ctx, ip, forwards, vips, []integration.RESTAlias{restAlias(namespace, name, ip)}); err != nil {
+		return Allocation{}, err
+	}
+	allocation := Allocation{IP: ip, Pool: s.name()}
+	if vipID != "" {
+		allocation.VirtualIPIDs = []string{vipID}
+	}
+	return allocation, nil
+}
+
+// ensureVirtualIP creates the ip alias virtual IP that makes pfsense answer arp requests for the address
+// and returns its id and whether it had to be created
+func (s *pfsenseRESTService) ensureVirtualIP(ctx context.Context, namespace string, name string, ip string) (string, bool, error) {
+	vips, err := s.client.ListVirtualIPs(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to list virtual ips; %w", err)
+	}
+	if existing := integration.FilterSlice(vips, isVirtualIPOf(namespace, name, ip)); len(existing) > 0 {
+		return existing[0].UniqID, false, nil
+	}
+	vip := restVirtualIP(namespace, name, ip)
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, virtual ip creation skipped", "virtualIP", integration.ToUnsafeJSONString(vip))
+		return "", false, nil
+	}
+	created, err := s.client.CreateVirtualIP(ctx, vip)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create virtual ip; %w", err)
+	}
+	return created.UniqID, true, nil
+}
+
+func (s *pfsenseRESTService) deleteVirtualIP(ctx context.Context, ip string) error {
+	vips, err := s.client.ListVirtualIPs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list virtual ips; %w", err)
+	}
+	owned := integration.FilterSlice(vips, isOwnedVirtualIPAt(ip))
+	return deleteByPosition(owned, func(v integration.RESTVirtualIP) int { return v.ID }, func(v integration.RESTVirtualIP) error {
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, virtual ip deletion skipped", "id", v.ID, "descr", v.Descr)
+			return nil
+		}
+		if err := s.client.DeleteVirtualIP(ctx, v.ID); err != nil {
+			return fmt.Errorf("failed to delete virtual ip %d; %w", v.ID, err)
+		}
+		return nil
+	})
+}
+
+// ensureAlias creates the host alias of the address, which lets firewall rules written on pfsense refer to
+// the address of the service by name, and returns whether it had to be created
+func (s *pfsenseRESTService) ensureAlias(ctx context.Context, namespace string, name string, ip string) (bool, error) {
+	aliases, err := s.client.ListAliases(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to list aliases; %w", err)
+	}
+	if slices.ContainsFunc(aliases, isAliasOf(namespace, name, ip)) {
+		return false, nil
+	}
+	if slices.ContainsFunc(aliases, func(a integration.RESTAlias) bool {
+		return a.Name == aliasName(ip) && !ownerDescr.MatchString(a.Descr)
+	}) {
+		return false, fmt.Errorf("alias %s exists in pfsense and is not managed by the controller", aliasName(ip))
+	}
+	// an alias of the address that is left from its previous owner is replaced
+	if err := s.deleteAlias(ctx, ip); err != nil {
+		return false, err
+	}
+	alias := restAlias(namespace, name, ip)
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, alias creation skipped", "alias", integration.ToUnsafeJSONString(alias))
+		return false, nil
+	}
+	if _, err := s.client.CreateAlias(ctx, alias); err != nil {
+		return false, fmt.Errorf("failed to create alias; %w", err)
+	}
+	return true, nil
+}
+
+func (s *pfsenseRESTService) deleteAlias(ctx context.Context, ip string) error {
+	aliases, err := s.client.ListAliases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list aliases; %w", err)
+	}
+	return deleteByPosition(integration.FilterSlice(aliases, isOwnedAliasAt(ip)), func(a integration.RESTAlias) int { return a.ID }, func(a integration.RESTAlias) error {
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, alias deletion skipped", "id", a.ID, "name", a.Name)
+			return nil
+		}
+		if err := s.client.DeleteAlias(ctx, a.ID); err != nil {
+			return fmt.Errorf("failed to delete alias %s; %w", a.Name, err)
+		}
+		return nil
+	})
+}
+
+// createPortForwards removes the port forwards it created when a later one fails, so no service is half exposed
+func (s *pfsenseRESTService) createPortForwards(ctx context.Context, namespace string, name string, clusterIP string, ip string, ports []ServicePort, vipChanged bool) error {
+	var created []integration.RESTPortForward
+	for _, r := range buildRules(namespace, name, clusterIP, ip, ports) {
+		pf := toPortForward(r)
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, port forward creation skipped", "portForward", integration.ToUnsafeJSONString(pf))
+			continue
+		}
+		pf, err := s.client.CreatePortForward(ctx, pf)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to create port forward; %w", err), s.removePortForwards(ctx, created))
+		}
+		created = append(created, pf)
+	}
+	if err := s.apply(ctx, vipChanged); err != nil {
+		return errors.Join(err, s.removePortForwards(ctx, created))
+	}
+	return nil
+}
+
+func (s *pfsenseRESTService) deletePortForwards(ctx context.Context, ip string) error {
+	forwards, err := s.client.ListPortForwards(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list port forwards; %w", err)
+	}
+	return s.removePortForwards(ctx, integration.FilterSlice(forwards, hasDestination(ip)))
+}
+
+func (s *pfsenseRESTService) removePortForwards(ctx context.Context, forwards []integration.RESTPortForward) error {
+	return deleteByPosition(forwards, func(pf integration.RESTPortForward) int { return pf.ID }, func(pf integration.RESTPortForward) error {
+		if s.dryRun {
+			slog.InfoContext(ctx, "dry run enabled, port forward deletion skipped", "id", pf.ID, "descr", pf.Descr)
+			return nil
+		}
+		if err := s.client.DeletePortForward(ctx, pf.ID); err != nil {
+			return fmt.Errorf("failed to delete port forward %d; %w", pf.ID, err)
+		}
+		return nil
+	})
+}
+
+// apply reloads the filter, and the virtual IPs as well when they changed
+func (s *pfsenseRESTService) apply(ctx context.Context, vipChanged bool) error {
+	if s.dryRun {
+		return nil
+	}
+	if vipChanged {
+		if err := s.client.ApplyVirtualIPs(ctx); err != nil {
+			return fmt.Errorf("failed to apply virtual ip changes; %w", err)
+		}
+	}
+	if err := s.client.ApplyFirewall(ctx); err != nil {
+		return fmt.Errorf("failed to apply firewall changes; %w", err)
+	}
+	return nil
+}
+
+// deleteByPosition deletes the items from the last one, since ids are positions in the config
+// and deleting from the end keeps the remaining ids valid
+func deleteByPosition[T any](items []T, id func(T) int, del func(T) error) error {
+	items = slices.SortedFunc(slices.Values(items), func(a, b T) int {
+		return cmp.Compare(id(b), id(a))
+	})
+	for _, item := range items {
+		if err := del(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restVirtualIP(namespace string, name string, ip string) integration.RESTVirtualIP {
+	return integration.RESTVirtualIP{
+		Mode:       "ipalias",
+		Interface:  "wan",
+		Type:       "single",
+		Subnet:     ip,
+		SubnetBits: 32,
+		Descr:      namespace + "/" + name,
+	}
+}
+
+func restAlias(namespace string, name string, ip string) integration.RESTAlias {
+	return integration.RESTAlias{
+		Name:    aliasName(ip),
+		Type:    "host",
+		Address: []string{ip},
+		Descr:   namespace + "/" + name,
+	}
+}
+
+func toPortForward(r rule) integration.RESTPortForward {
+	return integration.RESTPortForward{
+		Interface:       integration.FromPtr(r.Interface),
+		IPProtocol:      integration.FromPtr(r.Ipprotocol),
+		Protocol:        integration.FromPtr(r.Protocol),
+		Source:          "any",
+		Destination:     ruleAddress(r),
+		DestinationPort: integration.FromPtr(r.Destination.Port),
+		Target:          integration.FromPtr(r.Target),
+		LocalPort:       integration.FromPtr(r.LocalPort),
+		Descr:           integration.FromPtr(r.Descr),
+	}
+}
+
+func fromPortForward(pf integration.RESTPortForward) rule {
+	return rule{
+		Destination: &destination{Address: &pf.Destination, Port: &pf.DestinationPort},
+		Protocol:    &pf.Protocol,
+		Target:      &pf.Target,
+		LocalPort:   &pf.LocalPort,
+		Interface:   &pf.Interface,
+		Descr:       &pf.Descr,
+	}
+}
+
+// hasDestination matches the port forwards of the controller for the address
+func hasDestination(ip string) func(integration.RESTPortForward) bool {
+	return func(pf integration.RESTPortForward) bool {
+		return pf.Destination == ip && ownedDescr.MatchString(pf.Descr)
+	}
+}
+
+// isVirtualIPOf matches the ip alias virtual IP the controller created for the service
+func isVirtualIPOf(namespace string, name string, ip string) func(integration.RESTVirtualIP) bool {
+	return func(v integration.RESTVirtualIP) bool {
+		return isOwnedVirtualIPAt(ip)(v) && v.Descr == namespace+"/"+name
+	}
+}
+
+// isOwnedVirtualIPAt matches the ip alias virtual IPs of the controller for the address, so the virtual IPs
+// someone added to pfsense for the same address are left alone
+func isOwnedVirtualIPAt(ip string) func(integration.RESTVirtualIP) bool {
+	return func(v integration.RESTVirtualIP) bool {
+		return v.Mode == "ipalias" && v.Subnet == ip && ownerDescr.MatchString(v.Descr)
+	}
+}
+
+// isOwnedAliasAt matches the host alias of the controller for the address
+func isOwnedAliasAt(ip string) func(integration.RESTAlias) bool {
+	return func(a integration.RESTAlias) bool {
+		return a.Name == aliasName(ip) && ownerDescr.MatchString(a.Descr)
+	}
+}
+
+func isAliasOf(namespace string, name string, ip string) func(integration.RESTAlias) bool {
+	return func(a integration.RESTAlias) bool {
+		return a.Name == aliasName(ip) && a.Descr == namespace+"/"+name && slices.Equal(a.Address, []string{ip})
+	}
+}
+
+// aliasName names the host alias of the address, e.g. k8s_lb_10_0_0_1, as pfsense only allows letters,
+// digits and underscores in alias names
+func aliasName(ip string) string {
+	return "k8s_lb_" + strings.NewReplacer(".", "_", ":", "_").Replace(ip)
+}
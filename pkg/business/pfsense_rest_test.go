@@ -0,0 +1,251 @@
+package business
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/slamdev/pfsense-k8s-lb-controller/testdata"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_manage_port_forwards_with_rest_api(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	pfsenseURL, pfsenseStart := testdata.MockPfsenseRESTServer()
+	go func() {
+		if err := pfsenseStart(t.Context()); err != nil {
+			t.Logf("mock pfsense rest server stopped with error: %v", err)
+		}
+	}()
+
+	// no api key, so the client has to authenticate with a jwt
+	client, err := integration.CreatePfsenseRESTClient(pfsenseURL, "", integration.StaticCredentials{Username: "admin", Password: "admin"}, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+
+	svc := NewPfsenseRESTService(client, false, subnet)
+	namespace, name := testdata.RndName(), testdata.RndName()
+
+	allocation, err := svc.AllocateIP(t.Context(), namespace, name, "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.1", allocation.IP)
+	require.Len(t, allocation.VirtualIPIDs, 1)
+
+	vips, err := client.ListVirtualIPs(t.Context())
+	require.NoError(t, err)
+	require.Len(t, vips, 1)
+	require.Equal(t, allocation.VirtualIPIDs[0], vips[0].UniqID)
+	require.Equal(t, namespace+"/"+name, vips[0].Descr)
+
+	aliases, err := client.ListAliases(t.Context())
+	require.NoError(t, err)
+	require.Len(t, aliases, 1)
+	require.Equal(t, "k8s_lb_150_150_150_1", aliases[0].Name)
+	require.Equal(t, []string{allocation.IP}, aliases[0].Address)
+
+	ensured, err := svc.EnsureIP(t.Context(), namespace, name, "10.1.2.3", allocation.IP, []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.NoError(t, err)
+	require.Equal(t, allocation.VirtualIPIDs, ensured.VirtualIPIDs)
+
+	second, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.4", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8081, TargetPort: 80},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.2", second.IP)
+
+	updated, err := svc.UpdatePorts(t.Context(), namespace, name, "10.1.2.3", allocation.IP, []ServicePort{
+		{Name: "ssh", Protocol: "TCP", NodePort: 8022, TargetPort: 22},
+	})
+	require.NoError(t, err)
+	require.Equal(t, allocation.VirtualIPIDs, updated.VirtualIPIDs)
+
+	forwards, err := client.ListPortForwards(t.Context())
+	require.NoError(t, err)
+	require.Len(t, forwards, 2)
+
+	// a virtual IP someone added to pfsense for the address stays when the service releases it
+	_, err = client.CreateVirtualIP(t.Context(), integration.RESTVirtualIP{Mode: "ipalias", Interface: "wan", Type: "single", Subnet: allocation.IP, SubnetBits: 32, Descr: "uplink"})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.ReleaseIP(t.Context(), allocation.IP))
+
+	forwards, err = client.ListPortForwards(t.Context())
+	require.NoError(t, err)
+	require.Len(t, forwards, 1)
+	require.Equal(t, second.IP, forwards[0].Destination)
+
+	vips, err = client.ListVirtualIPs(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{second.IP, allocation.IP}, integration.MapSlice(vips, func(v integration.RESTVirtualIP) string {
+		return v.Subnet
+	}))
+	require.Equal(t, "uplink", vips[1].Descr)
+
+	aliases, err = client.ListAliases(t.Context())
+	require.NoError(t, err)
+	require.Len(t, aliases, 1)
+	require.Equal(t, []string{second.IP}, aliases[0].Address)
+}
+
+func Test_should_remove_created_port_forwards_virtual_ip_and_alias_when_one_of_them_fails(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	pfsenseURL, pfsenseStart := testdata.MockPfsenseRESTServer()
+	go func() {
+		if err := pfsenseStart(t.Context()); err != nil {
+			t.Logf("mock pfsense rest server stopped with error: %v", err)
+		}
+	}()
+	target, err := url.Parse(pfsenseURL)
+	require.NoError(t, err)
+
+	// a proxy in front of pfsense fails the second port forward with a page that is not json
+	var creates atomic.Int32
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/v2/firewall/nat/port_forward" && creates.Add(1) == 2 {
+			http.Error(w, "<html>bad gateway</html>", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := integration.CreatePfsenseRESTClient(srv.URL, "key", nil, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+	svc := NewPfsenseRESTService(client, false, subnet)
+
+	_, err = svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.ErrorContains(t, err, "status 502")
+
+	forwards, err := client.ListPortForwards(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, forwards)
+	vips, err := client.ListVirtualIPs(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, vips)
+	aliases, err := client.ListAliases(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, aliases)
+}
+
+func Test_should_serialize_concurrent_port_forward_changes(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	pfsenseURL, pfsenseStart := testdata.MockPfsenseRESTServer()
+	go func() {
+		if err := pfsenseStart(t.Context()); err != nil {
+			t.Logf("mock pfsense rest server stopped with error: %v", err)
+		}
+	}()
+	client, err := integration.CreatePfsenseRESTClient(pfsenseURL, "key", nil, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+	svc := NewPfsenseRESTService(client, false, subnet)
+
+	// ids are positions, so a delete that is not serialized with the others removes the port forwards of another service
+	const services = 8
+	var wg sync.WaitGroup
+	ips := make([]string, services)
+	errs := make([]error, services)
+	for i := range services {
+		wg.Go(func() {
+			name := "svc-" + strconv.Itoa(i)
+			allocation, err := svc.AllocateIP(t.Context(), "default", name, "10.1.2.3", []ServicePort{
+				{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+				{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ips[i] = allocation.IP
+			_, errs[i] = svc.UpdatePorts(t.Context(), "default", name, "10.1.2.3", allocation.IP, []ServicePort{
+				{Name: "ssh", Protocol: "TCP", NodePort: 8022, TargetPort: 22},
+			})
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	forwards, err := client.ListPortForwards(t.Context())
+	require.NoError(t, err)
+	destinations := integration.MapSlice(forwards, func(pf integration.RESTPortForward) string {
+		require.Equal(t, "22", pf.DestinationPort)
+		return pf.Destination
+	})
+	slices.Sort(destinations)
+	slices.Sort(ips)
+	require.Equal(t, ips, destinations)
+}
+
+func Test_should_fail_when_port_forward_read_back_from_rest_api_differs(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	pfsenseURL, pfsenseStart := testdata.MockPfsenseRESTServer()
+	go func() {
+		if err := pfsenseStart(t.Context()); err != nil {
+			t.Logf("mock pfsense rest server stopped with error: %v", err)
+		}
+	}()
+	target, err := url.Parse(pfsenseURL)
+	require.NoError(t, err)
+
+	// pfsense accepts the port forward but keeps another local port
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/v2/firewall/nat/port_forward" {
+			body, _ := io.ReadAll(r.Body)
+			body = bytes.ReplaceAll(body, []byte(`"local_port":"8080"`), []byte(`"local_port":"9090"`))
+			r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := integration.CreatePfsenseRESTClient(srv.URL, "key", nil, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+	svc := NewPfsenseRESTService(client, false, subnet)
+
+	_, err = svc.AllocateIP(t.Context(), "default", "svc", "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	var verificationErr *VerificationError
+	require.ErrorAs(t, err, &verificationErr)
+	require.Equal(t, "nat", verificationErr.Section)
+	require.Equal(t, []string{`port forward 80/tcp (default/svc 80) has local_port "9090", expected "8080"`}, verificationErr.Diff)
+}
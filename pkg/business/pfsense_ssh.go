@@ -0,0 +1,44 @@
+package business
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// NewPfsenseSSHService manages the same nat rules as the XML-RPC backend but transfers the config sections over ssh.
+// It manages no virtual IPs, so it cannot serve a CARP pair.
+func NewPfsenseSSHService(client *integration.PfsenseSSHClient, dryRun bool, writeWindow time.Duration, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	return withNATWriter(&pfsenseService{
+		pool:     newPool(subnet, exclusions),
+		sections: sshNATSections{client: client},
+		dryRun:   dryRun,
+	}, writeWindow)
+}
+
+type sshNATSections struct {
+	client *integration.PfsenseSSHClient
+}
+
+func (x sshNATSections) fetchNATSection(ctx context.Context) (nat, error) {
+	var section nat
+	if err := x.client.BackupSection(ctx, natConfigSection, &section); err != nil {
+		return nat{}, err
+	}
+	return section, nil
+}
+
+func (x sshNATSections) saveNATSection(ctx context.Context, section nat) error {
+	return x.client.RestoreSection(ctx, natConfigSection, section)
+}
+
+func (x sshNATSections) healthCheck(ctx context.Context) error {
+	_, err := integration.CheckerProbe(integration.PfsenseSSHHealthCheck(x.client))(ctx)
+	return err
+}
+
+func (x sshNATSections) configRevision(ctx context.Context) (string, error) {
+	return x.client.ConfigRevision(ctx)
+}
@@ -0,0 +1,86 @@
+package business
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/slamdev/pfsense-k8s-lb-controller/testdata"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_should_manage_nat_rules_over_ssh(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorizedKey, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	require.NoError(t, err)
+	privateKey := pem.EncodeToMemory(block)
+
+	address, hostKey, sshStart := testdata.MockPfsenseSSHServer(authorizedKey)
+	go func() {
+		if err := sshStart(t.Context()); err != nil {
+			t.Logf("mock pfsense ssh server stopped with error: %v", err)
+		}
+	}()
+
+	client, err := integration.CreatePfsenseSSHClient(address, "admin", privateKey, hostKey, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/readyz", http.NoBody)
+	require.NoError(t, err)
+	require.NoError(t, integration.PfsenseSSHHealthCheck(client)(req))
+
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+
+	svc := NewPfsenseSSHService(client, false, 0, subnet)
+	namespace, name := testdata.RndName(), testdata.RndName()
+
+	allocation, err := svc.AllocateIP(t.Context(), namespace, name, "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.1", allocation.IP)
+	require.Len(t, allocation.RuleTrackerIDs, 2)
+
+	second, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.4", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8081, TargetPort: 80},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.2", second.IP)
+
+	ensured, err := svc.EnsureIP(t.Context(), namespace, name, "10.1.2.3", allocation.IP, []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	require.NoError(t, err)
+	require.Equal(t, allocation.RuleTrackerIDs, ensured.RuleTrackerIDs)
+
+	require.NoError(t, svc.ReleaseIP(t.Context(), allocation.IP))
+
+	var section nat
+	require.NoError(t, client.BackupSection(t.Context(), natConfigSection, &section))
+	rules := integration.FromPtr(section.Rule)
+	require.Len(t, rules, 1)
+	require.Equal(t, second.IP, ruleAddress(rules[0]))
+
+	// a host key that is not pinned must be rejected
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherHostKey, err := ssh.NewPublicKey(otherPub)
+	require.NoError(t, err)
+	untrusted, err := integration.CreatePfsenseSSHClient(address, "admin", privateKey, string(ssh.MarshalAuthorizedKey(otherHostKey)), integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	require.Error(t, integration.PfsenseSSHHealthCheck(untrusted)(req))
+}
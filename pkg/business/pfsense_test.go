@@ -1,8 +1,27 @@
 package business
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
 	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
 	"github.com/slamdev/pfsense-k8s-lb-controller/testdata"
@@ -13,22 +32,9 @@ func Test_should_verify_pfsense_service(t *testing.T) {
 	t.Parallel()
 	testdata.SetTestLogger(t)
 
-	pfsenseURL, pfsenseStart := testdata.MockPfsenseServer()
-	go func() {
-		if err := pfsenseStart(t.Context()); err != nil {
-			t.Logf("mock pfsense server stopped with error: %v", err)
-		}
-	}()
+	svc := NewPfsenseService(newMockPfsenseClient(t, startMockPfsense(t), nil), false, 0, mockPfsenseSubnet)
 
-	client, err := integration.CreatePfsenseClient(pfsenseURL, "", "", true)
-	require.NoError(t, err)
-
-	subnet, err := netip.ParsePrefix("150.150.150.0/24")
-	require.NoError(t, err)
-
-	svc := NewPfsenseService(client, false, subnet)
-
-	ip, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", []ServicePort{
+	allocation, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", []ServicePort{
 		{
 			Name:        "http",
 			Protocol:    "TCP",
@@ -39,5 +45,683 @@ func Test_should_verify_pfsense_service(t *testing.T) {
 	})
 
 	require.NoError(t, err)
-	require.NotEmpty(t, ip)
+	require.NotEmpty(t, allocation.IP)
+	require.Len(t, allocation.RuleTrackerIDs, 1)
+}
+
+func Test_should_refuse_to_adopt_ip_outside_of_pool(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	svc := NewPfsenseService(newMockPfsenseClient(t, startMockPfsense(t), nil), false, 0, mockPfsenseSubnet)
+	ports := httpPorts()
+
+	allocation, err := svc.EnsureIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", "150.150.150.20", ports)
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.20", allocation.IP)
+
+	_, err = svc.EnsureIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", "10.10.10.10", ports)
+	require.ErrorIs(t, err, ErrIPOutsidePool)
+}
+
+func Test_should_rewrite_pfsense_rules_that_differ_from_service(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var restores []string
+	var mu sync.Mutex
+	pfsenseURL := proxyMockPfsense(t, func(_ http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		if strings.Contains(string(body), "pfsense.restore_config_section") {
+			mu.Lock()
+			restores = append(restores, string(body))
+			mu.Unlock()
+		}
+		return body
+	})
+	svc := NewPfsenseService(newMockPfsenseClient(t, pfsenseURL, nil), false, 0, netip.MustParsePrefix("150.150.148.0/22"))
+
+	// the mock forwards port 80 of the IP to the same node port, but without the descr of the service
+	_, err := svc.EnsureIP(t.Context(), "default", "svc", "10.1.10.2", "150.150.150.0", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 32152, TargetPort: 80},
+	})
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, restores, 1)
+	require.Contains(t, restores[0], "<string>default/svc 80</string>")
+}
+
+func Test_should_abort_hung_pfsense_call_after_read_timeout(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	// the server never answers while the test is running
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-hung
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(hung) })
+
+	client, err := integration.CreatePfsenseClient(srv.URL, integration.StaticCredentials{}, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{Read: 100 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	svc := NewPfsenseService(client, false, 0, mockPfsenseSubnet)
+
+	start := time.Now()
+	_, err = svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", httpPorts())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+func Test_should_retry_transient_pfsense_failures(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	// the first two requests fail as if pfsense was restarting
+	var requests atomic.Int32
+	pfsenseURL := proxyMockPfsense(t, func(w http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return nil
+		}
+		return body
+	})
+
+	guard := integration.NewCallGuard("default", 3, time.Millisecond, 10*time.Millisecond, 10, time.Minute)
+	svc := NewPfsenseService(newMockPfsenseClient(t, pfsenseURL, guard), false, 0, mockPfsenseSubnet)
+	_, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", httpPorts())
+	require.NoError(t, err)
+	require.Equal(t, integration.CircuitClosed, guard.State())
+}
+
+func Test_should_classify_pfsense_failures_and_open_circuit(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var requests atomic.Int32
+	status := atomic.Int32{}
+	status.Store(http.StatusUnauthorized)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+
+	guard := integration.NewCallGuard("default", 2, time.Millisecond, 10*time.Millisecond, 2, time.Minute)
+	svc := NewPfsenseService(newMockPfsenseClient(t, srv.URL, guard), false, 0, mockPfsenseSubnet)
+	ports := httpPorts()
+
+	// rejected credentials are not retried and do not count as an outage
+	_, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", ports)
+	var pfsenseErr *integration.PfsenseError
+	require.ErrorAs(t, err, &pfsenseErr)
+	require.Equal(t, integration.ErrorKindAuth, pfsenseErr.Kind)
+	require.True(t, integration.IsPermanent(err))
+	require.Equal(t, int32(1), requests.Load())
+	require.Equal(t, integration.CircuitClosed, guard.State())
+
+	// an unavailable pfsense is retried until the circuit opens
+	status.Store(http.StatusServiceUnavailable)
+	_, err = svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", ports)
+	require.True(t, integration.IsTransient(err))
+	require.Equal(t, int32(3), requests.Load())
+	require.Equal(t, integration.CircuitOpen, guard.State())
+
+	// while the circuit is open pfsense is not called at all
+	_, err = svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", ports)
+	var circuitErr *integration.CircuitOpenError
+	require.ErrorAs(t, err, &circuitErr)
+	require.Equal(t, int32(3), requests.Load())
+}
+
+func Test_should_verify_pfsense_with_ca_bundle_and_reload_client_certificate(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	target, err := url.Parse(startMockPfsense(t))
+	require.NoError(t, err)
+
+	ca, err := testdata.NewTestCA()
+	require.NoError(t, err)
+	serverCert, err := ca.ServerCertificate("pfsense.internal")
+	require.NoError(t, err)
+
+	var clientNames sync.Map
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientNames.Store(r.TLS.PeerCertificates[0].Subject.CommonName, true)
+		proxy.ServeHTTP(w, r)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	// every request makes a new handshake, so a rotated client certificate is presented right away
+	srv.Config.SetKeepAlivesEnabled(false)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(caFile, ca.PEM, 0o600))
+	writeClientCert := func(name string, modTime time.Time) {
+		certPEM, keyPEM, err := ca.Issue(name)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+		// the reload is driven by modification times, which may not change between two quick writes
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	writeClientCert("first", time.Now().Add(-time.Minute))
+
+	// the server certificate is issued for a name only, so the ip in the url does not verify without an override
+	tlsOptions := integration.TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}
+	client, err := integration.CreatePfsenseClient(srv.URL, integration.StaticCredentials{}, tlsOptions, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	require.Error(t, integration.PfsenseHealthCheck(client)(httptest.NewRequest(http.MethodGet, "/", nil)))
+
+	tlsOptions.ServerName = "pfsense.internal"
+	client, err = integration.CreatePfsenseClient(srv.URL, integration.StaticCredentials{}, tlsOptions, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, integration.PfsenseHealthCheck(client)(httptest.NewRequest(http.MethodGet, "/", nil)))
+	_, ok := clientNames.Load("first")
+	require.True(t, ok)
+
+	// a rotated certificate is picked up by the next handshake
+	writeClientCert("second", time.Now())
+	require.NoError(t, integration.PfsenseHealthCheck(client)(httptest.NewRequest(http.MethodGet, "/", nil)))
+	_, ok = clientNames.Load("second")
+	require.True(t, ok)
+}
+
+func Test_should_reread_rotated_pfsense_credentials_after_unauthorized(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var password atomic.Value
+	password.Store("first")
+	var unauthorized atomic.Int32
+	pfsenseURL := proxyMockPfsense(t, func(w http.ResponseWriter, r *http.Request, body []byte) []byte {
+		if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != password.Load() {
+			unauthorized.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return nil
+		}
+		return body
+	})
+
+	dir := t.TempDir()
+	usernameFile, passwordFile := filepath.Join(dir, "username"), filepath.Join(dir, "password")
+	modTime := time.Now().Add(-time.Minute)
+	require.NoError(t, os.WriteFile(usernameFile, []byte("admin\n"), 0o600))
+	require.NoError(t, os.WriteFile(passwordFile, []byte("first\n"), 0o600))
+	require.NoError(t, os.Chtimes(passwordFile, modTime, modTime))
+
+	credentials, err := integration.NewFileCredentials(usernameFile, passwordFile)
+	require.NoError(t, err)
+	client, err := integration.CreatePfsenseClient(pfsenseURL, credentials, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, nil)
+	require.NoError(t, err)
+	healthCheck := integration.PfsenseHealthCheck(client)
+	require.NoError(t, healthCheck(httptest.NewRequest(http.MethodGet, "/", nil)))
+
+	// the password is rotated on pfsense and in the file, which keeps its modification time,
+	// so only the rejected call makes the client read it again
+	password.Store("second")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("second\n"), 0o600))
+	require.NoError(t, os.Chtimes(passwordFile, modTime, modTime))
+	require.NoError(t, healthCheck(httptest.NewRequest(http.MethodGet, "/", nil)))
+	require.Equal(t, int32(1), unauthorized.Load())
+
+	// credentials that are still wrong after the re-read fail the call as an auth error
+	password.Store("third")
+	err = healthCheck(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Error(t, err)
+	var pfsenseErr *integration.PfsenseError
+	require.ErrorAs(t, err, &pfsenseErr)
+	require.Equal(t, integration.ErrorKindAuth, pfsenseErr.Kind)
+	require.Equal(t, int32(2), unauthorized.Load())
+}
+
+func Test_should_create_carp_vip_sync_peer_and_fail_over_to_secondary(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(primary.Close)
+
+	var mu sync.Mutex
+	var bodies []string
+	secondaryURL := proxyMockPfsense(t, func(w http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if strings.Contains(string(body), "pfsense.exec_php") {
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><methodResponse><params><param><value><boolean>1</boolean></value></param></params></methodResponse>`))
+			return nil
+		}
+		return body
+	})
+
+	guard := integration.NewCallGuard("default", 1, time.Millisecond, time.Millisecond, 10, time.Minute)
+	client := integration.NewPfsenseHAClient(newMockPfsenseClient(t, primary.URL, guard), newMockPfsenseClient(t, secondaryURL, nil))
+	carp := CARPConfig{Interface: "wan", VHID: 10, AdvSkew: 100, Password: "secret"}
+	svc := NewPfsenseHAService(client, carp, true, false, 0, mockPfsenseSubnet)
+	allocation, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", httpPorts())
+	require.NoError(t, err)
+	require.Len(t, allocation.VirtualIPIDs, 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	restoredVIP := integration.FilterSlice(bodies, func(body string) bool {
+		return strings.Contains(body, "pfsense.restore_config_section") && strings.Contains(body, "<name>virtualip</name>")
+	})
+	require.Len(t, restoredVIP, 1)
+	require.Contains(t, restoredVIP[0], "<string>carp</string>")
+	require.Contains(t, restoredVIP[0], "<name>vhid</name><value><string>10</string></value>")
+	require.Contains(t, restoredVIP[0], "<string>"+allocation.IP+"</string>")
+	require.True(t, slices.ContainsFunc(bodies, func(body string) bool {
+		return strings.Contains(body, "pfsense.exec_php") && strings.Contains(body, "filter sync")
+	}))
+}
+
+func Test_should_hand_out_distinct_vhids_and_leave_foreign_virtual_ips_alone(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	carp := CARPConfig{Interface: "wan", VHID: 10, Password: "secret"}
+	svc := NewPfsenseHAService(newMockPfsenseClient(t, startMockPfsense(t), nil), carp, false, false, 0, mockPfsenseSubnet).(*pfsenseService)
+
+	// someone added virtual IPs for addresses of the pool
+	require.NoError(t, svc.restoreVirtualIPSection(t.Context(), vipSection{VIP: &[]vip{
+		{Mode: integration.ToPointer("ipalias"), Interface: integration.ToPointer("wan"), Subnet: integration.ToPointer("150.150.150.1"), Descr: integration.ToPointer("uplink")},
+		{Mode: integration.ToPointer("carp"), Interface: integration.ToPointer("wan"), Subnet: integration.ToPointer("150.150.150.9"), Vhid: integration.ToPointer("20"), Descr: integration.ToPointer("uplink")},
+	}}))
+
+	// the services are ensured concurrently, so their virtual IPs are written by concurrent reconciles
+	const services = 5
+	var wg sync.WaitGroup
+	errs := make([]error, services)
+	for i := range services {
+		wg.Go(func() {
+			_, errs[i] = svc.EnsureIP(t.Context(), "default", "svc-"+strconv.Itoa(i), "10.1.2.3", "150.150.150."+strconv.Itoa(i+2), httpPorts())
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	section, err := svc.fetchVirtualIPSection(t.Context())
+	require.NoError(t, err)
+	vips := integration.FilterSlice(integration.FromPtr(section.VIP), func(v vip) bool {
+		return strings.HasPrefix(integration.FromPtr(v.Descr), "default/")
+	})
+	require.Len(t, vips, services)
+	vhids := integration.MapSlice(vips, func(v vip) string { return integration.FromPtr(v.Vhid) })
+	slices.Sort(vhids)
+	require.Equal(t, []string{"10", "11", "12", "13", "14"}, slices.Compact(vhids))
+
+	// the address of a foreign virtual IP is neither adopted nor released
+	_, err = svc.EnsureIP(t.Context(), "default", "foreign", "10.1.2.3", "150.150.150.9", httpPorts())
+	require.ErrorContains(t, err, "is not the carp virtual IP of default/foreign")
+	require.NoError(t, svc.ReleaseIP(t.Context(), "150.150.150.9"))
+	require.NoError(t, svc.ReleaseIP(t.Context(), "150.150.150.1"))
+
+	section, err = svc.fetchVirtualIPSection(t.Context())
+	require.NoError(t, err)
+	require.Len(t, integration.FromPtr(section.VIP), services+2)
+}
+
+func Test_should_mutate_pfsense_rules_with_php_instead_of_replacing_nat_section(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	encodedParams := regexp.MustCompile(`base64_decode\((?:&#34;|&quot;|")([A-Za-z0-9+/=]+)`)
+	var mu sync.Mutex
+	var methods []string
+	var ops []map[string]any
+	var rules any
+	pfsenseURL := proxyMockPfsense(t, func(w http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		methods = append(methods, regexp.MustCompile(`pfsense\.\w+`).FindString(string(body)))
+		if !strings.Contains(string(body), "pfsense.exec_php") {
+			return body
+		}
+		match := encodedParams.FindSubmatch(body)
+		require.NotNil(t, match)
+		decoded, err := base64.StdEncoding.DecodeString(string(match[1]))
+		require.NoError(t, err)
+		var params map[string]any
+		require.NoError(t, json.Unmarshal(decoded, &params))
+		ops = append(ops, params)
+		// the rules are kept, so they are read back as written
+		result := map[string]any{}
+		switch params["op"] {
+		case "addresses":
+			result["addresses"] = []string{"150.150.150.14", ""}
+		case "add":
+			rules = params["rules"]
+		case "rules":
+			result["rules"] = rules
+		case "delete":
+			result["deleted"], rules = 1, nil
+		}
+		// the result is printed the way php encodes it, which is [] for an empty array that is not cast to an object
+		printed := integration.ToUnsafeJSONString(result)
+		if len(result) == 0 && !bytes.Contains(body, []byte("json_encode((object) $result)")) {
+			printed = "[]"
+		}
+		_, _ = w.Write([]byte(`<?xml version="1.0"?><methodResponse><params><param><value><string>` + printed + `</string></value></param></params></methodResponse>`))
+		return nil
+	})
+	exclusion := integration.Range[netip.Addr]{Start: netip.MustParseAddr("150.150.150.0"), End: netip.MustParseAddr("150.150.150.13")}
+
+	svc := NewPfsensePHPService(newMockPfsenseClient(t, pfsenseURL, nil), CARPConfig{}, false, false, 0, mockPfsenseSubnet, exclusion)
+	allocation, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", httpPorts())
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.15", allocation.IP)
+	require.NoError(t, svc.ReleaseIP(t.Context(), allocation.IP))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"pfsense.host_firmware_version", "pfsense.exec_php", "pfsense.exec_php", "pfsense.exec_php", "pfsense.exec_php", "pfsense.exec_php"}, methods)
+	// every mutation is read back
+	require.Equal(t, []any{"addresses", "add", "rules", "delete", "rules"}, integration.MapSlice(ops, func(params map[string]any) any { return params["op"] }))
+	require.Equal(t, allocation.IP, ops[1]["address"])
+	for _, params := range ops {
+		require.Equal(t, ownedDescr.String(), params["owned"])
+		require.Equal(t, ownerDescr.String(), params["owner"])
+	}
+	added, ok := ops[1]["rules"].([]any)
+	require.True(t, ok)
+	require.Len(t, added, 1)
+	require.Equal(t, allocation.IP, added[0].(map[string]any)["destination"].(map[string]any)["address"])
+
+	require.True(t, phpMutationsSupported("2.7.2-RELEASE"))
+	require.True(t, phpMutationsSupported("23.09.1-RELEASE"))
+	require.False(t, phpMutationsSupported("2.6.0-RELEASE"))
+	require.False(t, phpMutationsSupported("22.05-RELEASE"))
+}
+
+func Test_should_batch_concurrent_pfsense_writes_into_one_restore(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var fetches, restores atomic.Int32
+	pfsenseURL := proxyMockPfsense(t, func(_ http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		switch {
+		case strings.Contains(string(body), "pfsense.backup_config_section"):
+			fetches.Add(1)
+		case strings.Contains(string(body), "pfsense.restore_config_section"):
+			restores.Add(1)
+		}
+		return body
+	})
+	// the pool has room for all services but one, whose change fails without failing the others
+	const services = 10
+	exclusion := integration.Range[netip.Addr]{Start: netip.MustParseAddr("150.150.150.11"), End: netip.MustParseAddr("150.150.150.255")}
+	svc := NewPfsenseService(newMockPfsenseClient(t, pfsenseURL, nil), false, 200*time.Millisecond, mockPfsenseSubnet, exclusion)
+
+	var wg sync.WaitGroup
+	ips := make([]string, services+1)
+	errs := make([]error, services+1)
+	for i := range services + 1 {
+		wg.Go(func() {
+			allocation, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", httpPorts())
+			ips[i], errs[i] = allocation.IP, err
+		})
+	}
+	wg.Wait()
+
+	require.Len(t, integration.FilterSlice(errs, func(err error) bool { return err != nil }), 1)
+	ips = integration.FilterSlice(ips, isNotEmpty)
+	slices.Sort(ips)
+	require.Len(t, slices.Compact(ips), services)
+	// the section is read once for the batch and once to verify the write
+	require.Equal(t, int32(2), fetches.Load())
+	require.Equal(t, int32(1), restores.Load())
+}
+
+func Test_should_serve_unchanged_pfsense_sections_from_cache(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var revision atomic.Int64
+	revision.Store(1000)
+	var natReads, healthCalls atomic.Int32
+	pfsenseURL := proxyMockPfsense(t, func(w http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		switch {
+		case strings.Contains(string(body), "<string>revision</string>"):
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><methodResponse><params><param><value><struct><member><name>revision</name><value><struct>` +
+				`<member><name>time</name><value><string>` + strconv.FormatInt(revision.Load(), 10) + `</string></value></member>` +
+				`</struct></value></member></struct></value></param></params></methodResponse>`))
+			return nil
+		case strings.Contains(string(body), "pfsense.backup_config_section"):
+			natReads.Add(1)
+		case strings.Contains(string(body), "pfsense.host_firmware_version"):
+			healthCalls.Add(1)
+		}
+		return body
+	})
+
+	client := integration.NewPfsenseCachedClient(newMockPfsenseClient(t, pfsenseURL, nil), "default", time.Minute)
+	svc := NewPfsenseService(client, false, 0, mockPfsenseSubnet)
+
+	ensure := func() {
+		_, err := svc.EnsureIP(t.Context(), "default", "svc", "10.1.2.3", "150.150.150.200", httpPorts())
+		require.NoError(t, err)
+	}
+
+	// the first call writes the rules; the writer reads the section again within the same revision, which is
+	// served from memory, while the write drops the cache, so the section is read from pfsense to verify it
+	ensure()
+	require.Equal(t, int32(2), natReads.Load())
+	// the section read back has the rules and is served from memory while the revision is unchanged
+	ensure()
+	require.Equal(t, int32(2), natReads.Load())
+
+	// releasing an IP without rules writes nothing, so only a new revision makes the section be read again
+	require.NoError(t, svc.ReleaseIP(t.Context(), "150.150.150.201"))
+	require.Equal(t, int32(2), natReads.Load())
+	revision.Add(1)
+	require.NoError(t, svc.ReleaseIP(t.Context(), "150.150.150.201"))
+	require.Equal(t, int32(3), natReads.Load())
+
+	// the calls above show pfsense is reachable, so the health check does not call it
+	require.NoError(t, integration.PfsenseHealthCheck(client)(httptest.NewRequest(http.MethodGet, "/", nil)))
+	require.Equal(t, int32(0), healthCalls.Load())
+}
+
+func Test_should_report_cached_pfsense_health_after_failure_threshold(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var down atomic.Bool
+	var probes atomic.Int32
+	probe := func(_ context.Context) (string, error) {
+		probes.Add(1)
+		if down.Load() {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "2.7.2-RELEASE", nil
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	monitor := integration.NewHealthMonitor("site-a", probe, 10*time.Millisecond, 3, false)
+	degraded := integration.NewHealthMonitor("site-b", probe, 10*time.Millisecond, 3, true)
+	require.Error(t, monitor.Check(req), "not checked yet")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	t.Cleanup(cancel)
+	go func() { _ = monitor.Start(ctx) }()
+	go func() { _ = degraded.Start(ctx) }()
+	require.Eventually(t, func() bool { return monitor.Check(req) == nil && degraded.Check(req) == nil }, 5*time.Second, 10*time.Millisecond)
+
+	// the probes do not call pfsense themselves
+	before := probes.Load()
+	for range 10 {
+		require.NoError(t, monitor.Check(req))
+	}
+	require.Less(t, probes.Load()-before, int32(10))
+
+	down.Store(true)
+	require.Eventually(t, func() bool { return monitor.Check(req) != nil }, 5*time.Second, 10*time.Millisecond)
+	require.ErrorIs(t, monitor.Check(req), io.ErrUnexpectedEOF)
+	require.NoError(t, degraded.Check(req))
+
+	down.Store(false)
+	require.Eventually(t, func() bool { return monitor.Check(req) == nil }, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_should_roll_back_nat_section_when_pfsense_fails_after_write(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	var restores []string
+	var mu sync.Mutex
+	pfsenseURL := proxyMockPfsense(t, func(w http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(string(body), "pfsense.restore_config_section"):
+			restores = append(restores, string(body))
+		case strings.Contains(string(body), "pfsense.host_firmware_version") && len(restores) == 1:
+			// the filter did not come back after the first write
+			w.WriteHeader(http.StatusBadGateway)
+			return nil
+		}
+		return body
+	})
+	client := newMockPfsenseClient(t, pfsenseURL, nil)
+	history := NewSnapshotHistory(5)
+	svc, err := WithRollback(NewPfsenseService(client, false, 0, mockPfsenseSubnet), "site-a", history)
+	require.NoError(t, err)
+
+	name := testdata.RndName()
+	allocation, err := svc.AllocateIP(t.Context(), testdata.RndName(), name, "10.1.2.3", httpPorts())
+	require.ErrorContains(t, err, "rolled back nat section")
+	require.Empty(t, allocation.IP)
+
+	// the second restore writes back the section as it was before the first one
+	require.Len(t, restores, 2)
+	require.Contains(t, restores[0], name)
+	require.NotContains(t, restores[1], name)
+
+	snapshots := history.List()
+	require.Len(t, snapshots, 1)
+	require.Equal(t, "site-a", snapshots[0].Target)
+	require.True(t, snapshots[0].RolledBack)
+
+	rec := httptest.NewRecorder()
+	history.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/snapshots", nil))
+	require.Contains(t, rec.Body.String(), `"rolledBack":true`)
+
+	// php mutations and the backends with their own api do not replace sections, so they cannot roll back
+	_, err = WithRollback(NewPfsensePHPService(client, CARPConfig{}, false, false, 0, mockPfsenseSubnet), "site-a", history)
+	require.ErrorIs(t, err, ErrRollbackUnsupported)
+	_, err = WithRollback(NewPfsenseRESTService(nil, false, mockPfsenseSubnet), "site-a", history)
+	require.ErrorIs(t, err, ErrRollbackUnsupported)
+}
+
+func Test_should_roll_back_when_the_primary_fails_after_write_while_the_secondary_answers(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	// the primary stops answering health checks once it took the write
+	var written atomic.Bool
+	primaryURL := proxyMockPfsense(t, func(w http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		if strings.Contains(string(body), "pfsense.host_firmware_version") && written.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return nil
+		}
+		if strings.Contains(string(body), "pfsense.restore_config_section") {
+			written.Store(true)
+		}
+		return body
+	})
+
+	client := integration.NewPfsenseHAClient(newMockPfsenseClient(t, primaryURL, nil), newMockPfsenseClient(t, startMockPfsense(t), nil))
+	svc, err := WithRollback(NewPfsenseHAService(client, CARPConfig{}, false, false, 0, mockPfsenseSubnet), "site-a", NewSnapshotHistory(5))
+	require.NoError(t, err)
+
+	_, err = svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.3", httpPorts())
+	require.ErrorContains(t, err, "rolled back nat section")
+}
+
+func Test_should_fail_when_pfsense_does_not_keep_written_rules(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	pfsenseURL := proxyMockPfsense(t, func(_ http.ResponseWriter, _ *http.Request, body []byte) []byte {
+		if strings.Contains(string(body), "pfsense.restore_config_section") {
+			// pfsense accepts the section but keeps a different port than it was given
+			body = bytes.ReplaceAll(body, []byte("<string>8080</string>"), []byte("<string>9090</string>"))
+		}
+		return body
+	})
+	svc := NewPfsenseService(newMockPfsenseClient(t, pfsenseURL, nil), false, 0, mockPfsenseSubnet)
+
+	_, err := svc.AllocateIP(t.Context(), "default", "svc", "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+		{Name: "https", Protocol: "TCP", NodePort: 8443, TargetPort: 443},
+	})
+	var verificationErr *VerificationError
+	require.ErrorAs(t, err, &verificationErr)
+	require.Equal(t, "nat", verificationErr.Section)
+	require.Len(t, verificationErr.Diff, 1)
+	require.Regexp(t, `^rule \d+ \(default/svc 80\) has local-port "9090", expected "8080"$`, verificationErr.Diff[0])
+}
+
+// mockPfsenseSubnet is the pool the tests allocate from
+var mockPfsenseSubnet = netip.MustParsePrefix("150.150.150.0/24")
+
+// httpPorts forwards port 80 of the service to node port 8080
+func httpPorts() []ServicePort {
+	return []ServicePort{{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80}}
+}
+
+// startMockPfsense runs the mock pfsense server until the test ends and returns its url
+func startMockPfsense(t *testing.T) string {
+	t.Helper()
+	pfsenseURL, pfsenseStart := testdata.MockPfsenseServer()
+	go func() {
+		if err := pfsenseStart(t.Context()); err != nil {
+			t.Logf("mock pfsense server stopped with error: %v", err)
+		}
+	}()
+	return pfsenseURL
+}
+
+// proxyMockPfsense puts intercept in front of a mock pfsense server and returns the url of the proxy. Intercept sees
+// every call with its body and returns the body to pass on to the mock, or nil once it answered the call itself.
+func proxyMockPfsense(t *testing.T, intercept func(w http.ResponseWriter, r *http.Request, body []byte) []byte) string {
+	t.Helper()
+	target, err := url.Parse(startMockPfsense(t))
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		body = intercept(w, r, body)
+		if body == nil {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// newMockPfsenseClient calls a mock pfsense server without credentials and certificate checks
+func newMockPfsenseClient(t *testing.T, pfsenseURL string, guard *integration.CallGuard) *integration.PfsenseClient {
+	t.Helper()
+	client, err := integration.CreatePfsenseClient(pfsenseURL, integration.StaticCredentials{}, integration.TLSOptions{Insecure: true}, integration.PfsenseTimeouts{}, guard)
+	require.NoError(t, err)
+	return client
 }
@@ -0,0 +1,103 @@
+package business
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// pool hands out IPs of a subnet except the excluded ranges; it is shared by all pfsense backends
+type pool struct {
+	subnet     netip.Prefix
+	exclusions []integration.Range[netip.Addr]
+	// reserved are IPs handed out without rules, e.g. while the service waits for approval
+	reserved *reservations
+}
+
+// reservations map the reserved IPs to the namespace/name of their service; they live in memory only
+// and are made again by the reconcile of each service after a restart
+type reservations struct {
+	mu  sync.Mutex
+	ips map[string]string
+}
+
+func newPool(subnet netip.Prefix, exclusions []integration.Range[netip.Addr]) pool {
+	return pool{subnet: subnet, exclusions: exclusions, reserved: &reservations{ips: map[string]string{}}}
+}
+
+func (p pool) allocate(allocatedIPs []string) (string, error) {
+	p.reserved.mu.Lock()
+	defer p.reserved.mu.Unlock()
+	return p.allocateLocked(allocatedIPs)
+}
+
+func (p pool) allocateLocked(allocatedIPs []string) (string, error) {
+	used := slices.Concat(allocatedIPs, slices.Collect(maps.Keys(p.reserved.ips)))
+	ip, err := integration.AllocateIP(p.subnet, p.exclusions, integration.FilterSlice(integration.UniqueSlice(used), isNotEmpty))
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate IP; %w", err)
+	}
+	return ip, nil
+}
+
+// reserve allocates an IP that is neither used nor reserved and keeps it for the owner;
+// an owner that already has a reservation gets the same IP.
+func (p pool) reserve(allocatedIPs []string, owner string) (string, error) {
+	p.reserved.mu.Lock()
+	defer p.reserved.mu.Unlock()
+	for ip, o := range p.reserved.ips {
+		if o == owner {
+			return ip, nil
+		}
+	}
+	ip, err := p.allocateLocked(allocatedIPs)
+	if err != nil {
+		return "", err
+	}
+	p.reserved.ips[ip] = owner
+	return ip, nil
+}
+
+// reserveIP keeps the IP for the owner again, e.g. after a restart.
+func (p pool) reserveIP(ip string, owner string) error {
+	if err := p.checkAllocatable(ip); err != nil {
+		return err
+	}
+	p.reserved.mu.Lock()
+	defer p.reserved.mu.Unlock()
+	p.reserved.ips[ip] = owner
+	return nil
+}
+
+func (p pool) unreserve(ip string) {
+	p.reserved.mu.Lock()
+	defer p.reserved.mu.Unlock()
+	delete(p.reserved.ips, ip)
+}
+
+func (p pool) IsInPool(ip string) bool {
+	return p.checkAllocatable(ip) == nil
+}
+
+func (p pool) checkAllocatable(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("failed to parse IP %s; %w", ip, err)
+	}
+	if !integration.IsAllocatable(p.subnet, p.exclusions, addr) {
+		return fmt.Errorf("%w; %s", ErrIPOutsidePool, ip)
+	}
+	return nil
+}
+
+func (p pool) name() string {
+	return p.subnet.String()
+}
+
+func isNotEmpty(s string) bool {
+	return s != ""
+}
@@ -11,9 +11,13 @@ import (
 	"slices"
 	"time"
 
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
 	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -21,22 +25,63 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+const (
+	// fieldManager owns the status fields written with server-side apply
+	fieldManager          = "pfsense-k8s-lb-controller"
+	conditionTypeIPInPool = "IPInPool"
+	// conditionTypeChangePending is set while an allocation or a port change waits for a maintenance window
+	conditionTypeChangePending = "ChangePending"
+	// permanentFailureRequeue spaces out retries of pfsense failures that need someone to fix them
+	permanentFailureRequeue = 5 * time.Minute
+	// legacyPortsHashAnnotation kept the synced ports on the service before they moved to the allocation,
+	// unless the ports hash annotation was configured
+	legacyPortsHashAnnotation = "slamdev.net/pfsense-k8s-lb-controller-ports-hash"
+)
+
+// ownedConditionTypes are the service conditions managed by the controller
+var ownedConditionTypes = []string{conditionTypeIPInPool, conditionTypeChangePending, conditionTypeApproved}
+
+// OutOfPoolPolicy defines what happens to services whose IP no longer belongs to any pool.
+type OutOfPoolPolicy string
+
+const (
+	// OutOfPoolPolicyFlag keeps the IP and marks the service with a condition.
+	OutOfPoolPolicyFlag OutOfPoolPolicy = "flag"
+	// OutOfPoolPolicyMigrate moves the service to a new IP and releases the old one after an overlap period.
+	OutOfPoolPolicyMigrate OutOfPoolPolicy = "migrate"
+)
+
 //nolint:unused
 type reconciler struct {
-	k8s                 client.Client
-	pfsense             PfsenseService
-	loadBalancerClass   string
-	finalizerName       string
+	k8s               client.Client
+	targets           pfsenseTargets
+	loadBalancerClass string
+	finalizerName     string
+	// portsHashAnnotation is read and removed on services that were synced before allocations were tracked
 	portsHashAnnotation string
+	outOfPoolPolicy     OutOfPoolPolicy
+	migrationOverlap    time.Duration
+	maintenance         *maintenanceGate
+	requireApproval     bool
 }
 
-func NewReconciler(k8s client.Client, pfsense PfsenseService, loadBalancerClass string, finalizerName string, portsHashAnnotation string) reconcile.Reconciler {
+// NewReconciler holds allocations and port changes back until one of the maintenance windows is open;
+// without windows they run right away. With requireApproval new ports are only exposed once they are approved,
+// see ApprovedByAnnotation. An empty portsHashAnnotation is the default key older versions kept the synced ports in.
+func NewReconciler(k8s client.Client, targets []PfsenseTarget, defaultTarget string, loadBalancerClass string, finalizerName string, portsHashAnnotation string, outOfPoolPolicy OutOfPoolPolicy, migrationOverlap time.Duration, maintenanceWindows []integration.MaintenanceWindow, requireApproval bool) reconcile.Reconciler {
+	if portsHashAnnotation == "" {
+		portsHashAnnotation = legacyPortsHashAnnotation
+	}
 	return &reconciler{
 		k8s:                 k8s,
-		pfsense:             pfsense,
+		targets:             pfsenseTargets{targets: targets, defaultTarget: defaultTarget},
 		loadBalancerClass:   loadBalancerClass,
 		finalizerName:       finalizerName,
 		portsHashAnnotation: portsHashAnnotation,
+		outOfPoolPolicy:     outOfPoolPolicy,
+		migrationOverlap:    migrationOverlap,
+		maintenance:         newMaintenanceGate(maintenanceWindows),
+		requireApproval:     requireApproval,
 	}
 }
 
@@ -47,6 +92,7 @@ func (r *reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if err := r.k8s.Get(ctx, req.NamespacedName, &svc); err != nil {
 		if apierrors.IsNotFound(err) {
 			// Already gone, nothing to do (finalizer would have handled cleanup)
+			r.maintenance.done(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, fmt.Errorf("get service: %w", err)
@@ -55,7 +101,11 @@ func (r *reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	// Always handle deletion if we have a finalizer, even if service type changed
 	if controllerutil.ContainsFinalizer(&svc, r.finalizerName) {
 		if !svc.DeletionTimestamp.IsZero() || !r.isOurService(&svc) {
-			return r.handleDeletion(ctx, &svc)
+			res, err := r.handleDeletion(ctx, &svc)
+			if err != nil {
+				return errorResult(ctx, err)
+			}
+			return res, nil
 		}
 	}
 
@@ -68,23 +118,48 @@ func (r *reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	// Handle create/update
 	res, err := r.handleCreateOrUpdate(ctx, &svc)
 	if err != nil {
-		if apierrors.IsConflict(err) {
-			logger.V(1).Info("conflict updating service, requeuing", "error", err)
-			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
-		}
-		return ctrl.Result{}, err
+		return errorResult(ctx, err)
 	}
 	return res, nil
 }
 
+// errorResult requeues conflicts shortly, as they only mean the object changed since it was read
+func errorResult(ctx context.Context, err error) (ctrl.Result, error) {
+	if apierrors.IsConflict(err) {
+		log.FromContext(ctx).V(1).Info("conflict updating service, requeuing", "error", err)
+		return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+	}
+	return pfsenseErrorResult(ctx, err)
+}
+
+// pfsenseErrorResult waits out an open circuit and slows down on failures that an immediate retry would not fix,
+// like rejected credentials or a malformed config; other errors go through the usual rate limited requeue.
+func pfsenseErrorResult(ctx context.Context, err error) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	var circuitErr *integration.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		logger.Info("pfsense circuit breaker is open, requeuing", "retryAfter", circuitErr.RetryAfter)
+		return ctrl.Result{RequeueAfter: circuitErr.RetryAfter}, nil
+	}
+	if integration.IsPermanent(err) {
+		logger.Error(err, "pfsense failure is not transient, requeuing", "retryAfter", permanentFailureRequeue)
+		return ctrl.Result{RequeueAfter: permanentFailureRequeue}, nil
+	}
+	return ctrl.Result{}, err
+}
+
 func (r *reconciler) isOurService(svc *corev1.Service) bool {
+	return isLoadBalancerOfClass(svc, r.loadBalancerClass)
+}
+
+func isLoadBalancerOfClass(svc *corev1.Service, loadBalancerClass string) bool {
 	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
 		return false
 	}
 	if svc.Spec.LoadBalancerClass == nil {
 		return false
 	}
-	return *svc.Spec.LoadBalancerClass == r.loadBalancerClass
+	return *svc.Spec.LoadBalancerClass == loadBalancerClass
 }
 
 func (r *reconciler) handleCreateOrUpdate(ctx context.Context, svc *corev1.Service) (ctrl.Result, error) {
@@ -92,8 +167,10 @@ func (r *reconciler) handleCreateOrUpdate(ctx context.Context, svc *corev1.Servi
 
 	// Add finalizer if missing
 	if !controllerutil.ContainsFinalizer(svc, r.finalizerName) {
+		// the finalizers are a list, which a merge patch replaces as a whole, so a concurrent change fails the patch
+		patch := client.MergeFromWithOptions(svc.DeepCopy(), client.MergeFromWithOptimisticLock{})
 		controllerutil.AddFinalizer(svc, r.finalizerName)
-		if err := r.k8s.Update(ctx, svc); err != nil {
+		if err := r.k8s.Patch(ctx, svc, patch); err != nil {
 			return ctrl.Result{}, fmt.Errorf("add finalizer: %w", err)
 		}
 		logger.V(0).Info("added finalizer to service")
@@ -104,69 +181,372 @@ func (r *reconciler) handleCreateOrUpdate(ctx context.Context, svc *corev1.Servi
 	ports := extractServicePorts(svc)
 	currentPortsHash := computePortsHash(ports)
 
-	// Assign IP from external LB if not already assigned
-	if len(svc.Status.LoadBalancer.Ingress) == 0 {
-		ip, err := r.pfsense.AllocateIP(ctx, svc.Namespace, svc.Name, svc.Spec.ClusterIP, ports)
+	lba, err := r.getAllocation(ctx, svc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	ip, lastPortsHash := assignedIP(svc, lba), r.lastPortsHash(svc, lba)
+
+	target, err := r.targets.forService(svc, lba)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("select pfsense target: %w", err)
+	}
+	logger = logger.WithValues("target", target.Name)
+	ctx = log.IntoContext(ctx, logger)
+
+	var approvedBy, pendingApproval string
+	if r.requireApproval {
+		approvedBy, pendingApproval, err = r.approve(ctx, svc, lba, currentPortsHash)
 		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("allocate IP: %w", err)
+			return ctrl.Result{}, err
+		}
+		if err := r.setCondition(ctx, svc, approvalCondition(approvedBy, pendingApproval)); err != nil {
+			return ctrl.Result{}, err
 		}
+	}
 
-		svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
-			{
-				IP:     ip,
-				IPMode: integration.ToPointer(corev1.LoadBalancerIPModeVIP),
-				Ports:  r.toLoadBalancerIngressPorts(ports),
-			},
+	// Assign IP from external LB if not already assigned
+	if ip == "" {
+		if pendingApproval != "" {
+			return ctrl.Result{}, r.waitForApproval(ctx, svc, target, ip)
+		}
+		if res, held, err := r.holdForMaintenance(ctx, svc, "allocation"); held {
+			return res, err
+		}
+		defer r.maintenance.done(client.ObjectKeyFromObject(svc))
+		allocation, err := target.Service.AllocateIP(ctx, svc.Namespace, svc.Name, svc.Spec.ClusterIP, ports)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("allocate IP: %w", err)
 		}
-		if err := r.k8s.Status().Update(ctx, svc); err != nil {
+		if err := r.saveAllocation(ctx, svc, newAllocationStatus(target, allocation, currentPortsHash, approvedBy)); err != nil {
 			// Failed to persist — release the IP to avoid leak
-			rerr := r.pfsense.ReleaseIP(ctx, ip)
-			return ctrl.Result{}, fmt.Errorf("update status: %w", errors.Join(err, rerr))
+			rerr := target.Service.ReleaseIP(ctx, allocation.IP)
+			return ctrl.Result{}, fmt.Errorf("save allocation: %w", errors.Join(err, rerr))
 		}
-		logger.V(0).Info("assigned load balancer IP", "ip", ip)
-
-		// Store ports hash in annotation
-		if err := r.updateServicePorts(ctx, svc, currentPortsHash); err != nil {
+		logger.V(0).Info("assigned load balancer IP", "ip", allocation.IP)
+		if err := r.dropLegacyAnnotation(ctx, svc); err != nil {
 			return ctrl.Result{}, err
 		}
+		return ctrl.Result{}, r.publishIngress(ctx, svc, allocation.IP, ports)
+	}
+
+	logger.V(0).Info("service already has load balancer IP", "ip", ip)
+
+	if pendingApproval != "" && lastPortsHash != currentPortsHash {
+		r.maintenance.done(client.ObjectKeyFromObject(svc))
+		return ctrl.Result{}, r.waitForApproval(ctx, svc, target, ip)
+	}
+
+	if !target.Service.IsInPool(ip) {
+		return r.handleOutOfPool(ctx, svc, target, lba, ip, ports, currentPortsHash, approvedBy)
+	}
+
+	var allocation Allocation
+	if lastPortsHash != currentPortsHash {
+		if res, held, err := r.holdForMaintenance(ctx, svc, "port change"); held {
+			return res, err
+		}
+		defer r.maintenance.done(client.ObjectKeyFromObject(svc))
+		logger.V(0).Info("ports changed, updating pfsense", "ip", ip, "oldHash", lastPortsHash, "newHash", currentPortsHash)
+		allocation, err = target.Service.UpdatePorts(ctx, svc.Namespace, svc.Name, svc.Spec.ClusterIP, ip, ports)
 	} else {
-		ip := svc.Status.LoadBalancer.Ingress[0].IP
-		logger.V(0).Info("service already has load balancer IP", "ip", ip)
-
-		// Check if ports have changed
-		lastPortsHash := svc.Annotations[r.portsHashAnnotation]
-		if lastPortsHash != currentPortsHash {
-			logger.V(0).Info("ports changed, updating pfsense", "ip", ip, "oldHash", lastPortsHash, "newHash", currentPortsHash)
-			if err := r.pfsense.UpdatePorts(ctx, ip, ports); err != nil {
-				return ctrl.Result{}, fmt.Errorf("update ports: %w", err)
-			}
+		// a queued change that is no longer needed must not hold back the ones after it
+		r.maintenance.done(client.ObjectKeyFromObject(svc))
+		// Make sure pfsense still has rules for the IP, e.g. after a config restore
+		allocation, err = target.Service.EnsureIP(ctx, svc.Namespace, svc.Name, svc.Spec.ClusterIP, ip, ports)
+	}
+	if err != nil {
+		if !errors.Is(err, ErrIPOutsidePool) {
+			return ctrl.Result{}, fmt.Errorf("sync IP: %w", err)
+		}
+		logger.V(0).Info("refusing to adopt load balancer IP outside of every pool", "ip", ip)
+		return ctrl.Result{}, r.setCondition(ctx, svc, outsidePoolCondition(ip))
+	}
 
-			// Update ports hash annotation
-			if err := r.updateServicePorts(ctx, svc, currentPortsHash, ports...); err != nil {
-				return ctrl.Result{}, err
-			}
-			logger.V(0).Info("updated ports in pfsense", "ip", ip)
+	status := newAllocationStatus(target, allocation, currentPortsHash, approvedBy)
+	if lba != nil {
+		status.RetiringIPs = lba.Status.RetiringIPs
+		status.RetireTime = lba.Status.RetireTime
+	}
+	requeueAfter, err := r.retireIPs(ctx, target, &status)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.saveAllocation(ctx, svc, status); err != nil {
+		return ctrl.Result{}, fmt.Errorf("save allocation: %w", err)
+	}
+	if err := r.dropLegacyAnnotation(ctx, svc); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, r.publishIngress(ctx, svc, ip, ports)
+}
+
+// handleOutOfPool either flags the service or moves it to a new IP, keeping the old one until the overlap is over
+func (r *reconciler) handleOutOfPool(ctx context.Context, svc *corev1.Service, target PfsenseTarget, lba *v1alpha1.LoadBalancerAllocation, ip string, ports []ServicePort, portsHash string, approvedBy string) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if r.outOfPoolPolicy != OutOfPoolPolicyMigrate {
+		logger.V(0).Info("load balancer IP is outside of every pool", "ip", ip)
+		return ctrl.Result{}, r.setCondition(ctx, svc, outsidePoolCondition(ip))
+	}
+
+	if res, held, err := r.holdForMaintenance(ctx, svc, "migration"); held {
+		return res, err
+	}
+	defer r.maintenance.done(client.ObjectKeyFromObject(svc))
+	allocation, err := target.Service.AllocateIP(ctx, svc.Namespace, svc.Name, svc.Spec.ClusterIP, ports)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("allocate IP for migration: %w", err)
+	}
+
+	status := newAllocationStatus(target, allocation, portsHash, approvedBy)
+	if lba != nil {
+		status.RetiringIPs = lba.Status.RetiringIPs
+	}
+	status.RetiringIPs = integration.UniqueSlice(append(status.RetiringIPs, ip))
+	status.RetireTime = integration.ToPointer(metav1.NewTime(time.Now().Add(r.migrationOverlap)))
+
+	if err := r.saveAllocation(ctx, svc, status); err != nil {
+		// Failed to persist — release the new IP to avoid leak
+		rerr := target.Service.ReleaseIP(ctx, allocation.IP)
+		return ctrl.Result{}, fmt.Errorf("save allocation: %w", errors.Join(err, rerr))
+	}
+	logger.V(0).Info("migrating load balancer IP out of the pool", "oldIP", ip, "newIP", allocation.IP, "overlap", r.migrationOverlap)
+
+	return ctrl.Result{RequeueAfter: r.migrationOverlap}, r.publishIngress(ctx, svc, allocation.IP, ports)
+}
+
+// retireIPs releases IPs left after a migration once the overlap is over, on the target that owns each of them,
+// otherwise it returns the time left until they can be released
+func (r *reconciler) retireIPs(ctx context.Context, target PfsenseTarget, status *v1alpha1.LoadBalancerAllocationStatus) (time.Duration, error) {
+	if len(status.RetiringIPs) == 0 {
+		return 0, nil
+	}
+	if status.RetireTime != nil {
+		if wait := time.Until(status.RetireTime.Time); wait > 0 {
+			return wait, nil
 		}
 	}
+	for _, ip := range status.RetiringIPs {
+		if err := r.targets.forIP(ip, target).Service.ReleaseIP(ctx, ip); err != nil {
+			return 0, fmt.Errorf("release retiring IP %s: %w", ip, err)
+		}
+		log.FromContext(ctx).V(0).Info("released retiring load balancer IP", "ip", ip)
+	}
+	status.RetiringIPs = nil
+	status.RetireTime = nil
+	return 0, nil
+}
 
-	return ctrl.Result{}, nil
+// assignedIP returns the IP recorded in the allocation, falling back to the service status
+// for services that were exposed before allocations were tracked
+func assignedIP(svc *corev1.Service, lba *v1alpha1.LoadBalancerAllocation) string {
+	if lba != nil && len(lba.Status.IPs) > 0 {
+		return lba.Status.IPs[0]
+	}
+	if len(svc.Status.LoadBalancer.Ingress) > 0 {
+		return svc.Status.LoadBalancer.Ingress[0].IP
+	}
+	return ""
 }
 
-func (r *reconciler) updateServicePorts(ctx context.Context, svc *corev1.Service, hash string, ports ...ServicePort) error {
-	if svc.Annotations == nil {
-		svc.Annotations = make(map[string]string)
+// lastPortsHash returns the hash of the ports synced to the assigned IP, falling back to the annotation
+// older versions kept it in
+func (r *reconciler) lastPortsHash(svc *corev1.Service, lba *v1alpha1.LoadBalancerAllocation) string {
+	if lba != nil && len(lba.Status.IPs) > 0 {
+		return lba.Status.SpecHash
 	}
-	svc.Annotations[r.portsHashAnnotation] = hash
+	return svc.Annotations[r.portsHashAnnotation]
+}
 
-	if len(ports) > 0 {
-		svc.Status.LoadBalancer.Ingress[0].Ports = r.toLoadBalancerIngressPorts(ports)
-		if err := r.k8s.Status().Update(ctx, svc); err != nil {
-			return fmt.Errorf("update status ports: %w", err)
+func (r *reconciler) getAllocation(ctx context.Context, svc *corev1.Service) (*v1alpha1.LoadBalancerAllocation, error) {
+	var lba v1alpha1.LoadBalancerAllocation
+	if err := r.k8s.Get(ctx, client.ObjectKeyFromObject(svc), &lba); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil //nolint:nilnil
 		}
+		return nil, fmt.Errorf("get allocation: %w", err)
+	}
+	return &lba, nil
+}
+
+// newAllocationStatus records the approver, if any, as the approver of the synced ports
+func newAllocationStatus(target PfsenseTarget, allocation Allocation, specHash string, approvedBy string) v1alpha1.LoadBalancerAllocationStatus {
+	status := v1alpha1.LoadBalancerAllocationStatus{
+		IPs:            []string{allocation.IP},
+		Target:         target.Name,
+		Pool:           allocation.Pool,
+		RuleTrackerIDs: allocation.RuleTrackerIDs,
+		VirtualIPIDs:   allocation.VirtualIPIDs,
+		SpecHash:       specHash,
+	}
+	if approvedBy != "" {
+		status.ApprovedBy, status.ApprovedSpecHash = approvedBy, specHash
+	}
+	return status
+}
+
+// saveAllocation records the pfsense state of the service; sync time is bumped only when the state changes
+func (r *reconciler) saveAllocation(ctx context.Context, svc *corev1.Service, status v1alpha1.LoadBalancerAllocationStatus) error {
+	lba := &v1alpha1.LoadBalancerAllocation{
+		ObjectMeta: metav1.ObjectMeta{Name: svc.Name, Namespace: svc.Namespace},
+	}
+	_, err := controllerutil.CreateOrPatch(ctx, r.k8s, lba, func() error {
+		lba.Spec.ServiceName = svc.Name
+		return controllerutil.SetControllerReference(svc, lba, r.k8s.Scheme())
+	})
+	if err != nil {
+		return fmt.Errorf("create allocation: %w", err)
 	}
 
-	if err := r.k8s.Update(ctx, svc); err != nil {
-		return fmt.Errorf("update ports hash annotation: %w", err)
+	status.LastSyncTime = lba.Status.LastSyncTime
+	if status.LastSyncTime != nil && equality.Semantic.DeepEqual(status, lba.Status) {
+		return nil
+	}
+	status.LastSyncTime = integration.ToPointer(metav1.Now())
+
+	patch := client.MergeFrom(lba.DeepCopy())
+	lba.Status = status
+	if err := r.k8s.Status().Patch(ctx, lba, patch); err != nil {
+		return fmt.Errorf("update allocation status: %w", err)
+	}
+	return nil
+}
+
+// dropLegacyAnnotation removes the ports hash older versions kept on the service, once the allocation holds it
+func (r *reconciler) dropLegacyAnnotation(ctx context.Context, svc *corev1.Service) error {
+	if _, ok := svc.Annotations[r.portsHashAnnotation]; !ok {
+		return nil
+	}
+	patch := client.MergeFromWithOptions(svc.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	delete(svc.Annotations, r.portsHashAnnotation)
+	if err := r.k8s.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("remove ports hash annotation: %w", err)
+	}
+	return nil
+}
+
+func (r *reconciler) deleteAllocation(ctx context.Context, lba *v1alpha1.LoadBalancerAllocation) error {
+	if lba == nil {
+		return nil
+	}
+	if err := r.k8s.Delete(ctx, lba); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete allocation: %w", err)
+	}
+	return nil
+}
+
+// publishIngress exposes the IP in service status if it is not there yet
+func (r *reconciler) publishIngress(ctx context.Context, svc *corev1.Service, ip string, ports []ServicePort) error {
+	ingress := []corev1.LoadBalancerIngress{
+		{
+			IP:     ip,
+			IPMode: integration.ToPointer(corev1.LoadBalancerIPModeVIP),
+			Ports:  r.toLoadBalancerIngressPorts(ports),
+		},
+	}
+	conditionChanged := meta.SetStatusCondition(&svc.Status.Conditions, ipInPoolCondition(svc, ip))
+	conditionChanged = clearChangePending(svc) || conditionChanged
+	if !conditionChanged && equality.Semantic.DeepEqual(ingress, svc.Status.LoadBalancer.Ingress) {
+		return nil
+	}
+	svc.Status.LoadBalancer.Ingress = ingress
+	if err := r.applyStatus(ctx, svc); err != nil {
+		return fmt.Errorf("update status: %w", err)
+	}
+	return nil
+}
+
+// applyStatus writes the load balancer ingress and the owned conditions with server-side apply,
+// so fields managed by other controllers are left untouched
+func (r *reconciler) applyStatus(ctx context.Context, svc *corev1.Service) error {
+	applied := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+		},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: svc.Status.LoadBalancer,
+			Conditions: integration.FilterSlice(svc.Status.Conditions, func(c metav1.Condition) bool {
+				return slices.Contains(ownedConditionTypes, c.Type)
+			}),
+		},
+	}
+	if err := r.k8s.Status().Patch(ctx, applied, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("apply status: %w", err)
+	}
+	applied.DeepCopyInto(svc)
+	return nil
+}
+
+// holdForMaintenance queues the change while no maintenance window is open and marks the service as pending;
+// it reports false once the change may run
+func (r *reconciler) holdForMaintenance(ctx context.Context, svc *corev1.Service, change string) (ctrl.Result, bool, error) {
+	wait, reason := r.maintenance.admit(client.ObjectKeyFromObject(svc), time.Now())
+	if wait == 0 {
+		return ctrl.Result{}, false, nil
+	}
+	log.FromContext(ctx).V(0).Info("pfsense change is held back for the maintenance window", "change", change, "reason", reason, "retryAfter", wait)
+	return ctrl.Result{RequeueAfter: wait}, true, r.setCondition(ctx, svc, changePendingCondition(change, reason))
+}
+
+func changePendingCondition(change string, reason string) metav1.Condition {
+	return metav1.Condition{
+		Type:    conditionTypeChangePending,
+		Status:  metav1.ConditionTrue,
+		Reason:  "MaintenanceWindow",
+		Message: fmt.Sprintf("pfsense %s is %s", change, reason),
+	}
+}
+
+// clearChangePending marks a pending change as done; services that never waited do not get the condition at all
+func clearChangePending(svc *corev1.Service) bool {
+	if !meta.IsStatusConditionTrue(svc.Status.Conditions, conditionTypeChangePending) {
+		return false
+	}
+	return meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+		Type:               conditionTypeChangePending,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Applied",
+		Message:            "no pfsense change is pending",
+		ObservedGeneration: svc.Generation,
+	})
+}
+
+func outsidePoolCondition(ip string) metav1.Condition {
+	return metav1.Condition{
+		Type:    conditionTypeIPInPool,
+		Status:  metav1.ConditionFalse,
+		Reason:  "OutsidePool",
+		Message: fmt.Sprintf("IP %s does not belong to any configured pool", ip),
+	}
+}
+
+func ipInPoolCondition(svc *corev1.Service, ip string) metav1.Condition {
+	return metav1.Condition{
+		Type:               conditionTypeIPInPool,
+		Status:             metav1.ConditionTrue,
+		Reason:             "InPool",
+		Message:            fmt.Sprintf("IP %s is managed in pfsense", ip),
+		ObservedGeneration: svc.Generation,
+	}
+}
+
+// setCondition persists the condition in service status only if it has changed
+func (r *reconciler) setCondition(ctx context.Context, svc *corev1.Service, condition metav1.Condition) error {
+	condition.ObservedGeneration = svc.Generation
+	if !meta.SetStatusCondition(&svc.Status.Conditions, condition) {
+		return nil
+	}
+	if err := r.applyStatus(ctx, svc); err != nil {
+		return fmt.Errorf("update status conditions: %w", err)
 	}
 	return nil
 }
@@ -196,6 +576,7 @@ func computePortsHash(ports []ServicePort) string {
 
 func (r *reconciler) handleDeletion(ctx context.Context, svc *corev1.Service) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
+	r.maintenance.done(client.ObjectKeyFromObject(svc))
 
 	if !controllerutil.ContainsFinalizer(svc, r.finalizerName) {
 		logger.V(0).Info("no finalizer present on service, skipping deletion handling")
@@ -203,20 +584,47 @@ func (r *reconciler) handleDeletion(ctx context.Context, svc *corev1.Service) (c
 		return ctrl.Result{}, nil
 	}
 
+	lba, err := r.getAllocation(ctx, svc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	ips := integration.MapSlice(svc.Status.LoadBalancer.Ingress, func(i corev1.LoadBalancerIngress) string {
+		return i.IP
+	})
+	if lba != nil {
+		ips = append(ips, lba.Status.IPs...)
+		ips = append(ips, lba.Status.RetiringIPs...)
+	}
+
+	// IPs outside of every pool are released on the target the service would be managed by
+	fallback, ferr := r.targets.forService(svc, lba)
+
 	// Release IP from external LB
-	for _, ingress := range svc.Status.LoadBalancer.Ingress {
-		if ingress.IP != "" {
-			if err := r.pfsense.ReleaseIP(ctx, ingress.IP); err != nil {
+	for _, ip := range integration.UniqueSlice(ips) {
+		if ip != "" {
+			target := r.targets.forIP(ip, fallback)
+			if target.Service == nil {
+				return ctrl.Result{}, fmt.Errorf("release IP %s: %w", ip, ferr)
+			}
+			if err := target.Service.ReleaseIP(ctx, ip); err != nil {
 				// Log and retry — don't remove finalizer until cleanup succeeds
-				return ctrl.Result{}, fmt.Errorf("release IP %s: %w", ingress.IP, err)
+				return ctrl.Result{}, fmt.Errorf("release IP %s: %w", ip, err)
 			}
-			logger.V(0).Info("released load balancer IP", "ip", ingress.IP)
+			logger.V(0).Info("released load balancer IP", "ip", ip)
 		}
 	}
 
+	// The allocation is garbage collected with the service, but the service may just have changed its type
+	if err := r.deleteAllocation(ctx, lba); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Cleanup done — remove finalizer
+	patch := client.MergeFromWithOptions(svc.DeepCopy(), client.MergeFromWithOptimisticLock{})
 	controllerutil.RemoveFinalizer(svc, r.finalizerName)
-	if err := r.k8s.Update(ctx, svc); err != nil {
+	delete(svc.Annotations, r.portsHashAnnotation)
+	if err := r.k8s.Patch(ctx, svc, patch); err != nil {
 		return ctrl.Result{}, fmt.Errorf("remove finalizer: %w", err)
 	}
 	logger.V(0).Info("removed finalizer from service")
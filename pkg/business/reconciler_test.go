@@ -0,0 +1,315 @@
+package business
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func Test_should_track_services_exposed_before_allocations_in_an_allocation(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Finalizers: []string{finalizer}},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: integration.ToPointer(class),
+			Ports:             []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.7"}}}},
+	}
+	portsHash := computePortsHash(extractServicePorts(svc))
+	svc.Annotations = map[string]string{legacyPortsHashAnnotation: portsHash}
+	k8s := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(svc).
+		WithStatusSubresource(&corev1.Service{}, &v1alpha1.LoadBalancerAllocation{}).
+		Build()
+	pfsense := &exposingService{}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", class, finalizer, "", OutOfPoolPolicyFlag, 0, nil, false)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+
+	// the ports were synced before, so the rules are only checked and the hash moves to the allocation
+	_, err := r.Reconcile(t.Context(), req)
+	require.NoError(t, err)
+	var got corev1.Service
+	var lba v1alpha1.LoadBalancerAllocation
+	require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &got))
+	require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &lba))
+	require.Equal(t, []string{"ensure 10.0.0.7"}, pfsense.calls)
+	require.Equal(t, []string{"10.0.0.7"}, lba.Status.IPs)
+	require.Equal(t, "default", lba.Status.Target)
+	require.Equal(t, portsHash, lba.Status.SpecHash)
+	require.NotContains(t, got.Annotations, legacyPortsHashAnnotation)
+
+	// the IP recorded in the allocation is released before the finalizer goes
+	pfsense.calls = nil
+	require.NoError(t, k8s.Delete(t.Context(), &got))
+	_, err = r.Reconcile(t.Context(), req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"release 10.0.0.7"}, pfsense.calls)
+	require.True(t, apierrors.IsNotFound(k8s.Get(t.Context(), req.NamespacedName, &got)))
+	require.True(t, apierrors.IsNotFound(k8s.Get(t.Context(), req.NamespacedName, &lba)))
+}
+
+func Test_should_read_the_ports_hash_from_the_configured_annotation(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	const annotation = "example.com/ports-hash"
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	// a service exposed before allocations, whose ports were synced under the configured key
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Finalizers: []string{finalizer}},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: integration.ToPointer(class),
+			Ports:             []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "10.0.0.7"}}}},
+	}
+	svc.Annotations = map[string]string{annotation: computePortsHash(extractServicePorts(svc))}
+	k8s := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(svc).
+		WithStatusSubresource(&corev1.Service{}, &v1alpha1.LoadBalancerAllocation{}).
+		Build()
+	pfsense := &exposingService{}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", class, finalizer, annotation, OutOfPoolPolicyFlag, 0, nil, false)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+
+	// the ports were synced under the configured key, so they are not rewritten on upgrade
+	_, err := r.Reconcile(t.Context(), req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ensure 10.0.0.7"}, pfsense.calls)
+	var got corev1.Service
+	var lba v1alpha1.LoadBalancerAllocation
+	require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &got))
+	require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &lba))
+	require.NotContains(t, got.Annotations, annotation)
+	require.Equal(t, computePortsHash(extractServicePorts(&got)), lba.Status.SpecHash)
+}
+
+func Test_should_flag_services_whose_ip_left_the_pool(t *testing.T) {
+	t.Parallel()
+
+	k8s, svc := outOfPoolFixture(t)
+	pfsense := &migratingService{outside: "10.0.0.7"}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", outOfPoolClass, outOfPoolFinalizer, "", OutOfPoolPolicyFlag, time.Hour, nil, false)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+
+	_, err := r.Reconcile(t.Context(), req)
+	require.NoError(t, err)
+	var got corev1.Service
+	require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &got))
+	require.Empty(t, pfsense.calls)
+	condition := meta.FindStatusCondition(got.Status.Conditions, conditionTypeIPInPool)
+	require.Equal(t, metav1.ConditionFalse, condition.Status)
+	require.Equal(t, "OutsidePool", condition.Reason)
+}
+
+func Test_should_migrate_services_whose_ip_left_the_pool_and_retire_the_old_ip_after_overlap(t *testing.T) {
+	t.Parallel()
+
+	k8s, svc := outOfPoolFixture(t)
+	pfsense := &migratingService{outside: "10.0.0.7"}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", outOfPoolClass, outOfPoolFinalizer, "", OutOfPoolPolicyMigrate, time.Hour, nil, false)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+	reconcileAndGet := func() (reconcile.Result, *corev1.Service, *v1alpha1.LoadBalancerAllocation) {
+		res, err := r.Reconcile(t.Context(), req)
+		require.NoError(t, err)
+		var svc corev1.Service
+		var lba v1alpha1.LoadBalancerAllocation
+		require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &svc))
+		require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &lba))
+		return res, &svc, &lba
+	}
+
+	// the service moves to a new IP, while the old one keeps forwarding until the overlap is over
+	res, got, lba := reconcileAndGet()
+	require.Equal(t, []string{"allocate"}, pfsense.calls)
+	require.Equal(t, time.Hour, res.RequeueAfter)
+	require.Equal(t, "10.0.1.1", got.Status.LoadBalancer.Ingress[0].IP)
+	require.Equal(t, []string{"10.0.1.1"}, lba.Status.IPs)
+	require.Equal(t, []string{"10.0.0.7"}, lba.Status.RetiringIPs)
+	require.NotNil(t, lba.Status.RetireTime)
+
+	// the old IP is kept while the overlap lasts
+	pfsense.calls = nil
+	res, _, lba = reconcileAndGet()
+	require.Equal(t, []string{"ensure 10.0.1.1"}, pfsense.calls)
+	require.Positive(t, res.RequeueAfter)
+	require.Equal(t, []string{"10.0.0.7"}, lba.Status.RetiringIPs)
+
+	// and released once it is over
+	lba.Status.RetireTime = integration.ToPointer(metav1.NewTime(time.Now().Add(-time.Minute)))
+	require.NoError(t, k8s.Status().Update(t.Context(), lba))
+	pfsense.calls = nil
+	res, _, lba = reconcileAndGet()
+	require.Equal(t, []string{"ensure 10.0.1.1", "release 10.0.0.7"}, pfsense.calls)
+	require.Zero(t, res.RequeueAfter)
+	require.Empty(t, lba.Status.RetiringIPs)
+	require.Nil(t, lba.Status.RetireTime)
+}
+
+const outOfPoolClass, outOfPoolFinalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+
+// outOfPoolFixture returns a service whose ports were synced to 10.0.0.7
+func outOfPoolFixture(t *testing.T) (client.Client, *corev1.Service) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Finalizers: []string{outOfPoolFinalizer}},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: integration.ToPointer(outOfPoolClass),
+			Ports:             []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	lba := &v1alpha1.LoadBalancerAllocation{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       v1alpha1.LoadBalancerAllocationSpec{ServiceName: "web"},
+		Status: v1alpha1.LoadBalancerAllocationStatus{
+			IPs:      []string{"10.0.0.7"},
+			Target:   "default",
+			SpecHash: computePortsHash(extractServicePorts(svc)),
+		},
+	}
+	k8s := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(svc, lba).
+		WithStatusSubresource(&corev1.Service{}, &v1alpha1.LoadBalancerAllocation{}).
+		Build()
+	return k8s, svc
+}
+
+// migratingService hands out 10.0.1.1 in place of an IP that left its pool
+type migratingService struct {
+	exposingService
+	outside string
+}
+
+func (s *migratingService) AllocateIP(_ context.Context, _ string, _ string, _ string, _ []ServicePort) (Allocation, error) {
+	s.calls = append(s.calls, "allocate")
+	return Allocation{IP: "10.0.1.1", Pool: "10.0.1.0/24"}, nil
+}
+
+func (s *migratingService) IsInPool(ip string) bool {
+	return ip != s.outside
+}
+
+func Test_should_apply_service_status_with_the_controller_field_manager(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Finalizers: []string{finalizer}},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: integration.ToPointer(class),
+			Ports:             []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	var applied []client.SubResourcePatchOptions
+	k8s := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(svc).
+		WithStatusSubresource(&corev1.Service{}, &v1alpha1.LoadBalancerAllocation{}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			SubResourcePatch: func(ctx context.Context, c client.Client, subResource string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+				if _, ok := obj.(*corev1.Service); ok && subResource == "status" {
+					require.Equal(t, types.ApplyPatchType, patch.Type())
+					options := client.SubResourcePatchOptions{}
+					options.ApplyOptions(opts)
+					applied = append(applied, options)
+				}
+				return c.SubResource(subResource).Patch(ctx, obj, patch, opts...)
+			},
+		}).
+		Build()
+	pfsense := &exposingService{}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", class, finalizer, "", OutOfPoolPolicyFlag, 0, nil, false)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+
+	_, err := r.Reconcile(t.Context(), req)
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+	require.Equal(t, fieldManager, applied[0].FieldManager)
+	require.True(t, integration.FromPtr(applied[0].Force))
+
+	var got corev1.Service
+	require.NoError(t, k8s.Get(t.Context(), req.NamespacedName, &got))
+	require.Equal(t, "10.0.0.1", got.Status.LoadBalancer.Ingress[0].IP)
+	require.True(t, meta.IsStatusConditionTrue(got.Status.Conditions, conditionTypeIPInPool))
+}
+
+func Test_should_requeue_when_the_finalizer_patch_conflicts(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+	// a new service, which gets the finalizer first
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerClass: integration.ToPointer(class)},
+	}
+	// the service changes right after the reconciler read it, so its resource version is stale
+	stale := false
+	k8s := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(svc).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				if err := c.Get(ctx, key, obj, opts...); err != nil {
+					return err
+				}
+				if _, ok := obj.(*corev1.Service); ok && !stale {
+					stale = true
+					changed := obj.DeepCopyObject().(*corev1.Service)
+					changed.Labels = map[string]string{"changed": "true"}
+					return c.Update(ctx, changed)
+				}
+				return nil
+			},
+		}).
+		Build()
+	pfsense := &exposingService{}
+	r := NewReconciler(k8s, []PfsenseTarget{{Name: "default", Service: pfsense}}, "default", class, finalizer, "", OutOfPoolPolicyFlag, 0, nil, false)
+
+	res, err := r.Reconcile(t.Context(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, res.RequeueAfter)
+	require.Empty(t, pfsense.calls)
+
+	var got corev1.Service
+	require.NoError(t, k8s.Get(t.Context(), client.ObjectKeyFromObject(svc), &got))
+	require.NotContains(t, got.Finalizers, finalizer)
+}
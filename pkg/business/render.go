@@ -0,0 +1,159 @@
+package business
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+const (
+	NATFragment       = "nat.xml"
+	FilterFragment    = "filter.xml"
+	VirtualIPFragment = "virtualip.xml"
+)
+
+// NewPfsenseRenderService allocates IPs the same way as the XML-RPC backend, but instead of restoring
+// the config sections it renders them as fragments for an external process to apply.
+func NewPfsenseRenderService(sink integration.RenderSink, dryRun bool, writeWindow time.Duration, subnet netip.Prefix, exclusions ...integration.Range[netip.Addr]) PfsenseService {
+	return withNATWriter(&pfsenseService{
+		pool:     newPool(subnet, exclusions),
+		sections: renderedNATSections{sink: sink},
+		dryRun:   dryRun,
+	}, writeWindow)
+}
+
+// renderedNATSections treats the rendered nat fragment as the nat section,
+// so allocations are based on the desired config rather than on what is applied already.
+type renderedNATSections struct {
+	sink integration.RenderSink
+}
+
+type filter struct {
+	XMLName xml.Name     `xml:"filter"`
+	Rule    []filterRule `xml:"rule"`
+}
+
+type filterRule struct {
+	Type             string      `xml:"type"`
+	Interface        string      `xml:"interface"`
+	Ipprotocol       string      `xml:"ipprotocol"`
+	Protocol         string      `xml:"protocol"`
+	Source           source      `xml:"source"`
+	Destination      destination `xml:"destination"`
+	Descr            string      `xml:"descr"`
+	AssociatedRuleID string      `xml:"associated-rule-id"`
+	Tracker          string      `xml:"tracker"`
+}
+
+type virtualIPs struct {
+	XMLName xml.Name    `xml:"virtualip"`
+	VIP     []virtualIP `xml:"vip"`
+}
+
+type virtualIP struct {
+	Mode       string `xml:"mode"`
+	Interface  string `xml:"interface"`
+	Type       string `xml:"type"`
+	Subnet     string `xml:"subnet"`
+	SubnetBits string `xml:"subnet_bits"`
+	Descr      string `xml:"descr"`
+}
+
+func (r renderedNATSections) fetchNATSection(ctx context.Context) (nat, error) {
+	data, err := r.sink.Read(ctx, NATFragment)
+	if err != nil {
+		return nat{}, fmt.Errorf("failed to read %s; %w", NATFragment, err)
+	}
+	var section nat
+	if len(data) == 0 {
+		return section, nil
+	}
+	if err := xml.Unmarshal(data, &section); err != nil {
+		return nat{}, fmt.Errorf("failed to decode %s; %w", NATFragment, err)
+	}
+	return section, nil
+}
+
+func (r renderedNATSections) saveNATSection(ctx context.Context, section nat) error {
+	// port forwards need a pass rule in the filter section, which pfsense links by the associated rule id
+	rules := slices.Clone(integration.FromPtr(section.Rule))
+	for i := range rules {
+		if rules[i].AssociatedRuleId == nil && rules[i].Tracker != nil {
+			rules[i].AssociatedRuleId = integration.ToPointer("nat_" + *rules[i].Tracker)
+		}
+	}
+	section.Rule = &rules
+
+	// the nat type name doubles as the root element of the fragment
+	fragments := map[string]any{
+		NATFragment:       section,
+		FilterFragment:    filter{Rule: integration.MapSlice(integration.FilterSlice(rules, hasAssociatedRule), toFilterRule)},
+		VirtualIPFragment: virtualIPs{VIP: toVirtualIPs(rules)},
+	}
+	rendered := make(map[string][]byte, len(fragments))
+	for name, fragment := range fragments {
+		data, err := xml.MarshalIndent(fragment, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to render %s; %w", name, err)
+		}
+		rendered[name] = append([]byte(xml.Header), append(data, '\n')...)
+	}
+
+	if err := r.sink.Write(ctx, rendered); err != nil {
+		return fmt.Errorf("failed to write rendered fragments; %w", err)
+	}
+	return nil
+}
+
+func hasAssociatedRule(r rule) bool {
+	return r.AssociatedRuleId != nil
+}
+
+func toFilterRule(r rule) filterRule {
+	return filterRule{
+		Type:       "pass",
+		Interface:  integration.FromPtr(r.Interface),
+		Ipprotocol: integration.FromPtr(r.Ipprotocol),
+		Protocol:   integration.FromPtr(r.Protocol),
+		Source:     source{Any: integration.ToPointer("")},
+		// forwarded traffic is filtered after the translation, so the rule matches the target
+		Destination: destination{
+			Address: r.Target,
+			Port:    r.LocalPort,
+		},
+		Descr:            "NAT " + integration.FromPtr(r.Descr),
+		AssociatedRuleID: integration.FromPtr(r.AssociatedRuleId),
+		Tracker:          integration.FromPtr(r.Tracker),
+	}
+}
+
+// toVirtualIPs returns an ip alias for every address the rules forward,
+// so pfsense answers arp requests for the allocated IPs.
+func toVirtualIPs(rules []rule) []virtualIP {
+	var vips []virtualIP
+	seen := map[string]bool{}
+	for _, r := range rules {
+		ip := ruleAddress(r)
+		if ip == "" || seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		// rule descriptions are "namespace/name port"
+		descr, _, _ := strings.Cut(integration.FromPtr(r.Descr), " ")
+		vips = append(vips, virtualIP{
+			Mode:       "ipalias",
+			Interface:  integration.FromPtr(r.Interface),
+			Type:       "single",
+			Subnet:     ip,
+			SubnetBits: "32",
+			Descr:      descr,
+		})
+	}
+	return vips
+}
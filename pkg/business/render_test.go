@@ -0,0 +1,56 @@
+package business
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/slamdev/pfsense-k8s-lb-controller/testdata"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_render_config_fragments_instead_of_pushing_them(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	dir := t.TempDir()
+	subnet, err := netip.ParsePrefix("150.150.150.0/24")
+	require.NoError(t, err)
+
+	svc := NewPfsenseRenderService(integration.NewFileSink(dir), false, 0, subnet)
+	namespace, name := testdata.RndName(), testdata.RndName()
+
+	allocation, err := svc.AllocateIP(t.Context(), namespace, name, "10.1.2.3", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8080, TargetPort: 80},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.1", allocation.IP)
+
+	// the rendered nat fragment is the state the next allocation is based on
+	second, err := svc.AllocateIP(t.Context(), testdata.RndName(), testdata.RndName(), "10.1.2.4", []ServicePort{
+		{Name: "http", Protocol: "TCP", NodePort: 8081, TargetPort: 80},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "150.150.150.2", second.IP)
+
+	require.NoError(t, svc.ReleaseIP(t.Context(), allocation.IP))
+
+	natXML, err := os.ReadFile(filepath.Join(dir, NATFragment))
+	require.NoError(t, err)
+	require.Contains(t, string(natXML), "<address>150.150.150.2</address>")
+	require.NotContains(t, string(natXML), "150.150.150.1")
+	require.Contains(t, string(natXML), "<associated-rule-id>nat_"+second.RuleTrackerIDs[0]+"</associated-rule-id>")
+
+	filterXML, err := os.ReadFile(filepath.Join(dir, FilterFragment))
+	require.NoError(t, err)
+	require.Contains(t, string(filterXML), "<type>pass</type>")
+	require.Contains(t, string(filterXML), "<address>10.1.2.4</address>")
+	require.Contains(t, string(filterXML), "<port>8081</port>")
+
+	vipXML, err := os.ReadFile(filepath.Join(dir, VirtualIPFragment))
+	require.NoError(t, err)
+	require.Contains(t, string(vipXML), "<subnet>150.150.150.2</subnet>")
+	require.NotContains(t, string(vipXML), "150.150.150.1")
+}
@@ -0,0 +1,131 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// Snapshot is a config section as it was before the controller wrote it.
+type Snapshot struct {
+	ID      int       `json:"id"`
+	Target  string    `json:"target"`
+	Section string    `json:"section"`
+	Taken   time.Time `json:"taken"`
+	Content any       `json:"content"`
+	// RolledBack is set once the write failed and the section was restored to the content
+	RolledBack bool   `json:"rolledBack,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SnapshotHistory keeps the last snapshots of every target, oldest first, and serves them as json.
+type SnapshotHistory struct {
+	size int
+
+	mu        sync.Mutex
+	lastID    int
+	snapshots []Snapshot
+}
+
+func NewSnapshotHistory(size int) *SnapshotHistory {
+	return &SnapshotHistory{size: max(1, size)}
+}
+
+// List returns a copy of the snapshots, oldest first.
+func (h *SnapshotHistory) List() []Snapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.snapshots)
+}
+
+func (h *SnapshotHistory) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.List()); err != nil {
+		slog.Warn("failed to encode snapshots", "error", err)
+	}
+}
+
+func (h *SnapshotHistory) take(target string, section string, content any) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	h.snapshots = append(h.snapshots, Snapshot{ID: h.lastID, Target: target, Section: section, Taken: time.Now(), Content: content})
+	if len(h.snapshots) > h.size {
+		h.snapshots = slices.Delete(h.snapshots, 0, len(h.snapshots)-h.size)
+	}
+	return h.lastID
+}
+
+func (h *SnapshotHistory) rolledBack(id int, cause error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := slices.IndexFunc(h.snapshots, func(s Snapshot) bool { return s.ID == id }); i >= 0 {
+		h.snapshots[i].RolledBack, h.snapshots[i].Error = true, cause.Error()
+	}
+}
+
+// ErrRollbackUnsupported is returned by WithRollback for php mutations and the backends with their own api,
+// which change single objects instead of replacing config sections.
+var ErrRollbackUnsupported = errors.New("rollback is only supported by services that replace config sections")
+
+// WithRollback snapshots every config section the service writes and restores it when the write fails or pfsense
+// stops answering right after it, which gives the writes commit-confirmed semantics.
+func WithRollback(svc PfsenseService, target string, history *SnapshotHistory) (PfsenseService, error) {
+	s, ok := svc.(*pfsenseService)
+	if !ok || s.php != nil {
+		return nil, ErrRollbackUnsupported
+	}
+	s.snapshots, s.target = history, target
+	return s, nil
+}
+
+// writeSection writes the section with save and, if the service keeps snapshots, rolls it back with restore
+// when the write or the health check after it fails. redact drops what must not show in the history, e.g. passwords.
+func writeSection[T any](ctx context.Context, s *pfsenseService, name string, fetch func(ctx context.Context) (T, error), restore func(ctx context.Context, section T) error, redact func(section T) any, save func(ctx context.Context) error) error {
+	if s.snapshots == nil {
+		return save(ctx)
+	}
+	before, err := fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %s section; %w", name, err)
+	}
+	id := s.snapshots.take(s.target, name, redact(before))
+
+	// the check goes to the firewall that took the write, which is not the one called first after a failover
+	written := integration.WithWrittenBy(ctx)
+	err = save(written)
+	if err == nil {
+		if err = s.checkApplied(written); err != nil {
+			err = fmt.Errorf("pfsense failed the health check after the %s section was written; %w", name, err)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	slog.WarnContext(ctx, "rolling back config section", "section", name, "snapshot", id, "error", err)
+	if rerr := restore(ctx, before); rerr != nil {
+		return errors.Join(err, fmt.Errorf("failed to roll back %s section to snapshot %d; %w", name, id, rerr))
+	}
+	s.snapshots.rolledBack(id, err)
+	return fmt.Errorf("rolled back %s section to snapshot %d; %w", name, id, err)
+}
+
+// checkApplied makes sure pfsense still answers after a write, if the backend can tell.
+func (s *pfsenseService) checkApplied(ctx context.Context) error {
+	checker, ok := s.sections.(interface {
+		healthCheck(ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return checker.healthCheck(ctx)
+}
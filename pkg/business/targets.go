@@ -0,0 +1,76 @@
+package business
+
+import (
+	"fmt"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TargetAnnotation selects the pfsense target of a service by its name.
+const TargetAnnotation = annotationPrefix + "target"
+
+// PfsenseTarget is a firewall managed by the controller.
+type PfsenseTarget struct {
+	Name    string
+	Service PfsenseService
+}
+
+// pfsenseTargets routes the calls for a service or an IP to the firewall that owns it.
+type pfsenseTargets struct {
+	targets       []PfsenseTarget
+	defaultTarget string
+}
+
+func (t pfsenseTargets) byName(name string) (PfsenseTarget, bool) {
+	for _, target := range t.targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return PfsenseTarget{}, false
+}
+
+// byIP returns the target whose pool contains the IP; pools of different targets do not overlap.
+func (t pfsenseTargets) byIP(ip string) (PfsenseTarget, bool) {
+	for _, target := range t.targets {
+		if target.Service.IsInPool(ip) {
+			return target, true
+		}
+	}
+	return PfsenseTarget{}, false
+}
+
+// forService selects the target by the annotation, then by the one recorded in the allocation,
+// then by the pool of the assigned IP, and falls back to the default target.
+func (t pfsenseTargets) forService(svc *corev1.Service, lba *v1alpha1.LoadBalancerAllocation) (PfsenseTarget, error) {
+	if name, ok := svc.Annotations[TargetAnnotation]; ok {
+		target, found := t.byName(name)
+		if !found {
+			return PfsenseTarget{}, fmt.Errorf("pfsense target %s selected by the %s annotation is not configured", name, TargetAnnotation)
+		}
+		return target, nil
+	}
+	if lba != nil && lba.Status.Target != "" {
+		if target, found := t.byName(lba.Status.Target); found {
+			return target, nil
+		}
+	}
+	if ip := assignedIP(svc, lba); ip != "" {
+		if target, found := t.byIP(ip); found {
+			return target, nil
+		}
+	}
+	if target, found := t.byName(t.defaultTarget); found {
+		return target, nil
+	}
+	return PfsenseTarget{}, fmt.Errorf("service does not select a pfsense target; set the %s annotation", TargetAnnotation)
+}
+
+// forIP returns the target that owns the IP, falling back to the given one for IPs outside of every pool.
+func (t pfsenseTargets) forIP(ip string, fallback PfsenseTarget) PfsenseTarget {
+	if target, found := t.byIP(ip); found {
+		return target
+	}
+	return fallback
+}
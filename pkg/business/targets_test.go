@@ -0,0 +1,64 @@
+package business
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/slamdev/pfsense-k8s-lb-controller/testdata"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_should_route_services_to_their_pfsense_target(t *testing.T) {
+	t.Parallel()
+	testdata.SetTestLogger(t)
+
+	newTarget := func(name string, subnet string) PfsenseTarget {
+		prefix, err := netip.ParsePrefix(subnet)
+		require.NoError(t, err)
+		return PfsenseTarget{Name: name, Service: NewPfsenseRenderService(integration.NewFileSink(t.TempDir()), false, 0, prefix)}
+	}
+	siteA, siteB := newTarget("site-a", "150.150.150.0/24"), newTarget("site-b", "160.160.160.0/24")
+	targets := pfsenseTargets{targets: []PfsenseTarget{siteA, siteB}, defaultTarget: "site-a"}
+
+	service := func(annotations map[string]string, ip string) *corev1.Service {
+		svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: testdata.RndName(), Annotations: annotations}}
+		if ip != "" {
+			svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: ip}}
+		}
+		return svc
+	}
+
+	target, err := targets.forService(service(map[string]string{TargetAnnotation: "site-b"}, ""), nil)
+	require.NoError(t, err)
+	require.Equal(t, "site-b", target.Name)
+
+	// the ip is matched with the pool it comes from
+	target, err = targets.forService(service(nil, "160.160.160.20"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "site-b", target.Name)
+
+	// the recorded target wins over the pool, so an IP that left every pool stays with its firewall
+	lba := &v1alpha1.LoadBalancerAllocation{Status: v1alpha1.LoadBalancerAllocationStatus{Target: "site-b", IPs: []string{"170.0.0.1"}}}
+	target, err = targets.forService(service(nil, ""), lba)
+	require.NoError(t, err)
+	require.Equal(t, "site-b", target.Name)
+
+	target, err = targets.forService(service(nil, ""), nil)
+	require.NoError(t, err)
+	require.Equal(t, "site-a", target.Name)
+
+	_, err = targets.forService(service(map[string]string{TargetAnnotation: "site-c"}, ""), nil)
+	require.ErrorContains(t, err, "site-c")
+
+	// without a default target the selection is required
+	_, err = pfsenseTargets{targets: targets.targets}.forService(service(nil, ""), nil)
+	require.ErrorContains(t, err, TargetAnnotation)
+
+	// retiring IPs are released on the firewall whose pool they are in
+	require.Equal(t, "site-b", targets.forIP("160.160.160.30", siteA).Name)
+	require.Equal(t, "site-a", targets.forIP("170.0.0.1", siteA).Name)
+}
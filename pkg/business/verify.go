@@ -0,0 +1,207 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// VerificationError is returned when pfsense accepted a write but the section read back differs from it,
+// e.g. because pfsense dropped entries it considered invalid.
+type VerificationError struct {
+	Section string
+	// Diff has one line per owned object that is missing, changed or left behind
+	Diff []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%s section read back from pfsense differs from what was written: %s", e.Section, strings.Join(e.Diff, "; "))
+}
+
+// verifyNATSection reads the nat section back and compares the rules of the controller with the written ones.
+func (s *pfsenseService) verifyNATSection(ctx context.Context, written nat) error {
+	actual, err := s.sections.fetchNATSection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back nat section; %w", err)
+	}
+	owned := func(r rule) bool { return isOwnedAt(ruleAddress(r))(r) }
+	return verifyOwned(natConfigSection, integration.FromPtr(written.Rule), integration.FromPtr(actual.Rule), owned, ruleKey)
+}
+
+// verifyVirtualIPSection reads the virtualip section back and compares the carp virtual IPs of the controller
+// with the written ones.
+func (s *pfsenseService) verifyVirtualIPSection(ctx context.Context, written vipSection) error {
+	owned := func(v vip) bool {
+		return s.carp != nil && isOwnedVIPAt(s.carp.Interface, integration.FromPtr(v.Subnet))(v)
+	}
+	return s.verifyVirtualIPs(ctx, integration.FromPtr(written.VIP), owned)
+}
+
+// verifyVirtualIPs compares the owned virtual IPs of the virtualip section read back with the written ones.
+func (s *pfsenseService) verifyVirtualIPs(ctx context.Context, written []vip, owned func(vip) bool) error {
+	actual, err := s.fetchVirtualIPSection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back virtualip section; %w", err)
+	}
+	return verifyOwned(virtualIPConfigSection,
+		integration.MapSlice(written, withoutPassword),
+		integration.MapSlice(integration.FromPtr(actual.VIP), withoutPassword),
+		owned, vipKey)
+}
+
+// verifyRulesWithPHP reads the rules of the address back after a php mutation, which pfsense may have dropped
+// or changed the same way as a restored section.
+func (s *pfsenseService) verifyRulesWithPHP(ctx context.Context, m *phpMutations, ip string, written []rule) error {
+	if m.dryRun {
+		return nil
+	}
+	actual, err := m.run(ctx, "rules", ip, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read back rules of %s; %w", ip, err)
+	}
+	return verifyOwned(natConfigSection, written, actual.Rules, isOwnedAt(ip), ruleKey)
+}
+
+// verifyAddress lists the port forwards, virtual IPs and aliases back and compares the ones of the controller
+// for the address with the expected ones, which are none after a release.
+func (s *pfsenseRESTService) verifyAddress(ctx context.Context, ip string, forwards []integration.RESTPortForward, vips []integration.RESTVirtualIP, aliases []integration.RESTAlias) error {
+	if s.dryRun {
+		return nil
+	}
+	actualForwards, err := s.client.ListPortForwards(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back port forwards; %w", err)
+	}
+	actualVIPs, err := s.client.ListVirtualIPs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back virtual ips; %w", err)
+	}
+	actualAliases, err := s.client.ListAliases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back aliases; %w", err)
+	}
+	return errors.Join(
+		verifyOwned(natConfigSection, forwards, actualForwards, hasDestination(ip), func(pf integration.RESTPortForward) string {
+			return fmt.Sprintf("port forward %s/%s (%s)", pf.DestinationPort, pf.Protocol, pf.Descr)
+		}),
+		verifyOwned(virtualIPConfigSection, vips, actualVIPs, isOwnedVirtualIPAt(ip), func(v integration.RESTVirtualIP) string {
+			return fmt.Sprintf("virtual IP %s (%s)", v.Subnet, v.Descr)
+		}),
+		verifyOwned(aliasConfigSection, aliases, actualAliases, isOwnedAliasAt(ip), func(a integration.RESTAlias) string {
+			return fmt.Sprintf("alias %s (%s)", a.Name, a.Descr)
+		}),
+	)
+}
+
+// verifyAddress searches the nat rules, virtual IPs and aliases back and compares the ones of the controller
+// for the address with the expected ones, which are none after a release.
+func (s *opnsenseService) verifyAddress(ctx context.Context, ip string, rules []integration.OPNsenseDNATRule, vips []integration.OPNsenseVirtualIP, aliases []integration.OPNsenseAlias) error {
+	if s.dryRun {
+		return nil
+	}
+	actualRules, err := s.client.SearchDNATRules(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back nat rules; %w", err)
+	}
+	actualVIPs, err := s.client.SearchVirtualIPs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back virtual ips; %w", err)
+	}
+	actualAliases, err := s.client.SearchAliases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back aliases; %w", err)
+	}
+	return errors.Join(
+		verifyOwned(natConfigSection, rules, actualRules, hasDNATDestination(ip), func(r integration.OPNsenseDNATRule) string {
+			return fmt.Sprintf("nat rule %s/%s (%s)", r.Destination.Port, r.Protocol, r.Descr)
+		}),
+		verifyOwned(virtualIPConfigSection, vips, actualVIPs, isOwnedOPNsenseVirtualIPAt(ip), func(v integration.OPNsenseVirtualIP) string {
+			return fmt.Sprintf("virtual IP %s (%s)", v.Subnet, v.Descr)
+		}),
+		verifyOwned(aliasConfigSection, aliases, actualAliases, isOwnedOPNsenseAliasAt(ip), func(a integration.OPNsenseAlias) string {
+			return fmt.Sprintf("alias %s (%s)", a.Name, a.Description)
+		}),
+	)
+}
+
+func ruleKey(r rule) string {
+	return fmt.Sprintf("rule %s (%s)", integration.FromPtr(r.Tracker), integration.FromPtr(r.Descr))
+}
+
+func vipKey(v vip) string {
+	return fmt.Sprintf("virtual IP %s (%s)", integration.FromPtr(v.Subnet), integration.FromPtr(v.Descr))
+}
+
+// withoutPassword leaves the carp password out, so it never ends up in the diff
+func withoutPassword(v vip) vip {
+	v.Password = nil
+	return v
+}
+
+// verifyOwned compares the owned objects by key. Every field written has to be read back with the same value,
+// while fields pfsense adds itself, like timestamps, are ignored.
+func verifyOwned[T any](section string, written []T, actual []T, owned func(T) bool, key func(T) string) error {
+	expected := ownedByKey(written, owned, key)
+	found := ownedByKey(actual, owned, key)
+
+	var diff []string
+	for _, k := range slices.Sorted(maps.Keys(expected)) {
+		a, ok := found[k]
+		if !ok {
+			diff = append(diff, k+" is missing")
+			continue
+		}
+		diff = append(diff, fieldDiff(k, expected[k], a)...)
+	}
+	for _, k := range slices.Sorted(maps.Keys(found)) {
+		if _, ok := expected[k]; !ok {
+			diff = append(diff, k+" was not written")
+		}
+	}
+	if len(diff) > 0 {
+		return &VerificationError{Section: section, Diff: diff}
+	}
+	return nil
+}
+
+func ownedByKey[T any](objects []T, owned func(T) bool, key func(T) string) map[string]map[string]any {
+	byKey := map[string]map[string]any{}
+	for _, o := range objects {
+		if owned(o) {
+			byKey[key(o)] = fields(o)
+		}
+	}
+	return byKey
+}
+
+// fields flattens the object into its json fields, so they can be compared one by one
+func fields(o any) map[string]any {
+	var m map[string]any
+	b, err := json.Marshal(o)
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return map[string]any{}
+	}
+	return m
+}
+
+func fieldDiff(key string, expected map[string]any, actual map[string]any) []string {
+	var diff []string
+	for _, field := range slices.Sorted(maps.Keys(expected)) {
+		if a, ok := actual[field]; !ok {
+			diff = append(diff, fmt.Sprintf("%s has no %s, expected %s", key, field, integration.ToUnsafeJSONString(expected[field])))
+		} else if !reflect.DeepEqual(a, expected[field]) {
+			diff = append(diff, fmt.Sprintf("%s has %s %s, expected %s", key, field, integration.ToUnsafeJSONString(a), integration.ToUnsafeJSONString(expected[field])))
+		}
+	}
+	return diff
+}
@@ -0,0 +1,132 @@
+package business
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrlsource "sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// configRevisioner is implemented by the services that can tell when the pfsense config changed
+type configRevisioner interface {
+	ConfigRevision(ctx context.Context) (string, error)
+	// keepsConfigRevision is false for a backend that never has a revision, e.g. rendered fragments
+	keepsConfigRevision() bool
+}
+
+func watchedRevisioner(svc PfsenseService) (configRevisioner, bool) {
+	revisioner, ok := svc.(configRevisioner)
+	return revisioner, ok && revisioner.keepsConfigRevision()
+}
+
+// ConfigWatcher polls the config revision of the pfsense targets and enqueues every managed service once one changes,
+// so a restored backup or a rule edited in the GUI is repaired within an interval instead of on the next service change.
+// The writes of the controller change the revision too, which costs one reconcile of every service.
+type ConfigWatcher struct {
+	k8s               client.Reader
+	targets           []PfsenseTarget
+	loadBalancerClass string
+	finalizerName     string
+	interval          time.Duration
+	events            chan event.GenericEvent
+}
+
+func NewConfigWatcher(k8s client.Reader, targets []PfsenseTarget, loadBalancerClass string, finalizerName string, interval time.Duration) *ConfigWatcher {
+	return &ConfigWatcher{
+		k8s:               k8s,
+		targets:           targets,
+		loadBalancerClass: loadBalancerClass,
+		finalizerName:     finalizerName,
+		interval:          interval,
+		events:            make(chan event.GenericEvent),
+	}
+}
+
+// Source feeds the services enqueued by the watcher to the controller.
+func (w *ConfigWatcher) Source() ctrlsource.Source {
+	return ctrlsource.Channel(w.events, &handler.EnqueueRequestForObject{})
+}
+
+// Start polls until the context is done. It runs on the leader only, as that is the replica that reconciles.
+func (w *ConfigWatcher) Start(ctx context.Context) error {
+	for _, target := range w.unwatched() {
+		slog.InfoContext(ctx, "pfsense target keeps no config revision, changes made on it are not repaired until its services change", "target", target)
+	}
+	revisions := map[string]string{}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		changed := w.poll(ctx, revisions)
+		if len(changed) == 0 {
+			continue
+		}
+		slog.InfoContext(ctx, "pfsense config changed, reconciling all services", "targets", changed)
+		if err := w.enqueue(ctx); err != nil {
+			slog.WarnContext(ctx, "failed to enqueue services", "error", err)
+		}
+	}
+}
+
+// poll records the revision of every target and returns the targets whose revision changed since the last poll.
+func (w *ConfigWatcher) poll(ctx context.Context, revisions map[string]string) []string {
+	var changed []string
+	for _, target := range w.targets {
+		revisioner, ok := watchedRevisioner(target.Service)
+		if !ok {
+			continue
+		}
+		revision, err := revisioner.ConfigRevision(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to read pfsense config revision", "target", target.Name, "error", err)
+			continue
+		}
+		last, seen := revisions[target.Name]
+		revisions[target.Name] = revision
+		// the first revision is only remembered, as every service is reconciled on start anyway
+		if seen && revision != "" && revision != last {
+			changed = append(changed, target.Name)
+		}
+	}
+	return changed
+}
+
+// unwatched returns the targets whose config changes the watcher cannot notice.
+func (w *ConfigWatcher) unwatched() []string {
+	var names []string
+	for _, target := range w.targets {
+		if _, ok := watchedRevisioner(target.Service); !ok {
+			names = append(names, target.Name)
+		}
+	}
+	return names
+}
+
+func (w *ConfigWatcher) enqueue(ctx context.Context) error {
+	services := &corev1.ServiceList{}
+	if err := w.k8s.List(ctx, services); err != nil {
+		return fmt.Errorf("failed to list services; %w", err)
+	}
+	for i := range services.Items {
+		svc := &services.Items[i]
+		if !isManagedService(svc, w.loadBalancerClass, w.finalizerName) {
+			continue
+		}
+		select {
+		case w.events <- event.GenericEvent{Object: svc}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
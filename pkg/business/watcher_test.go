@@ -0,0 +1,68 @@
+package business
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func Test_should_enqueue_managed_services_when_pfsense_config_changes(t *testing.T) {
+	t.Parallel()
+
+	const class, finalizer = "slamdev.net/pfsense-k8s-lb-controller", "slamdev.net/pfsense-k8s-lb-controller-ip-cleanup"
+	services := &corev1.ServiceList{Items: []corev1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Name: "managed"}, Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerClass: integration.ToPointer(class)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP}},
+	}}
+	siteA := &revisionService{revision: "1700000000 initial"}
+	rendered := NewPfsenseRenderService(nil, false, 0, netip.MustParsePrefix("10.0.0.0/24"))
+	targets := []PfsenseTarget{{Name: "site-a", Service: siteA}, {Name: "rendered", Service: rendered}, {Name: "rest", Service: &exposingService{}}}
+	watcher := NewConfigWatcher(serviceLister{services}, targets, class, finalizer, 0)
+
+	// the targets that keep no revision are reported once on start, instead of being skipped on every poll
+	require.Equal(t, []string{"rendered", "rest"}, watcher.unwatched())
+
+	revisions := map[string]string{}
+	require.Empty(t, watcher.poll(t.Context(), revisions))
+	require.Empty(t, watcher.poll(t.Context(), revisions))
+
+	// e.g. a backup restored in the GUI
+	siteA.revision = "1700000100 restored backup"
+	require.Equal(t, []string{"site-a"}, watcher.poll(t.Context(), revisions))
+
+	go func() { require.NoError(t, watcher.enqueue(t.Context())) }()
+	e := <-watcher.events
+	require.Equal(t, "managed", e.Object.GetName())
+}
+
+type revisionService struct {
+	PfsenseService
+	revision string
+}
+
+func (s *revisionService) ConfigRevision(_ context.Context) (string, error) {
+	return s.revision, nil
+}
+
+func (s *revisionService) keepsConfigRevision() bool {
+	return true
+}
+
+type serviceLister struct {
+	services *corev1.ServiceList
+}
+
+func (l serviceLister) Get(_ context.Context, _ client.ObjectKey, _ client.Object, _ ...client.GetOption) error {
+	return nil
+}
+
+func (l serviceLister) List(_ context.Context, list client.ObjectList, _ ...client.ListOption) error {
+	l.services.DeepCopyInto(list.(*corev1.ServiceList))
+	return nil
+}
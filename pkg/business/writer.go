@@ -0,0 +1,167 @@
+package business
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+)
+
+// natWriter is the single writer of a pfsense service. The changes queued within the window are applied in order
+// to one fetched nat section, which is saved once, so pfsense reloads its filter once for all of them.
+// Every change gets its own result: a change that fails is left out of the section without failing the others,
+// while a failed fetch or save fails all of them. Writes that do not change the section, like php mutations,
+// run one after another on the same goroutine.
+type natWriter struct {
+	window time.Duration
+	fetch  func(ctx context.Context) (nat, error)
+	save   func(ctx context.Context, section nat) error
+
+	mu      sync.Mutex
+	pending []natWrite
+	// running is set while the writer goroutine is alive; it exits once nothing is queued
+	running bool
+	// lifetime is cancelled when the manager stops, which cancels the batch being written, see Start
+	lifetime context.Context
+}
+
+type natWrite struct {
+	ctx context.Context
+	// change edits the section and reports whether it changed anything
+	change func(ctx context.Context, section *nat) (bool, error)
+	// exec is set instead of change for a write that does not go through the section
+	exec   func(ctx context.Context) error
+	result chan error
+}
+
+func newNATWriter(window time.Duration, fetch func(ctx context.Context) (nat, error), save func(ctx context.Context, section nat) error) *natWriter {
+	return &natWriter{window: window, fetch: fetch, save: save, lifetime: context.Background()}
+}
+
+// Start bounds the batches by the lifetime of the manager until ctx is done, so a batch that is written while
+// the controller shuts down is cancelled instead of holding the shutdown up.
+func (w *natWriter) Start(ctx context.Context) error {
+	w.mu.Lock()
+	w.lifetime = ctx
+	w.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// change queues an edit of the nat section and waits for the section to be saved.
+func (w *natWriter) change(ctx context.Context, change func(ctx context.Context, section *nat) (bool, error)) error {
+	return w.enqueue(natWrite{ctx: ctx, change: change, result: make(chan error, 1)})
+}
+
+// exec queues a write that does not go through the nat section and waits for it to run.
+func (w *natWriter) exec(ctx context.Context, exec func(ctx context.Context) error) error {
+	return w.enqueue(natWrite{ctx: ctx, exec: exec, result: make(chan error, 1)})
+}
+
+func (w *natWriter) enqueue(write natWrite) error {
+	w.mu.Lock()
+	w.pending = append(w.pending, write)
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	w.mu.Unlock()
+	// the result channel is buffered, so the writer does not block on a caller that stopped waiting;
+	// a write that has started may still succeed, which the next reconcile finds
+	select {
+	case err := <-write.result:
+		return err
+	case <-write.ctx.Done():
+		return write.ctx.Err()
+	}
+}
+
+func (w *natWriter) run() {
+	for {
+		w.mu.Lock()
+		lifetime := w.lifetime
+		w.mu.Unlock()
+		if w.window > 0 {
+			// the window is cut short on shutdown
+			timer := time.NewTimer(w.window)
+			select {
+			case <-timer.C:
+			case <-lifetime.Done():
+				timer.Stop()
+			}
+		}
+		w.mu.Lock()
+		batch := w.pending
+		w.pending = nil
+		if len(batch) == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+		w.write(lifetime, batch)
+	}
+}
+
+func (w *natWriter) write(lifetime context.Context, batch []natWrite) {
+	var changes []natWrite
+	for _, write := range batch {
+		switch {
+		case write.ctx.Err() != nil:
+			// nobody is waiting for the outcome, and the next reconcile decides again what to write
+			write.result <- write.ctx.Err()
+		case write.exec != nil:
+			write.result <- write.exec(write.ctx)
+		default:
+			changes = append(changes, write)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	// the section outlives any single change, so it is written with the values of the first one without its deadline,
+	// until the writer stops
+	ctx, cancel := context.WithCancel(context.WithoutCancel(changes[0].ctx))
+	defer cancel()
+	defer context.AfterFunc(lifetime, cancel)()
+	section, err := w.fetch(ctx)
+	if err != nil {
+		for _, change := range changes {
+			change.result <- fmt.Errorf("failed to fetch nat section; %w", err)
+		}
+		return
+	}
+
+	var applied []natWrite
+	changed := false
+	for _, change := range changes {
+		before := section.Rule
+		snapshot := slices.Clone(integration.FromPtr(before))
+		ok, err := change.change(change.ctx, &section)
+		if err != nil {
+			section.Rule = before
+			if before != nil {
+				section.Rule = &snapshot
+			}
+			change.result <- err
+			continue
+		}
+		applied = append(applied, change)
+		changed = changed || ok
+	}
+
+	if changed {
+		slog.DebugContext(ctx, "saving nat section", "changes", len(applied))
+		if err = w.save(ctx, section); err != nil {
+			err = fmt.Errorf("failed to save nat section; %w", err)
+		}
+	}
+	for _, change := range applied {
+		change.result <- err
+	}
+}
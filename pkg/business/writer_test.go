@@ -0,0 +1,47 @@
+package business
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_stop_waiting_for_the_writer_and_cancel_the_batch_on_shutdown(t *testing.T) {
+	t.Parallel()
+
+	fetching := make(chan struct{})
+	writer := newNATWriter(time.Millisecond, func(ctx context.Context) (nat, error) {
+		close(fetching)
+		<-ctx.Done()
+		return nat{}, ctx.Err()
+	}, func(context.Context, nat) error {
+		return nil
+	})
+	lifetime, stop := context.WithCancel(context.Background())
+	go func() { _ = writer.Start(lifetime) }()
+	require.Eventually(t, func() bool {
+		writer.mu.Lock()
+		defer writer.mu.Unlock()
+		return writer.lifetime == lifetime
+	}, time.Second, time.Millisecond)
+
+	// the caller gives up while the batch hangs in the fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- writer.change(ctx, func(context.Context, *nat) (bool, error) { return true, nil })
+	}()
+	<-fetching
+	cancel()
+	require.ErrorIs(t, <-result, context.Canceled)
+
+	// the batch runs without the deadline of the caller, but not beyond the writer
+	stop()
+	require.Eventually(t, func() bool {
+		writer.mu.Lock()
+		defer writer.mu.Unlock()
+		return !writer.running
+	}, time.Second, time.Millisecond)
+}
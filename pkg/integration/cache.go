@@ -0,0 +1,130 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const backupConfigSectionMethod = "pfsense.backup_config_section"
+
+var pfsenseCacheRequests, _ = otel.Meter("github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration").Int64Counter(
+	"pfsense.cache.requests",
+	metric.WithDescription("Reads of pfsense served from memory (hit) or from pfsense (miss) by target and kind"),
+)
+
+// sectionCache keeps the config sections read from pfsense with the config revision they were read at.
+// A section is served from memory while pfsense reports the same revision, which is a much smaller read.
+// Writes of the controller drop everything, as the revision time has only second precision.
+type sectionCache struct {
+	target string
+	// healthMaxAge is how long a successful call spares the health check a call of its own
+	healthMaxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// generation changes with every write, so a read that overlapped a write is not stored
+	generation  int
+	lastSuccess time.Time
+}
+
+type cacheEntry struct {
+	revision string
+	reply    []byte
+}
+
+// NewPfsenseCachedClient serves config section reads of the client from memory while the config revision is unchanged,
+// and lets a call that succeeded within healthMaxAge stand in for the health check.
+func NewPfsenseCachedClient(client *PfsenseClient, target string, healthMaxAge time.Duration) *PfsenseClient {
+	cached := *client
+	cached.cache = &sectionCache{target: target, healthMaxAge: healthMaxAge, entries: map[string]cacheEntry{}}
+	return &cached
+}
+
+func (c *PfsenseClient) cachedRead(ctx context.Context, method string, args any, reply any) error {
+	generation := c.cache.currentGeneration()
+	revision, err := c.ConfigRevision(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read config revision; %w", err)
+	}
+	key := fmt.Sprintf("%s %+v", method, args)
+	if revision != "" && c.cache.get(ctx, key, revision, reply) {
+		return nil
+	}
+	if err := c.call(ctx, callRead, method, args, reply); err != nil {
+		return err
+	}
+	if revision != "" {
+		c.cache.put(key, revision, generation, reply)
+	}
+	return nil
+}
+
+func (s *sectionCache) currentGeneration() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+func (s *sectionCache) get(ctx context.Context, key string, revision string, reply any) bool {
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	s.mu.Unlock()
+	// the reply is decoded again on every hit, so callers never share what they modify
+	hit := ok && entry.revision == revision && json.Unmarshal(entry.reply, reply) == nil
+	s.record(ctx, "section", hit)
+	return hit
+}
+
+func (s *sectionCache) put(key string, revision string, generation int, reply any) {
+	encoded, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation != s.generation {
+		return
+	}
+	s.entries[key] = cacheEntry{revision: revision, reply: encoded}
+}
+
+func (s *sectionCache) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	clear(s.entries)
+}
+
+func (s *sectionCache) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSuccess = time.Now()
+}
+
+// reachable reports whether pfsense answered recently enough for the health check to skip its own call.
+func (s *sectionCache) reachable(ctx context.Context) bool {
+	s.mu.Lock()
+	reachable := !s.lastSuccess.IsZero() && time.Since(s.lastSuccess) < s.healthMaxAge
+	s.mu.Unlock()
+	s.record(ctx, "health", reachable)
+	return reachable
+}
+
+func (s *sectionCache) record(ctx context.Context, kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	pfsenseCacheRequests.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("pfsense.target", s.target),
+		attribute.String("kind", kind),
+		attribute.String("result", result),
+	))
+}
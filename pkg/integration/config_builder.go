@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/knadh/koanf/parsers/dotenv"
 	kyaml "github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/env"
@@ -37,6 +38,25 @@ func BuildConfig(envPrefix string, fileName string, cfgFs fs.FS, out any) error
 	return nil
 }
 
+// DecodeConfig decodes a part of the config that is kept as a map into out the same way BuildConfig does.
+// Fields of out that raw does not set keep their values.
+func DecodeConfig(raw map[string]any, out any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.TextUnmarshallerHookFunc()),
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create config decoder; %w", err)
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return fmt.Errorf("failed to decode config; %w", err)
+	}
+	return nil
+}
+
 func LoadYamlConfigs(k *koanf.Koanf, envPrefix string, fileName string, cfgFs fs.FS) error {
 	var yamlProviders []koanf.Provider
 
@@ -0,0 +1,34 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// InstallCRDs applies every custom resource definition found in the root of crdFs
+// using server-side apply, so the controller can be deployed without a separate CRD step.
+func InstallCRDs(ctx context.Context, k8s client.Client, fieldOwner string, crdFs fs.FS) error {
+	files, err := fs.Glob(crdFs, "*.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to list crd files; %w", err)
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(crdFs, file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s; %w", file, err)
+		}
+		var crd apiextensionsv1.CustomResourceDefinition
+		if err := yaml.Unmarshal(data, &crd); err != nil {
+			return fmt.Errorf("failed to parse %s; %w", file, err)
+		}
+		if err := k8s.Patch(ctx, &crd, client.Apply, client.FieldOwner(fieldOwner), client.ForceOwnership); err != nil {
+			return fmt.Errorf("failed to apply crd %s; %w", crd.Name, err)
+		}
+	}
+	return nil
+}
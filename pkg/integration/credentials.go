@@ -0,0 +1,153 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialSource provides the credentials for every call, so they can be rotated while the controller runs.
+type CredentialSource interface {
+	// Credentials returns the current credentials; reload asks to read them again as the ones in use were rejected.
+	Credentials(ctx context.Context, reload bool) (Credentials, error)
+}
+
+// StaticCredentials never change, e.g. when they come from the application config.
+type StaticCredentials Credentials
+
+func (c StaticCredentials) Credentials(context.Context, bool) (Credentials, error) {
+	return Credentials(c), nil
+}
+
+type fileCredentials struct {
+	reloader *fileReloader[Credentials]
+}
+
+// NewFileCredentials reads the credentials from files, e.g. a mounted secret, and reads them again once they change.
+func NewFileCredentials(usernameFile string, passwordFile string) (CredentialSource, error) {
+	reloader := newFileReloader(func() (Credentials, error) {
+		username, err := os.ReadFile(usernameFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+		password, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+		// files written by hand usually end with a new line
+		return Credentials{Username: strings.TrimSpace(string(username)), Password: strings.TrimSpace(string(password))}, nil
+	}, usernameFile, passwordFile)
+	if _, err := reloader.get(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials; %w", err)
+	}
+	return &fileCredentials{reloader: reloader}, nil
+}
+
+func (c *fileCredentials) Credentials(_ context.Context, reload bool) (Credentials, error) {
+	if reload {
+		c.reloader.invalidate()
+	}
+	return c.reloader.get()
+}
+
+// secretCredentials reads the credentials from a kubernetes secret and keeps them for refreshInterval.
+// The secret is read directly instead of being watched, so the controller does not need to list secrets.
+type secretCredentials struct {
+	reader          client.Reader
+	key             client.ObjectKey
+	usernameKey     string
+	passwordKey     string
+	refreshInterval time.Duration
+
+	mu          sync.Mutex
+	credentials Credentials
+	readAt      time.Time
+}
+
+func NewSecretCredentials(reader client.Reader, namespace string, name string, usernameKey string, passwordKey string, refreshInterval time.Duration) CredentialSource {
+	return &secretCredentials{
+		reader:          reader,
+		key:             client.ObjectKey{Namespace: namespace, Name: name},
+		usernameKey:     usernameKey,
+		passwordKey:     passwordKey,
+		refreshInterval: refreshInterval,
+	}
+}
+
+func (c *secretCredentials) Credentials(ctx context.Context, reload bool) (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !reload && !c.readAt.IsZero() && time.Since(c.readAt) < c.refreshInterval {
+		return c.credentials, nil
+	}
+	var secret corev1.Secret
+	if err := c.reader.Get(ctx, c.key, &secret); err != nil {
+		if !c.readAt.IsZero() && !reload {
+			// keep calling pfsense with the last known credentials while the api server is unavailable
+			return c.credentials, nil
+		}
+		return Credentials{}, fmt.Errorf("failed to get secret %s; %w", c.key, err)
+	}
+	username, ok := secret.Data[c.usernameKey]
+	if !ok {
+		return Credentials{}, fmt.Errorf("secret %s has no %s key", c.key, c.usernameKey)
+	}
+	password, ok := secret.Data[c.passwordKey]
+	if !ok {
+		return Credentials{}, fmt.Errorf("secret %s has no %s key", c.key, c.passwordKey)
+	}
+	c.credentials = Credentials{Username: string(username), Password: string(password)}
+	c.readAt = time.Now()
+	return c.credentials, nil
+}
+
+// basicAuth sets the credentials on every request. A request rejected with 401 is sent once more
+// with credentials that are read again, so a password rotated on pfsense is picked up without a restart.
+func basicAuth(source CredentialSource) HTTPClientMiddleware {
+	return func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+		credentials, err := source.Credentials(req.Context(), false)
+		if err != nil {
+			return nil, credentialsError(err)
+		}
+		res, err := sendWithBasicAuth(req, next, credentials)
+		if err != nil || res.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+		reloaded, err := source.Credentials(req.Context(), true)
+		if err != nil || reloaded == credentials {
+			// nothing changed, so repeating the request would be rejected again
+			return res, nil
+		}
+		_ = res.Body.Close()
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to rewind request body; %w", err)
+			}
+		}
+		return sendWithBasicAuth(retry, next, reloaded)
+	}
+}
+
+func sendWithBasicAuth(req *http.Request, next http.RoundTripper, credentials Credentials) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(credentials.Username, credentials.Password)
+	return next.RoundTrip(req)
+}
+
+// credentialsError marks credentials that cannot be read as an auth failure, which retrying does not fix.
+func credentialsError(err error) error {
+	return &PfsenseError{Kind: ErrorKindAuth, Op: "read credentials", Err: err}
+}
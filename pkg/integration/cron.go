@@ -0,0 +1,164 @@
+package integration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a standard five field cron expression: minute, hour, day of month, month and day of week.
+// Every field is "*", a number, a range like "1-5", a step like "*/15" or "8-18/2", or a list of those.
+// As in cron, a day matches either day field when both are restricted.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func ParseCron(expr string) (CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return CronSchedule{}, fmt.Errorf("cron expression %q has %d fields instead of %d", expr, len(fields), len(cronFields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseCronField(field, cronFields[i].min, cronFields[i].max); err != nil {
+			return CronSchedule{}, fmt.Errorf("failed to parse %s of %q; %w", cronFields[i].name, expr, err)
+		}
+	}
+	// sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return CronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, lowest int, highest int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+		start, end := lowest, highest
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(startPart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", startPart)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endPart); err != nil {
+					return 0, fmt.Errorf("invalid value %q", endPart)
+				}
+			} else if hasStep {
+				end = highest
+			}
+		}
+		if start < lowest || end > highest || start > end {
+			return 0, fmt.Errorf("%q is outside of %d-%d", rangePart, lowest, highest)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Matches reports whether the minute of t is one of the schedule.
+func (s CronSchedule) Matches(t time.Time) bool {
+	return s.minute&(1<<t.Minute()) != 0 && s.hour&(1<<t.Hour()) != 0 && s.matchesDay(t)
+}
+
+func (s CronSchedule) matchesDay(t time.Time) bool {
+	if s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<int(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// maxCronSearch bounds the search for the next start, as an expression like "0 0 30 2 *" never matches
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+// MaintenanceWindow is open for Duration from every start of the schedule, in the time zone of Location.
+type MaintenanceWindow struct {
+	Schedule CronSchedule
+	Duration time.Duration
+	Location *time.Location
+}
+
+func ParseMaintenanceWindow(schedule string, duration time.Duration, location *time.Location) (MaintenanceWindow, error) {
+	cron, err := ParseCron(schedule)
+	if err != nil {
+		return MaintenanceWindow{}, err
+	}
+	if duration <= 0 {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window %q has no duration", schedule)
+	}
+	return MaintenanceWindow{Schedule: cron, Duration: duration, Location: location}, nil
+}
+
+// Open reports whether t is in a window that started within Duration before it.
+func (w MaintenanceWindow) Open(t time.Time) bool {
+	t = t.In(w.location())
+	for start := truncateToMinute(t); t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.Schedule.Matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns the next start after t, or false if the schedule never matches.
+func (w MaintenanceWindow) NextOpen(t time.Time) (time.Time, bool) {
+	t = t.In(w.location())
+	limit := t.Add(maxCronSearch)
+	for start := truncateToMinute(t).Add(time.Minute); start.Before(limit); {
+		if !w.Schedule.matchesDay(start) {
+			// skip the rest of a day that does not match at all
+			start = time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+			continue
+		}
+		if w.Schedule.Matches(start) {
+			return start, true
+		}
+		start = start.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+func (w MaintenanceWindow) location() *time.Location {
+	if w.Location == nil {
+		return time.UTC
+	}
+	return w.Location
+}
+
+// truncateToMinute truncates in the time zone of t, which time.Truncate does not do for zones with odd offsets.
+func truncateToMinute(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+}
@@ -0,0 +1,128 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"alexejk.io/go-xmlrpc"
+)
+
+// ErrorKind classifies pfsense failures so callers can tell whether retrying helps.
+type ErrorKind string
+
+const (
+	// ErrorKindFault is an XML-RPC fault, e.g. a malformed config section.
+	ErrorKindFault ErrorKind = "fault"
+	// ErrorKindHTTP is an unexpected http status that is neither an auth nor a transient one.
+	ErrorKindHTTP ErrorKind = "http"
+	// ErrorKindAuth means the credentials or the pinned host key were rejected.
+	ErrorKindAuth ErrorKind = "auth"
+	// ErrorKindTransient covers timeouts, connection failures and overloaded or restarting servers.
+	ErrorKindTransient ErrorKind = "transient"
+	// ErrorKindRejected means pfsense handled the call but reported that it did not succeed.
+	ErrorKindRejected ErrorKind = "rejected"
+)
+
+// PfsenseError is a classified failure of a single pfsense call.
+type PfsenseError struct {
+	Kind ErrorKind
+	// Op is the XML-RPC method, the http method and path, or the ssh operation
+	Op         string
+	FaultCode  int
+	StatusCode int
+	Err        error
+}
+
+func (e *PfsenseError) Error() string {
+	switch {
+	case e.Kind == ErrorKindFault:
+		return fmt.Sprintf("%s failed with fault %d; %v", e.Op, e.FaultCode, e.Err)
+	case e.StatusCode != 0:
+		return fmt.Sprintf("%s failed with %s status %d; %v", e.Op, e.Kind, e.StatusCode, e.Err)
+	default:
+		return fmt.Sprintf("%s failed with %s error; %v", e.Op, e.Kind, e.Err)
+	}
+}
+
+func (e *PfsenseError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether the same call may succeed if it is repeated shortly.
+func IsTransient(err error) bool {
+	var pe *PfsenseError
+	return errors.As(err, &pe) && pe.Kind == ErrorKindTransient
+}
+
+// IsPermanent reports whether pfsense answered in a way that repeating the same call will not change.
+func IsPermanent(err error) bool {
+	var pe *PfsenseError
+	return errors.As(err, &pe) && pe.Kind != ErrorKindTransient
+}
+
+// NewRejectedError is returned when pfsense reports Success=false.
+func NewRejectedError(op string) error {
+	return &PfsenseError{Kind: ErrorKindRejected, Op: op, Err: errors.New("pfsense returned 'false' as the result")}
+}
+
+// classifyError wraps err into a PfsenseError when its kind can be told; statusCode is zero if there was no http response.
+// Errors that cannot be classified, like a cancelled context, are returned as they are.
+func classifyError(op string, statusCode int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pe *PfsenseError
+	if errors.As(err, &pe) {
+		return err
+	}
+	if code, msg, ok := xmlrpcFault(err); ok {
+		kind := ErrorKindFault
+		if strings.Contains(strings.ToLower(msg), "authentication failed") {
+			kind = ErrorKindAuth
+		}
+		return &PfsenseError{Kind: kind, Op: op, FaultCode: code, Err: err}
+	}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return &PfsenseError{Kind: ErrorKindAuth, Op: op, StatusCode: statusCode, Err: err}
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout:
+		return &PfsenseError{Kind: ErrorKindTransient, Op: op, StatusCode: statusCode, Err: err}
+	case statusCode != 0 && (statusCode < 200 || statusCode > 299):
+		return &PfsenseError{Kind: ErrorKindHTTP, Op: op, StatusCode: statusCode, Err: err}
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &PfsenseError{Kind: ErrorKindTransient, Op: op, Err: err}
+	}
+	return err
+}
+
+// xmlrpcFault extracts the fault; the library returns it either as is or flattened by net/rpc into a "code: message" string.
+func xmlrpcFault(err error) (int, string, bool) {
+	var fault *xmlrpc.Fault
+	if errors.As(err, &fault) {
+		return fault.Code, fault.String, true
+	}
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		codeStr, msg, found := strings.Cut(string(serverErr), ": ")
+		if code, convErr := strconv.Atoi(codeStr); found && convErr == nil {
+			return code, msg, true
+		}
+	}
+	return 0, "", false
+}
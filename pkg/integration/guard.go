@@ -0,0 +1,222 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitOpenError is returned instead of calling pfsense while the circuit is open.
+type CircuitOpenError struct {
+	Target     string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("pfsense circuit breaker of %s is open, retry after %s", e.Target, e.RetryAfter)
+}
+
+var pfsenseCalls, _ = otel.Meter("github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration").Int64Counter(
+	"pfsense.calls",
+	metric.WithDescription("Calls to pfsense by target and outcome"),
+)
+
+// CallGuard retries transient pfsense failures with jittered exponential backoff and opens a circuit
+// once calls keep failing, so an outage is not made worse by every reconcile hitting pfsense.
+// After the circuit has been open for a while a single call is let through to probe pfsense.
+// Every target has its own guard, so one firewall being down does not block the others.
+// A nil CallGuard calls pfsense once and never opens.
+type CallGuard struct {
+	target     string
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	threshold  int
+	openFor    time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// callKind tells how a call is bounded and whether it is safe to repeat.
+type callKind int
+
+const (
+	callRead callKind = iota
+	// callReplace writes the same result no matter how many times it is repeated, e.g. a section restore
+	callReplace
+	callWrite
+	// callHealth is neither retried nor guarded, so health checks report the actual pfsense state
+	callHealth
+)
+
+func (t PfsenseTimeouts) of(kind callKind) time.Duration {
+	switch kind {
+	case callRead:
+		return t.Read
+	case callHealth:
+		return t.Health
+	default:
+		return t.Write
+	}
+}
+
+func NewCallGuard(target string, attempts int, backoff time.Duration, maxBackoff time.Duration, threshold int, openFor time.Duration) *CallGuard {
+	return &CallGuard{
+		target:     target,
+		attempts:   attempts,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		threshold:  threshold,
+		openFor:    openFor,
+	}
+}
+
+func (g *CallGuard) State() CircuitState {
+	if g == nil {
+		return CircuitClosed
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case g.openUntil.IsZero():
+		return CircuitClosed
+	case time.Now().Before(g.openUntil):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+func (g *CallGuard) do(ctx context.Context, kind callKind, fn func(ctx context.Context) error) error {
+	if g == nil {
+		return fn(ctx)
+	}
+	// the target label is picked up by the http client metrics
+	labeler := &otelhttp.Labeler{}
+	labeler.Add(attribute.String("pfsense.target", g.target))
+	ctx = otelhttp.ContextWithLabeler(ctx, labeler)
+	fn = g.counted(fn)
+	if kind == callHealth {
+		return fn(ctx)
+	}
+	attempts := 1
+	if kind == callRead || kind == callReplace {
+		attempts = max(1, g.attempts)
+	}
+	var err error
+	for attempt := range attempts {
+		if attempt > 0 {
+			if werr := sleep(ctx, g.delay(attempt)); werr != nil {
+				return errors.Join(err, werr)
+			}
+		}
+		if err = g.allow(); err != nil {
+			pfsenseCalls.Add(ctx, 1, metric.WithAttributes(attribute.String("pfsense.target", g.target), attribute.String("outcome", "circuit_open")))
+			return err
+		}
+		err = fn(ctx)
+		g.record(err)
+		if !IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// counted records the outcome of every call in the pfsense.calls metric.
+func (g *CallGuard) counted(fn func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		err := fn(ctx)
+		outcome := "success"
+		var pe *PfsenseError
+		switch {
+		case errors.As(err, &pe):
+			outcome = string(pe.Kind)
+		case err != nil:
+			outcome = "error"
+		}
+		pfsenseCalls.Add(ctx, 1, metric.WithAttributes(attribute.String("pfsense.target", g.target), attribute.String("outcome", outcome)))
+		return err
+	}
+}
+
+func (g *CallGuard) allow() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.openUntil.IsZero() {
+		return nil
+	}
+	if wait := time.Until(g.openUntil); wait > 0 {
+		return &CircuitOpenError{Target: g.target, RetryAfter: wait}
+	}
+	if g.probing {
+		return &CircuitOpenError{Target: g.target, RetryAfter: g.openFor}
+	}
+	g.probing = true
+	return nil
+}
+
+func (g *CallGuard) record(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	probe := g.probing
+	g.probing = false
+	switch {
+	case err == nil || IsPermanent(err):
+		// pfsense answered, even if it did not like the request
+		if !g.openUntil.IsZero() {
+			slog.Info("pfsense circuit breaker closed", "target", g.target)
+		}
+		g.failures = 0
+		g.openUntil = time.Time{}
+	case IsTransient(err):
+		g.failures++
+		if probe || (g.threshold > 0 && g.failures >= g.threshold) {
+			g.openUntil = time.Now().Add(g.openFor)
+			slog.Warn("pfsense circuit breaker opened", "target", g.target, "failures", g.failures, "until", g.openUntil, "error", err)
+		}
+	}
+}
+
+// delay doubles the backoff for every attempt and picks a random point in its upper half.
+func (g *CallGuard) delay(attempt int) time.Duration {
+	d := g.backoff << (attempt - 1)
+	if g.maxBackoff > 0 && (d > g.maxBackoff || d <= 0) {
+		d = g.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
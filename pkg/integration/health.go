@@ -0,0 +1,173 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var healthMeter = otel.Meter("github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration")
+
+var (
+	pfsenseLastHealthy, _ = healthMeter.Int64ObservableGauge(
+		"pfsense.health.last_success",
+		metric.WithDescription("Unix time of the last successful health check by target"),
+		metric.WithUnit("s"),
+	)
+	pfsenseFirmware, _ = healthMeter.Int64ObservableGauge(
+		"pfsense.firmware.version",
+		metric.WithDescription("Firmware version reported by the last successful health check by target, always 1"),
+	)
+	pfsenseDegraded, _ = healthMeter.Int64ObservableGauge(
+		"pfsense.health.degraded",
+		metric.WithDescription("1 while the target is down but the controller keeps serving in degraded mode"),
+	)
+)
+
+// HealthProbe checks pfsense and returns its firmware version, or an empty one if the backend does not tell it.
+type HealthProbe func(ctx context.Context) (string, error)
+
+// PfsenseHealthProbe calls pfsense unless a recent call of the controller already showed it is reachable.
+func PfsenseHealthProbe(client *PfsenseClient) HealthProbe {
+	var version string
+	return func(ctx context.Context) (string, error) {
+		if version != "" && client.cache != nil && client.cache.reachable(ctx) {
+			return version, nil
+		}
+		res, err := pfsenseHealthCall(ctx, client)
+		if err != nil {
+			return "", err
+		}
+		version = res.Firmware.Version
+		return version, nil
+	}
+}
+
+// CheckerProbe probes with a readiness check of a backend that does not tell its version.
+func CheckerProbe(check func(req *http.Request) error) HealthProbe {
+	return func(ctx context.Context) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to create health request; %w", err)
+		}
+		return "", check(req)
+	}
+}
+
+// HealthMonitor probes a target on its own schedule, so readiness probes only read the last result and
+// neither add load on pfsense nor flap with a single failed call: the target is unhealthy only after failureThreshold
+// failures in a row. In degraded mode it stays ready even then, and the controller keeps serving with what it has.
+// Every replica runs its own monitor, as every replica answers readiness probes.
+type HealthMonitor struct {
+	target           string
+	probe            HealthProbe
+	interval         time.Duration
+	failureThreshold int
+	degraded         bool
+
+	mu          sync.Mutex
+	checked     bool
+	failures    int
+	lastErr     error
+	lastSuccess time.Time
+	version     string
+}
+
+func NewHealthMonitor(target string, probe HealthProbe, interval time.Duration, failureThreshold int, degraded bool) *HealthMonitor {
+	m := &HealthMonitor{
+		target:           target,
+		probe:            probe,
+		interval:         interval,
+		failureThreshold: max(1, failureThreshold),
+		degraded:         degraded,
+	}
+	if _, err := healthMeter.RegisterCallback(m.observe, pfsenseLastHealthy, pfsenseFirmware, pfsenseDegraded); err != nil {
+		slog.Warn("failed to register pfsense health metrics", "target", target, "error", err)
+	}
+	return m
+}
+
+// Start probes right away and then every interval until the context is done.
+func (m *HealthMonitor) Start(ctx context.Context) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *HealthMonitor) NeedLeaderElection() bool {
+	return false
+}
+
+// Check reports the last result to a readiness probe without calling pfsense.
+func (m *HealthMonitor) Check(_ *http.Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !m.checked:
+		return fmt.Errorf("pfsense %s has not been checked yet", m.target)
+	case m.failures < m.failureThreshold || m.degraded:
+		return nil
+	}
+	return fmt.Errorf("pfsense %s failed %d health checks in a row; %w", m.target, m.failures, m.lastErr)
+}
+
+func (m *HealthMonitor) check(ctx context.Context) {
+	// the probes are bounded by the health timeout of the target
+	version, err := m.probe(ctx)
+	if errors.Is(err, context.Canceled) {
+		// the manager is stopping, which says nothing about pfsense
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checked = true
+	if err == nil {
+		if m.failures >= m.failureThreshold {
+			slog.InfoContext(ctx, "pfsense is healthy again", "target", m.target)
+		}
+		m.failures, m.lastErr, m.lastSuccess = 0, nil, time.Now()
+		if version != "" {
+			m.version = version
+		}
+		return
+	}
+	m.failures++
+	m.lastErr = err
+	if m.failures == m.failureThreshold {
+		slog.WarnContext(ctx, "pfsense is unhealthy", "target", m.target, "degraded", m.degraded, "error", err)
+	}
+}
+
+func (m *HealthMonitor) observe(_ context.Context, o metric.Observer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target := attribute.String("pfsense.target", m.target)
+	if !m.lastSuccess.IsZero() {
+		o.ObserveInt64(pfsenseLastHealthy, m.lastSuccess.Unix(), metric.WithAttributes(target))
+	}
+	if m.version != "" {
+		o.ObserveInt64(pfsenseFirmware, 1, metric.WithAttributes(target, attribute.String("version", m.version)))
+	}
+	degraded := int64(0)
+	if m.degraded && m.failures >= m.failureThreshold {
+		degraded = 1
+	}
+	o.ObserveInt64(pfsenseDegraded, degraded, metric.WithAttributes(target))
+	return nil
+}
@@ -23,14 +23,7 @@ func AllocateIP(
 	// Iterate over all usable IPs in subnet
 	for ip := subnet.Addr().Next(); subnet.Contains(ip); ip = ip.Next() {
 		// Skip excluded range
-		excluded := false
-		for _, exclusion := range exclusions {
-			if ip.Compare(exclusion.Start) >= 0 && ip.Compare(exclusion.End) <= 0 {
-				excluded = true
-				break
-			}
-		}
-		if excluded {
+		if isExcluded(ip, exclusions) {
 			continue
 		}
 
@@ -44,3 +37,21 @@ func AllocateIP(
 
 	return "", errors.New("no free IPs available")
 }
+
+// IsAllocatable reports whether the ip can be handed out from the subnet,
+// i.e. it is a usable subnet address and does not fall into any exclusion.
+func IsAllocatable(subnet netip.Prefix, exclusions []Range[netip.Addr], ip netip.Addr) bool {
+	if !subnet.Contains(ip) || ip == subnet.Masked().Addr() {
+		return false
+	}
+	return !isExcluded(ip, exclusions)
+}
+
+func isExcluded(ip netip.Addr, exclusions []Range[netip.Addr]) bool {
+	for _, exclusion := range exclusions {
+		if ip.Compare(exclusion.Start) >= 0 && ip.Compare(exclusion.End) <= 0 {
+			return true
+		}
+	}
+	return false
+}
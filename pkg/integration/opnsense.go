@@ -0,0 +1,233 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// OPNsenseClient talks to the OPNsense API which authenticates with a key/secret pair as basic credentials.
+type OPNsenseClient struct {
+	baseURL    string
+	httpClient *http.Client
+	timeouts   PfsenseTimeouts
+	guard      *CallGuard
+}
+
+type OPNsenseNetwork struct {
+	Network string `json:"network"`
+	Port    string `json:"port,omitempty"`
+}
+
+type OPNsenseDNATRule struct {
+	UUID        string          `json:"uuid,omitempty"`
+	Disabled    string          `json:"disabled"`
+	Interface   string          `json:"interface"`
+	IPProtocol  string          `json:"ipprotocol"`
+	Protocol    string          `json:"protocol"`
+	Source      OPNsenseNetwork `json:"source"`
+	Destination OPNsenseNetwork `json:"destination"`
+	Target      string          `json:"target"`
+	LocalPort   string          `json:"local-port"`
+	Descr       string          `json:"descr"`
+}
+
+type OPNsenseVirtualIP struct {
+	UUID       string `json:"uuid,omitempty"`
+	Mode       string `json:"mode"`
+	Interface  string `json:"interface"`
+	Subnet     string `json:"subnet"`
+	SubnetBits string `json:"subnet_bits"`
+	Descr      string `json:"descr"`
+}
+
+type OPNsenseAlias struct {
+	UUID    string `json:"uuid,omitempty"`
+	Enabled string `json:"enabled"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	// Content holds the addresses separated by newlines
+	Content     string `json:"content"`
+	Description string `json:"description"`
+}
+
+type opnsenseSearchResult[T any] struct {
+	Rows     []T `json:"rows"`
+	RowCount int `json:"rowCount"`
+	Total    int `json:"total"`
+	Current  int `json:"current"`
+}
+
+type opnsenseMutationResult struct {
+	Result      string         `json:"result"`
+	UUID        string         `json:"uuid"`
+	Validations map[string]any `json:"validations"`
+}
+
+func CreateOPNsenseClient(baseURL string, apiKey string, apiSecret string, tlsOptions TLSOptions, timeouts PfsenseTimeouts, guard *CallGuard) (*OPNsenseClient, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("failed to parse opnsense url; %w", err)
+	}
+	auth := func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(apiKey, apiSecret)
+		return next.RoundTrip(req)
+	}
+	tlsConfig, err := NewTLSConfig(tlsOptions, hostname(baseURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure tls; %w", err)
+	}
+	httpClient := NewHTTPClientWithTLS("opnsense", tlsConfig, auth)
+	return &OPNsenseClient{baseURL: baseURL + "/api", httpClient: httpClient, timeouts: timeouts, guard: guard}, nil
+}
+
+func (c *OPNsenseClient) SearchDNATRules(ctx context.Context) ([]OPNsenseDNATRule, error) {
+	return opnsenseSearch[OPNsenseDNATRule](ctx, c, "/firewall/d_nat/search_rule")
+}
+
+func (c *OPNsenseClient) AddDNATRule(ctx context.Context, rule OPNsenseDNATRule) (string, error) {
+	return opnsenseAdd(ctx, c, "/firewall/d_nat/add_rule", map[string]any{"rule": rule})
+}
+
+func (c *OPNsenseClient) DeleteDNATRule(ctx context.Context, uuid string) error {
+	return opnsenseDelete(ctx, c, "/firewall/d_nat/del_rule/"+url.PathEscape(uuid))
+}
+
+// ApplyDNAT reloads the filter so pending destination nat changes take effect.
+func (c *OPNsenseClient) ApplyDNAT(ctx context.Context) error {
+	_, err := opnsenseCall[json.RawMessage](ctx, c, callReplace, http.MethodPost, "/firewall/d_nat/apply", struct{}{})
+	return err
+}
+
+func (c *OPNsenseClient) SearchVirtualIPs(ctx context.Context) ([]OPNsenseVirtualIP, error) {
+	return opnsenseSearch[OPNsenseVirtualIP](ctx, c, "/interfaces/vip_settings/search_item")
+}
+
+func (c *OPNsenseClient) AddVirtualIP(ctx context.Context, vip OPNsenseVirtualIP) (string, error) {
+	return opnsenseAdd(ctx, c, "/interfaces/vip_settings/add_item", map[string]any{"vip": vip})
+}
+
+func (c *OPNsenseClient) DeleteVirtualIP(ctx context.Context, uuid string) error {
+	return opnsenseDelete(ctx, c, "/interfaces/vip_settings/del_item/"+url.PathEscape(uuid))
+}
+
+// ApplyVirtualIPs brings the pending virtual IPs up and the deleted ones down.
+func (c *OPNsenseClient) ApplyVirtualIPs(ctx context.Context) error {
+	_, err := opnsenseCall[json.RawMessage](ctx, c, callReplace, http.MethodPost, "/interfaces/vip_settings/reconfigure", struct{}{})
+	return err
+}
+
+func (c *OPNsenseClient) SearchAliases(ctx context.Context) ([]OPNsenseAlias, error) {
+	return opnsenseSearch[OPNsenseAlias](ctx, c, "/firewall/alias/search_item")
+}
+
+func (c *OPNsenseClient) AddAlias(ctx context.Context, alias OPNsenseAlias) (string, error) {
+	return opnsenseAdd(ctx, c, "/firewall/alias/add_item", map[string]any{"alias": alias})
+}
+
+func (c *OPNsenseClient) DeleteAlias(ctx context.Context, uuid string) error {
+	return opnsenseDelete(ctx, c, "/firewall/alias/del_item/"+url.PathEscape(uuid))
+}
+
+// ApplyAliases loads the pending alias changes into the filter tables.
+func (c *OPNsenseClient) ApplyAliases(ctx context.Context) error {
+	_, err := opnsenseCall[json.RawMessage](ctx, c, callReplace, http.MethodPost, "/firewall/alias/reconfigure", struct{}{})
+	return err
+}
+
+func OPNsenseHealthCheck(client *OPNsenseClient) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		if _, err := opnsenseCall[json.RawMessage](req.Context(), client, callHealth, http.MethodGet, "/core/firmware/status", nil); err != nil {
+			return fmt.Errorf("failed to make api call; %w", err)
+		}
+		return nil
+	}
+}
+
+func opnsenseSearch[T any](ctx context.Context, c *OPNsenseClient, path string) ([]T, error) {
+	// rowCount -1 disables paging
+	res, err := opnsenseCall[opnsenseSearchResult[T]](ctx, c, callRead, http.MethodPost, path, map[string]any{"current": 1, "rowCount": -1})
+	if err != nil {
+		return nil, err
+	}
+	return res.Rows, nil
+}
+
+func opnsenseAdd(ctx context.Context, c *OPNsenseClient, path string, body any) (string, error) {
+	res, err := opnsenseCall[opnsenseMutationResult](ctx, c, callWrite, http.MethodPost, path, body)
+	if err != nil {
+		return "", err
+	}
+	if res.Result != "saved" {
+		return "", &PfsenseError{Kind: ErrorKindRejected, Op: path, Err: fmt.Errorf("result %q; validations: %s", res.Result, ToUnsafeJSONString(res.Validations))}
+	}
+	return res.UUID, nil
+}
+
+func opnsenseDelete(ctx context.Context, c *OPNsenseClient, path string) error {
+	// deleting a missing uuid reports "not found", so repeating the call is safe
+	res, err := opnsenseCall[opnsenseMutationResult](ctx, c, callReplace, http.MethodPost, path, struct{}{})
+	if err != nil {
+		return err
+	}
+	if res.Result != "deleted" && res.Result != "not found" {
+		return &PfsenseError{Kind: ErrorKindRejected, Op: path, Err: fmt.Errorf("result %q", res.Result)}
+	}
+	return nil
+}
+
+func opnsenseCall[T any](ctx context.Context, c *OPNsenseClient, kind callKind, method string, path string, body any) (T, error) {
+	var out T
+	err := c.guard.do(ctx, kind, func(ctx context.Context) error {
+		var err error
+		out, err = opnsenseCallOnce[T](ctx, c, c.timeouts.of(kind), method, path, body)
+		return err
+	})
+	return out, err
+}
+
+func opnsenseCallOnce[T any](ctx context.Context, c *OPNsenseClient, timeout time.Duration, method string, path string, body any) (T, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	var zero T
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return zero, fmt.Errorf("failed to marshal request; %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return zero, fmt.Errorf("failed to create request; %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	op := method + " " + path
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return zero, classifyError(op, 0, fmt.Errorf("failed to call %s; %w", op, err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return zero, classifyError(op, res.StatusCode, errors.New(string(msg)))
+	}
+	var out T
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return zero, fmt.Errorf("failed to decode response of %s; %w", op, err)
+	}
+	return out, nil
+}
@@ -1,49 +1,276 @@
 package integration
 
 import (
-	"crypto/tls"
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"alexejk.io/go-xmlrpc"
 )
 
-func CreatePfsenseClient(url string, username string, password string, insecure bool) (*xmlrpc.Client, error) {
-	//nolint:gosec
-	httpClient := NewHTTPClientWithTLS("pfsense", &tls.Config{InsecureSkipVerify: insecure})
-	headers := map[string]string{
-		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
-	}
-	url += "/xmlrpc.php"
-	c, err := xmlrpc.NewClient(url, xmlrpc.HttpClient(httpClient), xmlrpc.Headers(headers))
+// PfsenseTimeouts bound pfsense calls by their kind; zero leaves a call bounded by its context only.
+type PfsenseTimeouts struct {
+	Read   time.Duration
+	Write  time.Duration
+	Health time.Duration
+}
+
+// PfsenseClient calls the pfsense XML-RPC api. The xmlrpc library does not accept a context,
+// so every call gets its own xmlrpc client whose requests carry the context of the call.
+type PfsenseClient struct {
+	url        string
+	httpClient *http.Client
+	timeouts   PfsenseTimeouts
+	guard      *CallGuard
+	// secondary is the peer of a CARP pair that is called while this firewall is unreachable
+	secondary *PfsenseClient
+	cache     *sectionCache
+}
+
+func CreatePfsenseClient(url string, credentials CredentialSource, tlsOptions TLSOptions, timeouts PfsenseTimeouts, guard *CallGuard) (*PfsenseClient, error) {
+	tlsConfig, err := NewTLSConfig(tlsOptions, hostname(url))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create xmlrpc client; %w", err)
+		return nil, fmt.Errorf("failed to configure tls; %w", err)
+	}
+	httpClient := NewHTTPClientWithTLS("pfsense", tlsConfig, basicAuth(credentials))
+	return &PfsenseClient{url: url + "/xmlrpc.php", httpClient: httpClient, timeouts: timeouts, guard: guard}, nil
+}
+
+// NewPfsenseHAClient calls the primary firewall of a CARP pair and fails over to the secondary while the primary
+// is unreachable. Both clients should have their own guard, so the open circuit of the primary does not block the secondary.
+func NewPfsenseHAClient(primary *PfsenseClient, secondary *PfsenseClient) *PfsenseClient {
+	client := *primary
+	client.secondary = secondary
+	return &client
+}
+
+func (c *PfsenseClient) Timeouts() PfsenseTimeouts {
+	return c.timeouts
+}
+
+// Read calls a method that does not change the pfsense config; transient failures are retried.
+func (c *PfsenseClient) Read(ctx context.Context, method string, args any, reply any) error {
+	if c.cache != nil && method == backupConfigSectionMethod {
+		return c.cachedRead(ctx, method, args, reply)
+	}
+	return c.call(ctx, callRead, method, args, reply)
+}
+
+// Write calls a method that replaces a part of the pfsense config, so repeating it after a transient failure is safe.
+func (c *PfsenseClient) Write(ctx context.Context, method string, args any, reply any) error {
+	defer c.invalidateCache()
+	return c.call(ctx, callReplace, method, args, reply)
+}
+
+// Exec calls a method that changes the pfsense config and must not be repeated.
+func (c *PfsenseClient) Exec(ctx context.Context, method string, args any, reply any) error {
+	defer c.invalidateCache()
+	return c.call(ctx, callWrite, method, args, reply)
+}
+
+// invalidateCache drops the cache once a write is done, which also keeps reads that overlapped it from being stored.
+func (c *PfsenseClient) invalidateCache() {
+	if c.cache != nil {
+		c.cache.invalidate()
 	}
-	return c, nil
 }
 
-func PfsenseHealthCheck(client *xmlrpc.Client) func(req *http.Request) error {
-	return func(_ *http.Request) error {
-		req := &struct {
-			Dummy   string
-			Timeout int
-		}{
-			Dummy:   "dummy_value",
-			Timeout: 30,
+func (c *PfsenseClient) call(ctx context.Context, kind callKind, method string, args any, reply any) error {
+	err := c.guard.do(ctx, kind, func(ctx context.Context) error {
+		return c.callOnce(ctx, c.timeouts.of(kind), method, args, reply)
+	})
+	if err == nil && c.cache != nil {
+		c.cache.succeeded()
+	}
+	if err == nil && (kind == callWrite || kind == callReplace) {
+		recordWriter(ctx, c)
+	}
+	if c.secondary == nil || !isUnreachable(err) {
+		return err
+	}
+	slog.WarnContext(ctx, "pfsense primary is unreachable, calling the secondary", "method", method, "error", err)
+	if serr := c.secondary.call(ctx, kind, method, args, reply); serr != nil {
+		return fmt.Errorf("failed to call the secondary after the primary failed with %w; %w", err, serr)
+	}
+	return nil
+}
+
+type writtenByKey struct{}
+
+// WrittenBy records the firewall that took the writes made with its context, which is the secondary of a CARP pair
+// while the primary is unreachable.
+type WrittenBy struct {
+	mu     sync.Mutex
+	client *PfsenseClient
+}
+
+// WithWrittenBy returns a context that records the firewall taking its writes, see CheckWriter.
+func WithWrittenBy(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writtenByKey{}, &WrittenBy{})
+}
+
+func recordWriter(ctx context.Context, c *PfsenseClient) {
+	if w, ok := ctx.Value(writtenByKey{}).(*WrittenBy); ok {
+		w.mu.Lock()
+		w.client = c
+		w.mu.Unlock()
+	}
+}
+
+// CheckWriter calls the firewall that took the last write recorded in the context of WithWrittenBy, or this one
+// if none was, without failing over, so a firewall that broke with the write does not pass on its peer.
+func (c *PfsenseClient) CheckWriter(ctx context.Context) error {
+	writer := *c
+	if w, ok := ctx.Value(writtenByKey{}).(*WrittenBy); ok {
+		w.mu.Lock()
+		if w.client != nil {
+			writer = *w.client
 		}
-		res := &NestedXMLRPC[hostFirmwareVersionResponse]{}
-		if err := client.Call("pfsense.host_firmware_version", req, res); err != nil {
-			return fmt.Errorf("failed to make rpc call; %w", err)
+		w.mu.Unlock()
+	}
+	writer.secondary = nil
+	_, err := pfsenseHealthCall(ctx, &writer)
+	return err
+}
+
+// isUnreachable reports whether the call did not get to pfsense, as opposed to pfsense refusing it.
+func isUnreachable(err error) bool {
+	var circuitErr *CircuitOpenError
+	return IsTransient(err) || errors.As(err, &circuitErr)
+}
+
+func (c *PfsenseClient) callOnce(ctx context.Context, timeout time.Duration, method string, args any, reply any) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	// the status is not exposed by the library, so it is captured to classify the failure
+	var statusCode int
+	httpClient := *c.httpClient
+	httpClient.Transport = &middlewareRoundTripper{
+		roundTripper: c.httpClient.Transport,
+		middleware: func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+			res, err := next.RoundTrip(req.WithContext(ctx))
+			if res != nil {
+				statusCode = res.StatusCode
+			}
+			return res, err
+		},
+	}
+	if timeout > 0 {
+		// the context deadline replaces the overall client timeout
+		httpClient.Timeout = 0
+	}
+
+	client, err := xmlrpc.NewClient(c.url, xmlrpc.HttpClient(&httpClient))
+	if err != nil {
+		return fmt.Errorf("failed to create xmlrpc client; %w", err)
+	}
+	defer client.Close()
+
+	if err := client.Call(method, args, reply); err != nil {
+		// the library does not wrap transport errors, so the context error is attached to keep errors.Is working
+		return classifyError(method, statusCode, errors.Join(err, ctx.Err()))
+	}
+	return nil
+}
+
+func PfsenseHealthCheck(client *PfsenseClient) func(req *http.Request) error {
+	return func(r *http.Request) error {
+		if client.cache != nil && client.cache.reachable(r.Context()) {
+			return nil
 		}
-		return nil
+		_, err := pfsenseHealthCall(r.Context(), client)
+		return err
+	}
+}
+
+func pfsenseHealthCall(ctx context.Context, client *PfsenseClient) (hostFirmwareVersionResponse, error) {
+	req := &struct {
+		Dummy   string
+		Timeout int
+	}{
+		Dummy:   "dummy_value",
+		Timeout: TimeoutSeconds(client.timeouts.Health),
+	}
+	res := &NestedXMLRPC[hostFirmwareVersionResponse]{}
+	if err := client.call(ctx, callHealth, "pfsense.host_firmware_version", req, res); err != nil {
+		return hostFirmwareVersionResponse{}, fmt.Errorf("failed to make rpc call; %w", err)
+	}
+	return res.Nested, nil
+}
+
+// FirmwareVersion returns the pfsense version, e.g. "2.7.2-RELEASE" or "23.09.1-RELEASE" for pfsense plus.
+func (c *PfsenseClient) FirmwareVersion(ctx context.Context) (string, error) {
+	req := &struct {
+		Dummy   string
+		Timeout int
+	}{
+		Dummy:   "dummy_value",
+		Timeout: TimeoutSeconds(c.timeouts.Read),
+	}
+	res := &NestedXMLRPC[hostFirmwareVersionResponse]{}
+	if err := c.Read(ctx, "pfsense.host_firmware_version", req, res); err != nil {
+		return "", fmt.Errorf("failed to make rpc call; %w", err)
 	}
+	return res.Nested.Firmware.Version, nil
+}
+
+// ConfigRevision identifies the config version by the time and description of its last write; empty if pfsense has none.
+// It is never served from the cache.
+func (c *PfsenseClient) ConfigRevision(ctx context.Context) (string, error) {
+	req := &struct{ Data []string }{Data: []string{"revision"}}
+	res := &NestedXMLRPC[struct{ Revision *configRevision }]{}
+	if err := c.call(ctx, callRead, backupConfigSectionMethod, req, res); err != nil {
+		return "", err
+	}
+	return res.Nested.Revision.String(), nil
+}
+
+// TimeoutSeconds converts the timeout to the seconds argument some pfsense methods take, defaulting to 30.
+func TimeoutSeconds(timeout time.Duration) int {
+	if timeout <= 0 {
+		return 30
+	}
+	return max(1, int(timeout.Seconds()))
+}
+
+// hostname returns the host of the url without the port, or an empty string if the url cannot be parsed.
+func hostname(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 type NestedXMLRPC[T any] struct {
 	Nested T
 }
 
+type configRevision struct {
+	Time        string
+	Description string
+}
+
+func (r *configRevision) String() string {
+	if r == nil || r.Time == "" {
+		return ""
+	}
+	return r.Time + " " + r.Description
+}
+
 type hostFirmwareVersionResponse struct {
 	Firmware struct {
 		Version string
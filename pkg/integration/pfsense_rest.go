@@ -0,0 +1,283 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pfsenseRESTPrefix = "/api/v2"
+
+// PfsenseRESTClient talks to the pfSense REST API package (https://github.com/jaredhendrickson13/pfsense-api).
+type PfsenseRESTClient struct {
+	baseURL    string
+	httpClient *http.Client
+	timeouts   PfsenseTimeouts
+	guard      *CallGuard
+}
+
+type RESTPortForward struct {
+	ID               int    `json:"id,omitempty"`
+	Interface        string `json:"interface"`
+	IPProtocol       string `json:"ipprotocol"`
+	Protocol         string `json:"protocol"`
+	Source           string `json:"source"`
+	Destination      string `json:"destination"`
+	DestinationPort  string `json:"destination_port"`
+	Target           string `json:"target"`
+	LocalPort        string `json:"local_port"`
+	Descr            string `json:"descr"`
+	AssociatedRuleID string `json:"associated_rule_id,omitempty"`
+}
+
+type RESTVirtualIP struct {
+	ID         int    `json:"id,omitempty"`
+	Mode       string `json:"mode"`
+	Interface  string `json:"interface"`
+	Type       string `json:"type"`
+	Subnet     string `json:"subnet"`
+	SubnetBits int    `json:"subnet_bits"`
+	Descr      string `json:"descr"`
+	UniqID     string `json:"uniqid,omitempty"`
+}
+
+type RESTAlias struct {
+	ID      int      `json:"id,omitempty"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Address []string `json:"address"`
+	Descr   string   `json:"descr"`
+}
+
+type restResponse[T any] struct {
+	Code       int    `json:"code"`
+	Status     string `json:"status"`
+	ResponseID string `json:"response_id"`
+	Message    string `json:"message"`
+	Data       T      `json:"data"`
+}
+
+// CreatePfsenseRESTClient authenticates with the API key if it is set, otherwise it obtains a JWT with the credentials.
+func CreatePfsenseRESTClient(baseURL string, apiKey string, credentials CredentialSource, tlsOptions TLSOptions, timeouts PfsenseTimeouts, guard *CallGuard) (*PfsenseRESTClient, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("failed to parse pfsense url; %w", err)
+	}
+	var auth HTTPClientMiddleware
+	if apiKey != "" {
+		auth = apiKeyAuth(apiKey)
+	} else {
+		auth = (&jwtAuth{tokenURL: baseURL + pfsenseRESTPrefix + "/auth/jwt", credentials: credentials}).middleware
+	}
+	tlsConfig, err := NewTLSConfig(tlsOptions, hostname(baseURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure tls; %w", err)
+	}
+	httpClient := NewHTTPClientWithTLS("pfsense", tlsConfig, auth)
+	return &PfsenseRESTClient{baseURL: baseURL + pfsenseRESTPrefix, httpClient: httpClient, timeouts: timeouts, guard: guard}, nil
+}
+
+func (c *PfsenseRESTClient) ListPortForwards(ctx context.Context) ([]RESTPortForward, error) {
+	return restCall[[]RESTPortForward](ctx, c, callRead, http.MethodGet, "/firewall/nat/port_forwards", nil, nil)
+}
+
+func (c *PfsenseRESTClient) CreatePortForward(ctx context.Context, pf RESTPortForward) (RESTPortForward, error) {
+	return restCall[RESTPortForward](ctx, c, callWrite, http.MethodPost, "/firewall/nat/port_forward", nil, pf)
+}
+
+func (c *PfsenseRESTClient) DeletePortForward(ctx context.Context, id int) error {
+	_, err := restCall[json.RawMessage](ctx, c, callWrite, http.MethodDelete, "/firewall/nat/port_forward", idQuery(id), nil)
+	return err
+}
+
+func (c *PfsenseRESTClient) ListVirtualIPs(ctx context.Context) ([]RESTVirtualIP, error) {
+	return restCall[[]RESTVirtualIP](ctx, c, callRead, http.MethodGet, "/firewall/virtual_ips", nil, nil)
+}
+
+func (c *PfsenseRESTClient) CreateVirtualIP(ctx context.Context, vip RESTVirtualIP) (RESTVirtualIP, error) {
+	return restCall[RESTVirtualIP](ctx, c, callWrite, http.MethodPost, "/firewall/virtual_ip", nil, vip)
+}
+
+func (c *PfsenseRESTClient) DeleteVirtualIP(ctx context.Context, id int) error {
+	_, err := restCall[json.RawMessage](ctx, c, callWrite, http.MethodDelete, "/firewall/virtual_ip", idQuery(id), nil)
+	return err
+}
+
+// ApplyVirtualIPs brings the pending virtual IPs up and the deleted ones down.
+func (c *PfsenseRESTClient) ApplyVirtualIPs(ctx context.Context) error {
+	_, err := restCall[json.RawMessage](ctx, c, callReplace, http.MethodPost, "/firewall/virtual_ip/apply", nil, struct{}{})
+	return err
+}
+
+func (c *PfsenseRESTClient) ListAliases(ctx context.Context) ([]RESTAlias, error) {
+	return restCall[[]RESTAlias](ctx, c, callRead, http.MethodGet, "/firewall/aliases", nil, nil)
+}
+
+func (c *PfsenseRESTClient) CreateAlias(ctx context.Context, alias RESTAlias) (RESTAlias, error) {
+	return restCall[RESTAlias](ctx, c, callWrite, http.MethodPost, "/firewall/alias", nil, alias)
+}
+
+func (c *PfsenseRESTClient) DeleteAlias(ctx context.Context, id int) error {
+	_, err := restCall[json.RawMessage](ctx, c, callWrite, http.MethodDelete, "/firewall/alias", idQuery(id), nil)
+	return err
+}
+
+// ApplyFirewall reloads the filter so pending nat and alias changes take effect.
+func (c *PfsenseRESTClient) ApplyFirewall(ctx context.Context) error {
+	_, err := restCall[json.RawMessage](ctx, c, callReplace, http.MethodPost, "/firewall/apply", nil, struct{}{})
+	return err
+}
+
+func PfsenseRESTHealthCheck(client *PfsenseRESTClient) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		if _, err := restCall[json.RawMessage](req.Context(), client, callHealth, http.MethodGet, "/status/system", nil, nil); err != nil {
+			return fmt.Errorf("failed to make rest call; %w", err)
+		}
+		return nil
+	}
+}
+
+func idQuery(id int) url.Values {
+	return url.Values{"id": []string{strconv.Itoa(id)}}
+}
+
+func restCall[T any](ctx context.Context, c *PfsenseRESTClient, kind callKind, method string, path string, query url.Values, body any) (T, error) {
+	var out T
+	err := c.guard.do(ctx, kind, func(ctx context.Context) error {
+		var err error
+		out, err = restCallOnce[T](ctx, c, c.timeouts.of(kind), method, path, query, body)
+		return err
+	})
+	return out, err
+}
+
+func restCallOnce[T any](ctx context.Context, c *PfsenseRESTClient, timeout time.Duration, method string, path string, query url.Values, body any) (T, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	var zero T
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return zero, fmt.Errorf("failed to marshal request; %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return zero, fmt.Errorf("failed to create request; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	op := method + " " + path
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return zero, classifyError(op, 0, fmt.Errorf("failed to call %s; %w", op, err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		// errors of a proxy in front of pfsense are not json, so the body is only used for the message
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		var out restResponse[json.RawMessage]
+		message := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &out) == nil {
+			message = out.ResponseID + " " + out.Message
+		}
+		return zero, classifyError(op, res.StatusCode, fmt.Errorf("%s failed with status %d: %s", op, res.StatusCode, message))
+	}
+	var out restResponse[T]
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return zero, classifyError(op, res.StatusCode, fmt.Errorf("failed to decode response of %s with status %d; %w", op, res.StatusCode, err))
+	}
+	return out.Data, nil
+}
+
+func apiKeyAuth(apiKey string) HTTPClientMiddleware {
+	return func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-API-Key", apiKey)
+		return next.RoundTrip(req)
+	}
+}
+
+// jwtAuth obtains a token with basic credentials and refreshes it once the api rejects it.
+type jwtAuth struct {
+	tokenURL    string
+	credentials CredentialSource
+	mu          sync.Mutex
+	token       string
+}
+
+func (a *jwtAuth) middleware(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+	token, err := a.getToken(req.Context(), next, "")
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.send(req, next, token)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	// the token has expired or was revoked; get a new one and retry once
+	_ = res.Body.Close()
+	if token, err = a.getToken(req.Context(), next, token); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("failed to rewind request body; %w", err)
+		}
+	}
+	return a.send(retry, next, token)
+}
+
+func (a *jwtAuth) send(req *http.Request, next http.RoundTripper, token string) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return next.RoundTrip(req)
+}
+
+// getToken returns the cached token unless it is the stale one that was just rejected.
+func (a *jwtAuth) getToken(ctx context.Context, next http.RoundTripper, stale string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && a.token != stale {
+		return a.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.tokenURL, http.NoBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to create jwt request; %w", err)
+	}
+	// the token request is authenticated with the credentials, which are read again if pfsense rejects them
+	res, err := basicAuth(a.credentials)(req, next)
+	if err != nil {
+		return "", fmt.Errorf("failed to request jwt; %w", err)
+	}
+	defer res.Body.Close()
+	var out restResponse[struct {
+		Token string `json:"token"`
+	}]
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("failed to decode jwt response with status %d; %w", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK || out.Data.Token == "" {
+		return "", &PfsenseError{Kind: ErrorKindAuth, Op: "POST /auth/jwt", StatusCode: res.StatusCode, Err: errors.New("pfsense did not issue a jwt: " + out.Message)}
+	}
+	a.token = out.Data.Token
+	return a.token, nil
+}
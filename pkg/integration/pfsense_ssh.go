@@ -0,0 +1,176 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	pfsensePHP = "/usr/local/bin/php"
+
+	// the scripts are passed to php -r in single quotes, so they must not contain any
+	pfsenseBackupSectionScript  = `require_once("config.inc"); echo json_encode((object) config_get_path($argv[1], []));`
+	pfsenseRestoreSectionScript = `require_once("config.inc"); require_once("filter.inc");` +
+		` $data = json_decode(file_get_contents("php://stdin"), true);` +
+		` if (!is_array($data)) { fwrite(STDERR, "section is not a json object"); exit(1); }` +
+		` config_set_path($argv[1], $data);` +
+		` write_config("pfsense-k8s-lb-controller restored section " . $argv[1]);` +
+		` filter_configure(); echo "ok";`
+)
+
+// PfsenseSSHClient manages pfSense over ssh for firewalls that have XML-RPC disabled.
+// Every call opens its own connection, the same way every XML-RPC call is a separate request.
+type PfsenseSSHClient struct {
+	address  string
+	config   *ssh.ClientConfig
+	timeouts PfsenseTimeouts
+	guard    *CallGuard
+}
+
+// CreatePfsenseSSHClient authenticates with the private key and accepts only the pinned host key,
+// which is expected in the authorized_keys format, e.g. "ssh-ed25519 AAAA...".
+func CreatePfsenseSSHClient(address string, username string, privateKey []byte, hostKey string, timeouts PfsenseTimeouts, guard *CallGuard) (*PfsenseSSHClient, error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh private key; %w", err)
+	}
+	pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh host key; %w", err)
+	}
+	return &PfsenseSSHClient{
+		address: address,
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.FixedHostKey(pinned),
+		},
+		timeouts: timeouts,
+		guard:    guard,
+	}, nil
+}
+
+// BackupSection decodes the config section into out.
+func (c *PfsenseSSHClient) BackupSection(ctx context.Context, section string, out any) error {
+	res, err := c.run(ctx, callRead, "backup "+section, phpCommand(pfsenseBackupSectionScript, section), nil)
+	if err != nil {
+		return fmt.Errorf("failed to backup section %s; %w", section, err)
+	}
+	if err := json.Unmarshal(res, out); err != nil {
+		return fmt.Errorf("failed to decode section %s; %w", section, err)
+	}
+	return nil
+}
+
+// ConfigRevision identifies the config version like the one of the XML-RPC client.
+func (c *PfsenseSSHClient) ConfigRevision(ctx context.Context) (string, error) {
+	var revision configRevision
+	if err := c.BackupSection(ctx, "revision", &revision); err != nil {
+		return "", err
+	}
+	return revision.String(), nil
+}
+
+// RestoreSection replaces the config section with data and reloads the filter.
+func (c *PfsenseSSHClient) RestoreSection(ctx context.Context, section string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal section %s; %w", section, err)
+	}
+	res, err := c.run(ctx, callReplace, "restore "+section, phpCommand(pfsenseRestoreSectionScript, section), b)
+	if err != nil {
+		return fmt.Errorf("failed to restore section %s; %w", section, err)
+	}
+	if strings.TrimSpace(string(res)) != "ok" {
+		return fmt.Errorf("unexpected output of section %s restore: %s", section, res)
+	}
+	return nil
+}
+
+func PfsenseSSHHealthCheck(client *PfsenseSSHClient) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		if _, err := client.run(req.Context(), callHealth, "version", "cat /etc/version", nil); err != nil {
+			return fmt.Errorf("failed to make ssh call; %w", err)
+		}
+		return nil
+	}
+}
+
+func phpCommand(script string, args ...string) string {
+	return pfsensePHP + " -r '" + script + "' -- " + strings.Join(args, " ")
+}
+
+func (c *PfsenseSSHClient) run(ctx context.Context, kind callKind, op string, cmd string, stdin []byte) ([]byte, error) {
+	var out []byte
+	err := c.guard.do(ctx, kind, func(ctx context.Context) error {
+		var err error
+		out, err = c.runOnce(ctx, c.timeouts.of(kind), cmd, stdin)
+		return classifySSHError(op, err)
+	})
+	return out, err
+}
+
+func (c *PfsenseSSHClient) runOnce(ctx context.Context, timeout time.Duration, cmd string, stdin []byte) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s; %w", c.address, err)
+	}
+	// the ssh package is not context aware, so closing the connection is the only way to interrupt it
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.address, c.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to establish ssh connection; %w", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh session; %w", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = bytes.NewReader(stdin)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		// an interrupted session only reports a closed connection, so the context error is attached
+		return nil, fmt.Errorf("remote command failed: %s; %w", strings.TrimSpace(stderr.String()), errors.Join(err, ctx.Err()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func classifySSHError(op string, err error) error {
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr):
+		// the command ran, so pfsense is reachable but refused the change
+		return &PfsenseError{Kind: ErrorKindRejected, Op: op, Err: err}
+	case strings.Contains(err.Error(), "unable to authenticate") || strings.Contains(err.Error(), "host key mismatch"):
+		// the ssh package does not export these errors
+		return &PfsenseError{Kind: ErrorKindAuth, Op: op, Err: err}
+	default:
+		return classifyError(op, 0, err)
+	}
+}
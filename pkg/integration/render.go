@@ -0,0 +1,162 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// RenderSink keeps rendered pfsense config fragments, keyed by file name,
+// for an external review process to apply instead of the controller.
+type RenderSink interface {
+	// Read returns nil if the fragment was never written.
+	Read(ctx context.Context, name string) ([]byte, error)
+	Write(ctx context.Context, fragments map[string][]byte) error
+}
+
+type FileSink struct {
+	dir string
+}
+
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{dir: dir}
+}
+
+func (s *FileSink) Read(_ context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s; %w", name, err)
+	}
+	return data, nil
+}
+
+func (s *FileSink) Write(_ context.Context, fragments map[string][]byte) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s; %w", s.dir, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(fragments)) {
+		// write to a temporary file first so readers never see a partially written fragment
+		tmp, err := os.CreateTemp(s.dir, "."+name+"-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary file for %s; %w", name, err)
+		}
+		_, err = tmp.Write(fragments[name])
+		err = errors.Join(err, tmp.Close())
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+			return fmt.Errorf("failed to write %s; %w", name, err)
+		}
+	}
+	return nil
+}
+
+// GitSink writes the fragments into a directory of a git working tree and commits them;
+// pushing and reviewing the commits is left to the external process.
+type GitSink struct {
+	FileSink
+	authorName  string
+	authorEmail string
+}
+
+func NewGitSink(dir string, authorName string, authorEmail string) *GitSink {
+	return &GitSink{FileSink: FileSink{dir: dir}, authorName: authorName, authorEmail: authorEmail}
+}
+
+func (s *GitSink) Write(ctx context.Context, fragments map[string][]byte) error {
+	if err := s.FileSink.Write(ctx, fragments); err != nil {
+		return err
+	}
+	names := slices.Sorted(maps.Keys(fragments))
+	if _, err := s.git(ctx, append([]string{"add", "--"}, names...)...); err != nil {
+		return err
+	}
+	if _, err := s.git(ctx, append([]string{"diff", "--cached", "--quiet", "--"}, names...)...); err == nil {
+		// nothing has changed since the last commit
+		return nil
+	}
+	msg := "Update pfsense config fragments " + strings.Join(names, ", ")
+	if _, err := s.git(ctx, append([]string{"commit", "-m", msg, "--"}, names...)...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *GitSink) git(ctx context.Context, args ...string) ([]byte, error) {
+	global := []string{"-C", s.dir, "-c", "user.name=" + s.authorName, "-c", "user.email=" + s.authorEmail}
+	out, err := exec.CommandContext(ctx, "git", append(global, args...)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %s; %w", args[0], strings.TrimSpace(string(out)), err)
+	}
+	return out, nil
+}
+
+// ConfigMapSink stores every fragment as a key of a single config map.
+type ConfigMapSink struct {
+	k8s client.Client
+	key types.NamespacedName
+}
+
+func NewConfigMapSink(k8s client.Client, namespace string, name string) *ConfigMapSink {
+	return &ConfigMapSink{k8s: k8s, key: types.NamespacedName{Namespace: namespace, Name: name}}
+}
+
+func (s *ConfigMapSink) Read(ctx context.Context, name string) ([]byte, error) {
+	cm := &corev1.ConfigMap{}
+	if err := s.k8s.Get(ctx, s.key, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get config map %s; %w", s.key, err)
+	}
+	data, ok := cm.Data[name]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(data), nil
+}
+
+func (s *ConfigMapSink) Write(ctx context.Context, fragments map[string][]byte) error {
+	cm := &corev1.ConfigMap{}
+	cm.Namespace, cm.Name = s.key.Namespace, s.key.Name
+	_, err := controllerutil.CreateOrPatch(ctx, s.k8s, cm, func() error {
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		for name, data := range fragments {
+			cm.Data[name] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save config map %s; %w", s.key, err)
+	}
+	return nil
+}
+
+func RenderSinkHealthCheck(sink RenderSink, name string) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		if _, err := sink.Read(req.Context(), name); err != nil {
+			return fmt.Errorf("failed to read rendered fragment; %w", err)
+		}
+		return nil
+	}
+}
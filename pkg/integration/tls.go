@@ -0,0 +1,167 @@
+package integration
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions configures the https connection to the firewall.
+// The CA bundle and the client key pair are re-read when the files change, so they can be rotated without a restart.
+type TLSOptions struct {
+	Insecure bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used for SNI and certificate verification
+	ServerName string
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3"; empty means 1.2
+	MinVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig builds the config for connections to host, which is verified unless ServerName overrides it.
+func NewTLSConfig(opts TLSOptions, host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+		//nolint:gosec
+		InsecureSkipVerify: opts.Insecure,
+	}
+	if opts.MinVersion != "" {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", opts.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		keyPair := newFileReloader(func() (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+			return &cert, err
+		}, opts.CertFile, opts.KeyFile)
+		if _, err := keyPair.get(); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate; %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return keyPair.get()
+		}
+	}
+
+	if opts.CAFile != "" && !opts.Insecure {
+		roots := newFileReloader(func() (*x509.CertPool, error) {
+			data, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, errors.New("no certificates found in " + opts.CAFile)
+			}
+			return pool, nil
+		}, opts.CAFile)
+		if _, err := roots.get(); err != nil {
+			return nil, fmt.Errorf("failed to load ca bundle; %w", err)
+		}
+		// the standard verification takes a fixed pool, so it is replaced by one that reads the current bundle
+		serverName := cmp.Or(opts.ServerName, host)
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPeer(cs, serverName, roots)
+		}
+	}
+	return cfg, nil
+}
+
+func verifyPeer(cs tls.ConnectionState, serverName string, roots *fileReloader[*x509.CertPool]) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	pool, err := roots.get()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		// the connection state has no server name for ip addresses, so the expected name is passed explicitly
+		DNSName:       serverName,
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify server certificate; %w", err)
+	}
+	return nil
+}
+
+// fileReloader caches a value loaded from files and loads it again once any of the files is modified.
+// A failed reload keeps the previous value, as rotation tools often replace the files one by one.
+type fileReloader[T any] struct {
+	load  func() (T, error)
+	paths []string
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	value    T
+	loaded   bool
+}
+
+func newFileReloader[T any](load func() (T, error), paths ...string) *fileReloader[T] {
+	return &fileReloader[T]{load: load, paths: paths, modTimes: make([]time.Time, len(paths))}
+}
+
+// invalidate makes the next get load the files even if they were not modified.
+func (r *fileReloader[T]) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTimes = make([]time.Time, len(r.paths))
+}
+
+func (r *fileReloader[T]) get() (T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := make([]time.Time, len(r.paths))
+	changed := !r.loaded
+	for i, path := range r.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if r.loaded {
+				return r.value, nil
+			}
+			return r.value, fmt.Errorf("failed to stat %s; %w", path, err)
+		}
+		modTimes[i] = info.ModTime()
+		changed = changed || !modTimes[i].Equal(r.modTimes[i])
+	}
+	if !changed {
+		return r.value, nil
+	}
+
+	value, err := r.load()
+	if err != nil {
+		if r.loaded {
+			slog.Warn("failed to reload file, keeping the previous content", "paths", r.paths, "error", err)
+			return r.value, nil
+		}
+		return value, err
+	}
+	r.value, r.modTimes, r.loaded = value, modTimes, true
+	return r.value, nil
+}
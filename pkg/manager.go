@@ -5,89 +5,211 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/url"
+	"os"
+	"time"
 
-	"alexejk.io/go-xmlrpc"
 	"github.com/go-logr/logr"
+	"github.com/slamdev/pfsense-k8s-lb-controller/api/v1alpha1"
 	"github.com/slamdev/pfsense-k8s-lb-controller/configs"
 	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/business"
 	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 )
 
+//go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen@v0.19.0 rbac:roleName=pfsense-k8s-lb-controller paths=./... output:rbac:dir=../config/rbac
+
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups="",resources=services/status,verbs=patch
+// +kubebuilder:rbac:groups="",resources=services/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;patch
+// +kubebuilder:rbac:groups=pfsense.slamdev.net,resources=loadbalancerallocations,verbs=get;list;watch;create;patch;delete
+// +kubebuilder:rbac:groups=pfsense.slamdev.net,resources=loadbalancerallocations/status,verbs=patch
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;create;patch
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingadmissionpolicies;validatingadmissionpolicybindings,verbs=get
+
 func NewManager() (ctrl.Manager, error) {
 	var appConfig configs.Config
 	if err := integration.BuildConfig("APP_", "application", configs.Configs, &appConfig); err != nil {
 		return nil, fmt.Errorf("failed to populate config; %w", err)
 	}
 
+	switch appConfig.Controller.OutOfPool.Policy {
+	case configs.OutOfPoolPolicyFlag, configs.OutOfPoolPolicyMigrate:
+	default:
+		return nil, fmt.Errorf("unknown out of pool policy %q", appConfig.Controller.OutOfPool.Policy)
+	}
+
 	runnableTelemetry, err := configureTelemetry(context.Background(), appConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure telemetry; %w", err)
 	}
 
-	pfsenseClient, err := configurePfsenseClient(appConfig)
+	kubecfg, err := config.GetConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to configure pfsense client; %w", err)
+		return nil, fmt.Errorf("unable to get kubeconfig: %w", err)
 	}
-	pfsenseService := business.NewPfsenseService(pfsenseClient, appConfig.Controller.DryRun, appConfig.Controller.Subnet, appConfig.Controller.Exclusions...)
 
-	kubecfg, err := config.GetConfig()
+	targetConfigs, err := appConfig.PfsenseTargets()
 	if err != nil {
-		return nil, fmt.Errorf("unable to get kubeconfig: %w", err)
+		return nil, fmt.Errorf("failed to configure pfsense targets; %w", err)
+	}
+	defaultTarget := appConfig.Pfsense.DefaultTarget
+	if len(targetConfigs) == 1 {
+		defaultTarget = targetConfigs[0].Name
+	}
+	pfsenseTargets := make([]business.PfsenseTarget, 0, len(targetConfigs))
+	readyzChecks := map[string]healthz.Checker{}
+	var healthMonitors []*integration.HealthMonitor
+	// the xml-rpc services run their writer until the manager stops
+	var writers []manager.Runnable
+	var snapshots *business.SnapshotHistory
+	if appConfig.Controller.Rollback.Enabled {
+		snapshots = business.NewSnapshotHistory(appConfig.Controller.Rollback.History)
+	}
+	for _, targetConfig := range targetConfigs {
+		// every target has its own circuit breaker, so one firewall being down does not block the others
+		retryConfig, breakerConfig := targetConfig.Retry, targetConfig.CircuitBreaker
+		guard := integration.NewCallGuard(targetConfig.Name, retryConfig.Attempts, retryConfig.Backoff, retryConfig.MaxBackoff, breakerConfig.FailureThreshold, breakerConfig.OpenDuration)
+		pfsenseService, pfsenseHealthProbe, err := configurePfsense(targetConfig, appConfig.Controller, kubecfg, guard)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure pfsense target %s; %w", targetConfig.Name, err)
+		}
+		if snapshots != nil {
+			// a target that cannot roll back must not look protected
+			if pfsenseService, err = business.WithRollback(pfsenseService, targetConfig.Name, snapshots); err != nil {
+				return nil, fmt.Errorf("failed to enable rollback of pfsense target %s; %w", targetConfig.Name, err)
+			}
+		}
+		pfsenseTargets = append(pfsenseTargets, business.PfsenseTarget{Name: targetConfig.Name, Service: pfsenseService})
+		if writer, ok := pfsenseService.(manager.Runnable); ok {
+			writers = append(writers, writer)
+		}
+		checkName := "pfsense"
+		if targetConfig.Name != configs.DefaultPfsenseTarget {
+			checkName += "-" + targetConfig.Name
+		}
+		healthConfig := targetConfig.Health
+		if healthConfig.Interval <= 0 {
+			return nil, fmt.Errorf("health check interval of pfsense target %s must be positive", targetConfig.Name)
+		}
+		monitor := integration.NewHealthMonitor(targetConfig.Name, pfsenseHealthProbe, healthConfig.Interval, healthConfig.FailureThreshold, healthConfig.Degraded)
+		healthMonitors = append(healthMonitors, monitor)
+		// the monitor probes past the circuit breaker, so a transient trip does not make the target unready, an outage
+		// does once it fails the threshold of checks in a row
+		readyzChecks[checkName] = monitor.Check
 	}
 
 	ctrl.SetLogger(logr.FromSlogHandler(slog.Default().Handler()))
 
-	healthProbeBindAddress := ""
-	if appConfig.Telemetry.Health.Enabled {
-		healthProbeBindAddress = appConfig.Telemetry.Health.BindAddress
+	scheme := runtime.NewScheme()
+	if err := buildScheme(scheme); err != nil {
+		return nil, fmt.Errorf("unable to build scheme: %w", err)
 	}
 
-	metricsBindAddress := ""
-	if appConfig.Telemetry.Metrics.Enabled {
-		metricsBindAddress = appConfig.Telemetry.Metrics.BindAddress
+	cacheOptions, err := serviceCacheOptions(appConfig.Controller)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure cache: %w", err)
 	}
 
-	mgr, err := ctrl.NewManager(kubecfg, manager.Options{
-		HealthProbeBindAddress: healthProbeBindAddress,
-		Metrics: metricsserver.Options{
-			BindAddress: metricsBindAddress,
-		},
-	})
+	mgr, err := ctrl.NewManager(kubecfg, managerOptions(appConfig, scheme, cacheOptions))
 	if err != nil {
 		return nil, fmt.Errorf("unable to set up overall controller manager: %w", err)
 	}
 
-	if err := mgr.Add(runnableTelemetry); err != nil {
+	if appConfig.Controller.Approval.Required {
+		// the approval is only as good as the policy that ties the approver to who set the annotation
+		if err := business.CheckApprovalPolicy(context.Background(), mgr.GetAPIReader()); err != nil {
+			return nil, fmt.Errorf("approval is required, but the approval admission policy is not installed: %w", err)
+		}
+	}
+
+	if appConfig.Controller.InstallCRDs {
+		// the crds are applied on every replica once the manager runs; the controller waits until they are served
+		if err := mgr.Add(nonLeaderRunnable{installCRDs(mgr.GetClient())}); err != nil {
+			return nil, fmt.Errorf("unable to set up crd installation in controller manager: %w", err)
+		}
+	}
+
+	// telemetry has to run on every replica, not only on the leader
+	if err := mgr.Add(nonLeaderRunnable{runnableTelemetry}); err != nil {
 		return nil, fmt.Errorf("unable to set up telemetry in controller manager: %w", err)
 	}
 
-	if err := mgr.AddReadyzCheck("pfsense", integration.PfsenseHealthCheck(pfsenseClient)); err != nil {
-		return nil, fmt.Errorf("unable to set up pfsense health check in controller manager: %w", err)
+	if snapshots != nil && appConfig.Controller.Rollback.ServeSnapshots && appConfig.Telemetry.Metrics.Enabled {
+		if err := mgr.AddMetricsServerExtraHandler("/snapshots", snapshots); err != nil {
+			return nil, fmt.Errorf("unable to serve pfsense snapshots: %w", err)
+		}
+	}
+
+	for _, monitor := range healthMonitors {
+		if err := mgr.Add(monitor); err != nil {
+			return nil, fmt.Errorf("unable to set up pfsense health monitor in controller manager: %w", err)
+		}
+	}
+	for _, writer := range writers {
+		if err := mgr.Add(writer); err != nil {
+			return nil, fmt.Errorf("unable to set up pfsense writer in controller manager: %w", err)
+		}
+	}
+	for name, check := range readyzChecks {
+		if err := mgr.AddReadyzCheck(name, check); err != nil {
+			return nil, fmt.Errorf("unable to set up %s check in controller manager: %w", name, err)
+		}
 	}
 	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
 		return nil, fmt.Errorf("unable to set up health check in controller manager: %w", err)
 	}
 
+	maintenanceWindows, err := parseMaintenanceWindows(appConfig.Controller)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure maintenance windows: %w", err)
+	}
+
 	reconciler := business.NewReconciler(
-		mgr.GetClient(), pfsenseService,
+		mgr.GetClient(), pfsenseTargets, defaultTarget,
 		appConfig.Controller.LoadBalancerClass,
 		appConfig.Controller.FinalizerName,
 		appConfig.Controller.PortsHashAnnotation,
+		business.OutOfPoolPolicy(appConfig.Controller.OutOfPool.Policy),
+		appConfig.Controller.OutOfPool.Overlap,
+		maintenanceWindows,
+		appConfig.Controller.Approval.Required,
 	)
 
-	err = ctrl.
+	controllerBuilder := ctrl.
 		NewControllerManagedBy(mgr).
 		Named("app").
-		For(&corev1.Service{}).
-		Complete(reconciler)
-	if err != nil {
+		For(&corev1.Service{}, builder.WithPredicates(business.ServicePredicate(appConfig.Controller.LoadBalancerClass, appConfig.Controller.FinalizerName))).
+		Owns(&v1alpha1.LoadBalancerAllocation{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: appConfig.Controller.MaxConcurrentReconciles})
+	if interval := appConfig.Controller.ConfigWatch.Interval; interval > 0 {
+		watcher := business.NewConfigWatcher(mgr.GetClient(), pfsenseTargets, appConfig.Controller.LoadBalancerClass, appConfig.Controller.FinalizerName, interval)
+		if err := mgr.Add(watcher); err != nil {
+			return nil, fmt.Errorf("unable to set up pfsense config watcher in controller manager: %w", err)
+		}
+		controllerBuilder = controllerBuilder.WatchesRawSource(watcher.Source())
+	}
+	if err := controllerBuilder.Complete(reconciler); err != nil {
 		return nil, fmt.Errorf("unable to create controller: %w", err)
 	}
 
@@ -112,11 +234,279 @@ func configureTelemetry(ctx context.Context, appConfig configs.Config) (manager.
 	return r, nil
 }
 
-func configurePfsenseClient(appConfig configs.Config) (*xmlrpc.Client, error) {
-	pfsenseURL := url.URL(appConfig.Pfsense.URL)
-	pfsenseClient, err := integration.CreatePfsenseClient(pfsenseURL.String(), appConfig.Pfsense.Username, appConfig.Pfsense.Password, appConfig.Pfsense.Insecure)
+func buildScheme(scheme *runtime.Scheme) error {
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return fmt.Errorf("failed to add client-go types; %w", err)
+	}
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		return fmt.Errorf("failed to add apiextensions types; %w", err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return fmt.Errorf("failed to add controller types; %w", err)
+	}
+	return nil
+}
+
+func installCRDs(k8s client.Client) manager.RunnableFunc {
+	return func(ctx context.Context) error {
+		if err := integration.InstallCRDs(ctx, k8s, "pfsense-k8s-lb-controller", v1alpha1.CRDs); err != nil {
+			return fmt.Errorf("failed to install crds; %w", err)
+		}
+		return nil
+	}
+}
+
+// managerOptions serve health and metrics only when they are enabled and elect a leader with the configured lease
+func managerOptions(appConfig configs.Config, scheme *runtime.Scheme, cacheOptions cache.Options) manager.Options {
+	healthProbeBindAddress := ""
+	if appConfig.Telemetry.Health.Enabled {
+		healthProbeBindAddress = appConfig.Telemetry.Health.BindAddress
+	}
+
+	metricsBindAddress := ""
+	if appConfig.Telemetry.Metrics.Enabled {
+		metricsBindAddress = appConfig.Telemetry.Metrics.BindAddress
+	}
+
+	return manager.Options{
+		Scheme:                 scheme,
+		Cache:                  cacheOptions,
+		HealthProbeBindAddress: healthProbeBindAddress,
+		Metrics: metricsserver.Options{
+			BindAddress: metricsBindAddress,
+		},
+		LeaderElection:                appConfig.LeaderElection.Enabled,
+		LeaderElectionNamespace:       appConfig.LeaderElection.Namespace,
+		LeaderElectionID:              appConfig.LeaderElection.ID,
+		LeaseDuration:                 durationOrNil(appConfig.LeaderElection.LeaseDuration),
+		RenewDeadline:                 durationOrNil(appConfig.LeaderElection.RenewDeadline),
+		RetryPeriod:                   durationOrNil(appConfig.LeaderElection.RetryPeriod),
+		LeaderElectionReleaseOnCancel: true,
+	}
+}
+
+// nonLeaderRunnable is started on every replica regardless of the leader election result.
+type nonLeaderRunnable struct {
+	manager.RunnableFunc
+}
+
+func (nonLeaderRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+// serviceCacheOptions keep only the watched services in the cache, without the fields the controller does not read
+func serviceCacheOptions(ctrlConfig configs.Controller) (cache.Options, error) {
+	serviceCache := cache.ByObject{Transform: business.ServiceTransform(ctrlConfig.PortsHashAnnotation)}
+	if ctrlConfig.Watch.LabelSelector != "" {
+		selector, err := labels.Parse(ctrlConfig.Watch.LabelSelector)
+		if err != nil {
+			return cache.Options{}, fmt.Errorf("failed to parse label selector; %w", err)
+		}
+		serviceCache.Label = selector
+	}
+	options := cache.Options{
+		DefaultTransform: cache.TransformStripManagedFields(),
+		ByObject:         map[client.Object]cache.ByObject{&corev1.Service{}: serviceCache},
+	}
+	if len(ctrlConfig.Watch.Namespaces) > 0 {
+		options.DefaultNamespaces = map[string]cache.Config{}
+		for _, namespace := range ctrlConfig.Watch.Namespaces {
+			options.DefaultNamespaces[namespace] = cache.Config{}
+		}
+	}
+	return options, nil
+}
+
+func parseMaintenanceWindows(ctrlConfig configs.Controller) ([]integration.MaintenanceWindow, error) {
+	location, err := time.LoadLocation(ctrlConfig.Maintenance.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load time zone; %w", err)
+	}
+	windows := make([]integration.MaintenanceWindow, 0, len(ctrlConfig.Maintenance.Windows))
+	for _, w := range ctrlConfig.Maintenance.Windows {
+		window, err := integration.ParseMaintenanceWindow(w.Schedule, w.Duration, location)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func durationOrNil(d time.Duration) *time.Duration {
+	if d == 0 {
+		return nil
+	}
+	return &d
+}
+
+// configurePfsense creates the pfsense service with its health check for the configured backend of the target
+func configurePfsense(target configs.PfsenseTarget, ctrlConfig configs.Controller, kubecfg *rest.Config, guard *integration.CallGuard) (business.PfsenseService, integration.HealthProbe, error) {
+	pfsenseURL := url.URL(target.URL)
+	subnet, exclusions := target.Pool.Subnet, target.Pool.Exclusions
+
+	carpConfig := target.Pool.CARP
+	ha := carpConfig.VHID > 0 || target.HA.Sync || target.HA.SecondaryURL.Host != ""
+	switch target.Mutations {
+	case configs.PfsenseMutationsSections, configs.PfsenseMutationsPHP, "":
+	default:
+		return nil, nil, fmt.Errorf("unknown pfsense mutations %q", target.Mutations)
+	}
+	php := target.Mutations == configs.PfsenseMutationsPHP
+	// rendered fragments hold ip alias rather than carp virtual IPs, and nothing runs php against them
+	if ha && target.Render.Target != "" {
+		return nil, nil, fmt.Errorf("render target %q does not support carp pairs, unset pool.carp.vhid and ha", target.Render.Target)
+	}
+	if php && target.Render.Target != "" {
+		return nil, nil, fmt.Errorf("render target %q does not support php mutations", target.Render.Target)
+	}
+	if ha && target.Backend == configs.PfsenseBackendSSH {
+		return nil, nil, fmt.Errorf("pfsense backend %q manages no virtual IPs and does not support carp pairs, unset pool.carp.vhid and ha", target.Backend)
+	}
+	if ha && target.Backend != configs.PfsenseBackendXMLRPC && target.Backend != "" {
+		return nil, nil, fmt.Errorf("pfsense backend %q does not support carp pairs", target.Backend)
+	}
+	if php && target.Backend != configs.PfsenseBackendXMLRPC && target.Backend != "" {
+		return nil, nil, fmt.Errorf("pfsense backend %q does not support php mutations", target.Backend)
+	}
+
+	if target.Render.Target != "" {
+		sink, err := configureRenderSink(target.Pfsense, kubecfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to configure render sink; %w", err)
+		}
+		svc := business.NewPfsenseRenderService(sink, ctrlConfig.DryRun, target.WriteBatchWindow, subnet, exclusions...)
+		return svc, integration.CheckerProbe(integration.RenderSinkHealthCheck(sink, business.NATFragment)), nil
+	}
+
+	credentials, err := pfsenseCredentials(target.Pfsense, kubecfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pfsense client; %w", err)
+		return nil, nil, fmt.Errorf("failed to configure pfsense credentials; %w", err)
+	}
+
+	switch target.Backend {
+	case configs.PfsenseBackendXMLRPC, "":
+		pfsenseClient, err := integration.CreatePfsenseClient(pfsenseURL.String(), credentials, pfsenseTLSOptions(target.Pfsense), target.Timeouts, guard)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create pfsense client; %w", err)
+		}
+		if !ha && !php {
+			pfsenseClient = cachedPfsenseClient(pfsenseClient, target)
+			svc := business.NewPfsenseService(pfsenseClient, ctrlConfig.DryRun, target.WriteBatchWindow, subnet, exclusions...)
+			return svc, integration.PfsenseHealthProbe(pfsenseClient), nil
+		}
+		if target.HA.SecondaryURL.Host != "" {
+			// the secondary has its own circuit breaker, which stays closed while the primary is down
+			retryConfig, breakerConfig := target.Retry, target.CircuitBreaker
+			secondaryGuard := integration.NewCallGuard(target.Name+"-secondary", retryConfig.Attempts, retryConfig.Backoff, retryConfig.MaxBackoff, breakerConfig.FailureThreshold, breakerConfig.OpenDuration)
+			secondaryURL := url.URL(target.HA.SecondaryURL)
+			secondaryClient, err := integration.CreatePfsenseClient(secondaryURL.String(), credentials, pfsenseTLSOptions(target.Pfsense), target.Timeouts, secondaryGuard)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create secondary pfsense client; %w", err)
+			}
+			pfsenseClient = integration.NewPfsenseHAClient(pfsenseClient, secondaryClient)
+		}
+		pfsenseClient = cachedPfsenseClient(pfsenseClient, target)
+		carp := business.CARPConfig{
+			Interface: carpConfig.Interface,
+			VHID:      carpConfig.VHID,
+			AdvSkew:   carpConfig.AdvSkew,
+			AdvBase:   carpConfig.AdvBase,
+			Password:  carpConfig.Password,
+		}
+		if php {
+			svc := business.NewPfsensePHPService(pfsenseClient, carp, target.HA.Sync, ctrlConfig.DryRun, target.WriteBatchWindow, subnet, exclusions...)
+			return svc, integration.PfsenseHealthProbe(pfsenseClient), nil
+		}
+		svc := business.NewPfsenseHAService(pfsenseClient, carp, target.HA.Sync, ctrlConfig.DryRun, target.WriteBatchWindow, subnet, exclusions...)
+		return svc, integration.PfsenseHealthProbe(pfsenseClient), nil
+	case configs.PfsenseBackendREST:
+		pfsenseClient, err := integration.CreatePfsenseRESTClient(pfsenseURL.String(), target.APIKey, credentials, pfsenseTLSOptions(target.Pfsense), target.Timeouts, guard)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create pfsense rest client; %w", err)
+		}
+		svc := business.NewPfsenseRESTService(pfsenseClient, ctrlConfig.DryRun, subnet, exclusions...)
+		return svc, integration.CheckerProbe(integration.PfsenseRESTHealthCheck(pfsenseClient)), nil
+	case configs.PfsenseBackendOPNsense:
+		opnsenseClient, err := integration.CreateOPNsenseClient(pfsenseURL.String(), target.APIKey, target.APISecret, pfsenseTLSOptions(target.Pfsense), target.Timeouts, guard)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create opnsense client; %w", err)
+		}
+		svc := business.NewOPNsenseService(opnsenseClient, ctrlConfig.DryRun, subnet, exclusions...)
+		return svc, integration.CheckerProbe(integration.OPNsenseHealthCheck(opnsenseClient)), nil
+	case configs.PfsenseBackendSSH:
+		sshConfig := target.SSH
+		address := sshConfig.Address
+		if address == "" {
+			address = net.JoinHostPort(pfsenseURL.Hostname(), "22")
+		}
+		privateKey, err := os.ReadFile(sshConfig.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read ssh private key; %w", err)
+		}
+		pfsenseClient, err := integration.CreatePfsenseSSHClient(address, target.Username, privateKey, sshConfig.HostKey, target.Timeouts, guard)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create pfsense ssh client; %w", err)
+		}
+		svc := business.NewPfsenseSSHService(pfsenseClient, ctrlConfig.DryRun, target.WriteBatchWindow, subnet, exclusions...)
+		return svc, integration.CheckerProbe(integration.PfsenseSSHHealthCheck(pfsenseClient)), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown pfsense backend %q", target.Backend)
+	}
+}
+
+func cachedPfsenseClient(client *integration.PfsenseClient, target configs.PfsenseTarget) *integration.PfsenseClient {
+	if !target.Cache.Enabled {
+		return client
+	}
+	return integration.NewPfsenseCachedClient(client, target.Name, target.Cache.HealthMaxAge)
+}
+
+func pfsenseCredentials(pfsenseConfig configs.Pfsense, kubecfg *rest.Config) (integration.CredentialSource, error) {
+	credentialsConfig := pfsenseConfig.Credentials
+	switch {
+	case credentialsConfig.Secret.Name != "":
+		// the secret is read directly so the manager cache does not have to watch secrets
+		k8s, err := client.New(kubecfg, client.Options{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client; %w", err)
+		}
+		secret := credentialsConfig.Secret
+		return integration.NewSecretCredentials(k8s, secret.Namespace, secret.Name, secret.UsernameKey, secret.PasswordKey, secret.RefreshInterval), nil
+	case credentialsConfig.UsernameFile != "" || credentialsConfig.PasswordFile != "":
+		return integration.NewFileCredentials(credentialsConfig.UsernameFile, credentialsConfig.PasswordFile)
+	default:
+		return integration.StaticCredentials{Username: pfsenseConfig.Username, Password: pfsenseConfig.Password}, nil
+	}
+}
+
+func pfsenseTLSOptions(pfsenseConfig configs.Pfsense) integration.TLSOptions {
+	tlsConfig := pfsenseConfig.TLS
+	return integration.TLSOptions{
+		Insecure:   pfsenseConfig.Insecure,
+		CAFile:     tlsConfig.CAFile,
+		CertFile:   tlsConfig.CertFile,
+		KeyFile:    tlsConfig.KeyFile,
+		ServerName: tlsConfig.ServerName,
+		MinVersion: tlsConfig.MinVersion,
+	}
+}
+
+func configureRenderSink(pfsenseConfig configs.Pfsense, kubecfg *rest.Config) (integration.RenderSink, error) {
+	renderConfig := pfsenseConfig.Render
+	switch renderConfig.Target {
+	case configs.RenderTargetFile:
+		return integration.NewFileSink(renderConfig.Dir), nil
+	case configs.RenderTargetGit:
+		return integration.NewGitSink(renderConfig.Dir, renderConfig.Git.AuthorName, renderConfig.Git.AuthorEmail), nil
+	case configs.RenderTargetConfigMap:
+		// the config map is read and written directly so the manager cache does not have to watch config maps
+		k8s, err := client.New(kubecfg, client.Options{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client; %w", err)
+		}
+		return integration.NewConfigMapSink(k8s, renderConfig.ConfigMap.Namespace, renderConfig.ConfigMap.Name), nil
+	default:
+		return nil, fmt.Errorf("unknown render target %q", renderConfig.Target)
 	}
-	return pfsenseClient, nil
 }
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/slamdev/pfsense-k8s-lb-controller/configs"
+	"github.com/slamdev/pfsense-k8s-lb-controller/pkg/integration"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func Test_should_map_leader_election_config_to_manager_options(t *testing.T) {
+	t.Parallel()
+
+	var appConfig configs.Config
+	appConfig.LeaderElection = configs.LeaderElection{
+		Enabled:       true,
+		Namespace:     "pfsense",
+		ID:            "pfsense-k8s-lb-controller.slamdev.net",
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+
+	options := managerOptions(appConfig, runtime.NewScheme(), cache.Options{})
+	require.True(t, options.LeaderElection)
+	require.Equal(t, "pfsense", options.LeaderElectionNamespace)
+	require.Equal(t, "pfsense-k8s-lb-controller.slamdev.net", options.LeaderElectionID)
+	require.Equal(t, 15*time.Second, *options.LeaseDuration)
+	require.Equal(t, 10*time.Second, *options.RenewDeadline)
+	require.Equal(t, 2*time.Second, *options.RetryPeriod)
+	require.True(t, options.LeaderElectionReleaseOnCancel)
+
+	// durations that are not set keep the defaults of controller-runtime
+	appConfig.LeaderElection = configs.LeaderElection{}
+	options = managerOptions(appConfig, runtime.NewScheme(), cache.Options{})
+	require.False(t, options.LeaderElection)
+	require.Nil(t, options.LeaseDuration)
+	require.Nil(t, options.RenewDeadline)
+	require.Nil(t, options.RetryPeriod)
+}
+
+func Test_should_serve_health_and_metrics_only_when_enabled(t *testing.T) {
+	t.Parallel()
+
+	var appConfig configs.Config
+	appConfig.Telemetry.Health.BindAddress = ":8181"
+	appConfig.Telemetry.Metrics.BindAddress = ":8080"
+
+	options := managerOptions(appConfig, runtime.NewScheme(), cache.Options{})
+	require.Empty(t, options.HealthProbeBindAddress)
+	require.Empty(t, options.Metrics.BindAddress)
+
+	appConfig.Telemetry.Health.Enabled = true
+	appConfig.Telemetry.Metrics.Enabled = true
+	options = managerOptions(appConfig, runtime.NewScheme(), cache.Options{})
+	require.Equal(t, ":8181", options.HealthProbeBindAddress)
+	require.Equal(t, ":8080", options.Metrics.BindAddress)
+}
+
+func Test_should_run_telemetry_and_health_runnables_on_every_replica(t *testing.T) {
+	t.Parallel()
+
+	telemetry := nonLeaderRunnable{func(context.Context) error { return nil }}
+	probe := integration.CheckerProbe(func(*http.Request) error { return nil })
+	monitor := integration.NewHealthMonitor("default", probe, time.Second, 1, false)
+
+	for name, runnable := range map[string]manager.Runnable{"telemetry": telemetry, "health monitor": monitor} {
+		election, ok := runnable.(manager.LeaderElectionRunnable)
+		require.True(t, ok, name)
+		require.False(t, election.NeedLeaderElection(), name)
+	}
+}
+
+func Test_should_refuse_carp_pairs_on_the_ssh_backend(t *testing.T) {
+	t.Parallel()
+
+	var target configs.PfsenseTarget
+	target.Backend = configs.PfsenseBackendSSH
+	target.Pool.CARP.VHID = 10
+
+	_, _, err := configurePfsense(target, configs.Controller{}, nil, nil)
+	require.ErrorContains(t, err, "manages no virtual IPs")
+}
+
+func Test_should_refuse_carp_pairs_and_php_mutations_on_render_targets(t *testing.T) {
+	t.Parallel()
+
+	var target configs.PfsenseTarget
+	target.Render.Target = "file"
+	target.HA.Sync = true
+	_, _, err := configurePfsense(target, configs.Controller{}, nil, nil)
+	require.ErrorContains(t, err, "does not support carp pairs")
+
+	target.HA.Sync = false
+	target.Mutations = configs.PfsenseMutationsPHP
+	_, _, err = configurePfsense(target, configs.Controller{}, nil, nil)
+	require.ErrorContains(t, err, "does not support php mutations")
+}
@@ -0,0 +1,120 @@
+package testdata
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// MockOPNsenseServer mimics the OPNsense destination nat, virtual IP and alias api; the items are kept in memory.
+func MockOPNsenseServer() (string, manager.RunnableFunc) {
+	rules, vips, aliases := &opnsenseTable{key: "rule"}, &opnsenseTable{key: "vip"}, &opnsenseTable{key: "alias"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/core/firmware/status", opnsenseAuthorized(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"product_name": "OPNsense"})
+	}))
+	mux.HandleFunc("POST /api/firewall/d_nat/search_rule", opnsenseAuthorized(rules.search))
+	mux.HandleFunc("POST /api/firewall/d_nat/add_rule", opnsenseAuthorized(rules.add))
+	mux.HandleFunc("POST /api/firewall/d_nat/del_rule/{uuid}", opnsenseAuthorized(rules.delete))
+	mux.HandleFunc("POST /api/interfaces/vip_settings/search_item", opnsenseAuthorized(vips.search))
+	mux.HandleFunc("POST /api/interfaces/vip_settings/add_item", opnsenseAuthorized(vips.add))
+	mux.HandleFunc("POST /api/interfaces/vip_settings/del_item/{uuid}", opnsenseAuthorized(vips.delete))
+	mux.HandleFunc("POST /api/firewall/alias/search_item", opnsenseAuthorized(aliases.search))
+	mux.HandleFunc("POST /api/firewall/alias/add_item", opnsenseAuthorized(aliases.add))
+	mux.HandleFunc("POST /api/firewall/alias/del_item/{uuid}", opnsenseAuthorized(aliases.delete))
+	applied := func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+	mux.HandleFunc("POST /api/firewall/d_nat/apply", opnsenseAuthorized(applied))
+	mux.HandleFunc("POST /api/interfaces/vip_settings/reconfigure", opnsenseAuthorized(applied))
+	mux.HandleFunc("POST /api/firewall/alias/reconfigure", opnsenseAuthorized(applied))
+
+	srv := httptest.NewUnstartedServer(mux)
+	// httptest server binds to 127.0.0.1 so it is not accessible from docker containers
+	// we need to bind to 0.0.0.0
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		panic(err)
+	}
+	srv.Listener = l
+
+	return "http://" + l.Addr().String(), func(ctx context.Context) error {
+		srv.Start()
+		<-ctx.Done()
+		srv.Close()
+		slog.InfoContext(ctx, "mock opnsense server stopped")
+		return nil
+	}
+}
+
+func opnsenseAuthorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"status": "401", "message": "Authentication Failed"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// opnsenseTable keeps the items of one model, which the api wraps in the key when they are added
+type opnsenseTable struct {
+	key   string
+	mu    sync.Mutex
+	items []map[string]any
+}
+
+func (t *opnsenseTable) search(w http.ResponseWriter, _ *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rows":     t.items,
+		"rowCount": len(t.items),
+		"total":    len(t.items),
+		"current":  1,
+	})
+}
+
+func (t *opnsenseTable) add(w http.ResponseWriter, r *http.Request) {
+	var body map[string]map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body[t.key] == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"result": "failed"})
+		return
+	}
+	item := body[t.key]
+	id := uuid.NewString()
+	item["uuid"] = id
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items = append(t.items, item)
+	writeJSON(w, http.StatusOK, map[string]any{"result": "saved", "uuid": id})
+}
+
+func (t *opnsenseTable) delete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("uuid")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := slices.IndexFunc(t.items, func(item map[string]any) bool {
+		return item["uuid"] == id
+	})
+	if i < 0 {
+		writeJSON(w, http.StatusOK, map[string]any{"result": "not found"})
+		return
+	}
+	t.items = slices.Delete(t.items, i, i+1)
+	writeJSON(w, http.StatusOK, map[string]any{"result": "deleted"})
+}
+
+func writeJSON(w http.ResponseWriter, code int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(data)
+}
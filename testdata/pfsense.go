@@ -8,7 +8,9 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
+	"sync"
 
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
@@ -23,7 +25,8 @@ var backupConfigSectionResponse string
 
 func MockPfsenseServer() (string, manager.RunnableFunc) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/xmlrpc.php", xmlrpcHandler)
+	state := &pfsenseState{sections: map[string]string{}}
+	mux.HandleFunc("/xmlrpc.php", state.xmlrpcHandler)
 	srv := httptest.NewUnstartedServer(mux)
 	// httptest server binds to 127.0.0.1 so it is not accessible from docker containers
 	// we need to bind to 0.0.0.0
@@ -55,7 +58,18 @@ func loadResponse(filename string) string {
 	return string(b)
 }
 
-func xmlrpcHandler(w http.ResponseWriter, r *http.Request) {
+// pfsenseState keeps the restored sections, so they are read back like from pfsense
+type pfsenseState struct {
+	mu       sync.Mutex
+	sections map[string]string
+}
+
+var (
+	sectionNamePattern      = regexp.MustCompile(`^<value><struct><member><name>(\w+)</name>`)
+	requestedSectionPattern = regexp.MustCompile(`<data><value><string>(\w+)</string></value></data>`)
+)
+
+func (s *pfsenseState) xmlrpcHandler(w http.ResponseWriter, r *http.Request) {
 	bytedata, _ := io.ReadAll(r.Body)
 	body := string(bytedata)
 	slog.InfoContext(r.Context(), "mock pfsense server received request", "body", body)
@@ -63,8 +77,9 @@ func xmlrpcHandler(w http.ResponseWriter, r *http.Request) {
 	if strings.Contains(body, "pfsense.host_firmware_version") {
 		response = hostFirmwareVersionResponse
 	} else if strings.Contains(body, "pfsense.backup_config_section") {
-		response = backupConfigSectionResponse
+		response = s.backup(body)
 	} else if strings.Contains(body, "pfsense.restore_config_section") {
+		s.restore(body)
 		response = acceptedResponse
 	} else {
 		response = notFoundResponse
@@ -73,3 +88,27 @@ func xmlrpcHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
 	_, _ = w.Write([]byte(response))
 }
+
+func (s *pfsenseState) backup(body string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := requestedSectionPattern.FindStringSubmatch(body); m != nil {
+		if section, ok := s.sections[m[1]]; ok {
+			return `<?xml version="1.0"?><methodResponse><params><param>` + section + `</param></params></methodResponse>`
+		}
+	}
+	return backupConfigSectionResponse
+}
+
+func (s *pfsenseState) restore(body string) {
+	_, param, ok := strings.Cut(body, "<params><param>")
+	if !ok {
+		return
+	}
+	param, _, _ = strings.Cut(param, "</param>")
+	if m := sectionNamePattern.FindStringSubmatch(param); m != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.sections[m[1]] = param
+	}
+}
@@ -0,0 +1,141 @@
+package testdata
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const mockPfsenseJWT = "mock-jwt"
+
+// MockPfsenseRESTServer mimics the pfSense REST API package; port forwards, virtual IPs and aliases are kept in memory.
+func MockPfsenseRESTServer() (string, manager.RunnableFunc) {
+	s := &restState{portForwards: &restTable{}, virtualIPs: &restTable{}, aliases: &restTable{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/auth/jwt", func(w http.ResponseWriter, _ *http.Request) {
+		writeRESTResponse(w, http.StatusOK, map[string]string{"token": mockPfsenseJWT})
+	})
+	mux.HandleFunc("GET /api/v2/status/system", s.authorized(func(w http.ResponseWriter, _ *http.Request) {
+		writeRESTResponse(w, http.StatusOK, map[string]string{"platform": "pfSense"})
+	}))
+	mux.HandleFunc("GET /api/v2/firewall/nat/port_forwards", s.authorized(s.portForwards.list))
+	mux.HandleFunc("POST /api/v2/firewall/nat/port_forward", s.authorized(s.portForwards.create))
+	mux.HandleFunc("DELETE /api/v2/firewall/nat/port_forward", s.authorized(s.portForwards.delete))
+	mux.HandleFunc("GET /api/v2/firewall/virtual_ips", s.authorized(s.virtualIPs.list))
+	mux.HandleFunc("POST /api/v2/firewall/virtual_ip", s.authorized(s.virtualIPs.create))
+	mux.HandleFunc("DELETE /api/v2/firewall/virtual_ip", s.authorized(s.virtualIPs.delete))
+	mux.HandleFunc("GET /api/v2/firewall/aliases", s.authorized(s.aliases.list))
+	mux.HandleFunc("POST /api/v2/firewall/alias", s.authorized(s.aliases.create))
+	mux.HandleFunc("DELETE /api/v2/firewall/alias", s.authorized(s.aliases.delete))
+	applied := func(w http.ResponseWriter, _ *http.Request) {
+		writeRESTResponse(w, http.StatusOK, map[string]bool{"applied": true})
+	}
+	mux.HandleFunc("POST /api/v2/firewall/apply", s.authorized(applied))
+	mux.HandleFunc("POST /api/v2/firewall/virtual_ip/apply", s.authorized(applied))
+
+	srv := httptest.NewUnstartedServer(mux)
+	// httptest server binds to 127.0.0.1 so it is not accessible from docker containers
+	// we need to bind to 0.0.0.0
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		panic(err)
+	}
+	srv.Listener = l
+
+	return "http://" + l.Addr().String(), func(ctx context.Context) error {
+		srv.Start()
+		<-ctx.Done()
+		srv.Close()
+		slog.InfoContext(ctx, "mock pfsense rest server stopped")
+		return nil
+	}
+}
+
+type restState struct {
+	portForwards *restTable
+	virtualIPs   *restTable
+	aliases      *restTable
+}
+
+func (s *restState) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") == "" && r.Header.Get("Authorization") != "Bearer "+mockPfsenseJWT {
+			writeRESTResponse(w, http.StatusUnauthorized, nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// restTable keeps the objects of one config section, which the api addresses by their positions
+type restTable struct {
+	mu      sync.Mutex
+	objects []map[string]any
+}
+
+func (t *restTable) list(w http.ResponseWriter, _ *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	writeRESTResponse(w, http.StatusOK, t.withIDs())
+}
+
+func (t *restTable) create(w http.ResponseWriter, r *http.Request) {
+	var object map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		writeRESTResponse(w, http.StatusBadRequest, nil)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// virtual IPs get a uniqid, which the mock hands out for every object
+	object["uniqid"] = strconv.FormatInt(time.Now().UnixNano(), 16)
+	t.objects = append(t.objects, object)
+	writeRESTResponse(w, http.StatusOK, t.withIDs()[len(t.objects)-1])
+}
+
+func (t *restTable) delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil || id < 0 || id >= len(t.objects) {
+		writeRESTResponse(w, http.StatusNotFound, nil)
+		return
+	}
+	t.objects = slices.Delete(t.objects, id, id+1)
+	writeRESTResponse(w, http.StatusOK, nil)
+}
+
+// withIDs returns the objects with their positions as ids, the same way pfsense does
+func (t *restTable) withIDs() []map[string]any {
+	out := make([]map[string]any, len(t.objects))
+	for i, object := range t.objects {
+		out[i] = map[string]any{"id": i}
+		for k, v := range object {
+			if k != "id" {
+				out[i][k] = v
+			}
+		}
+	}
+	return out
+}
+
+func writeRESTResponse(w http.ResponseWriter, code int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"code":        code,
+		"status":      http.StatusText(code),
+		"response_id": "MOCK_" + strconv.Itoa(code),
+		"message":     "",
+		"data":        data,
+	})
+}
@@ -0,0 +1,140 @@
+package testdata
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// MockPfsenseSSHServer stands in for the pfSense ssh shell. It does not run php; it recognizes the
+// section backup and restore scripts by the config functions they call and keeps sections in memory.
+// It returns the address and the host key in the authorized_keys format.
+func MockPfsenseSSHServer(authorizedKey ssh.PublicKey) (string, string, manager.RunnableFunc) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		panic(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	// we need to bind to 0.0.0.0 so the server is accessible from docker containers
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		panic(err)
+	}
+
+	s := &sshState{sections: map[string]json.RawMessage{}}
+	hostKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())))
+	return l.Addr().String(), hostKey, func(ctx context.Context) error {
+		go func() {
+			<-ctx.Done()
+			_ = l.Close()
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				slog.InfoContext(ctx, "mock pfsense ssh server stopped")
+				return nil //nolint:nilerr
+			}
+			go s.serve(conn, config)
+		}
+	}
+}
+
+type sshState struct {
+	mu       sync.Mutex
+	sections map[string]json.RawMessage
+}
+
+func (s *sshState) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+func (s *sshState) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		_ = req.Reply(true, nil)
+		status := s.exec(payload.Command, channel, channel.Stderr())
+		exitStatus := make([]byte, 4)
+		binary.BigEndian.PutUint32(exitStatus, status)
+		_, _ = channel.SendRequest("exit-status", false, exitStatus)
+		return
+	}
+}
+
+func (s *sshState) exec(command string, channel io.ReadWriter, stderr io.Writer) uint32 {
+	fields := strings.Fields(command)
+	section := fields[len(fields)-1]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case command == "cat /etc/version":
+		_, _ = io.WriteString(channel, "2.7.2-RELEASE\n")
+	case strings.Contains(command, "config_get_path"):
+		data, ok := s.sections[section]
+		if !ok {
+			data = json.RawMessage("{}")
+		}
+		_, _ = channel.Write(data)
+	case strings.Contains(command, "config_set_path"):
+		data, err := io.ReadAll(channel)
+		if err != nil || !json.Valid(data) {
+			_, _ = io.WriteString(stderr, "section is not a json object")
+			return 1
+		}
+		s.sections[section] = data
+		_, _ = io.WriteString(channel, "ok")
+	default:
+		_, _ = io.WriteString(stderr, "unsupported command: "+command)
+		return 127
+	}
+	return 0
+}